@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Access is the kind of access to a topic checked by an Authorizer
+type Access byte
+
+const (
+	// AccessRead is subscribing to a topic filter
+	AccessRead Access = 1 << iota
+	// AccessWrite is publishing on a topic
+	AccessWrite
+	// AccessReadWrite grants both
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+// Authorizer decides whether a client may publish on a topic or subscribe
+// to a topic filter
+type Authorizer interface {
+	Authorize(clientID string, username string, access Access, topic string) bool
+}
+
+// aclRule grants access to the topics matching pattern, a rule without
+// access denies them
+type aclRule struct {
+	access  Access
+	pattern string
+}
+
+// ACL is a list of topic rules loaded from a file. Each line is one of
+//
+//	user <username>
+//	topic [read|write|readwrite|deny] <pattern>
+//	pattern [read|write|readwrite|deny] <pattern>
+//
+// "topic" rules before the first "user" line apply to every client, after
+// it to that user only. "pattern" rules apply to every client. "%c" and
+// "%u" in patterns stand for the client ID and the user name. The access
+// defaults to readwrite. A topic is denied if a matching rule denies it or
+// if no rule grants the access. Lines starting with '#' are comments.
+type ACL struct {
+	global []aclRule
+	users  map[string][]aclRule
+}
+
+// LoadACL reads ACL rules from a file
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL reads ACL rules, see ACL for the format
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{users: make(map[string][]aclRule)}
+	scanner := bufio.NewScanner(r)
+	user := ""
+	inUser := false
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "user":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("acl line %d: user needs a name", n)
+			}
+			user, inUser = fields[1], true
+		case "topic", "pattern":
+			rule, err := parseACLRule(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("acl line %d: %s", n, err)
+			}
+			if fields[0] == "topic" && inUser {
+				acl.users[user] = append(acl.users[user], rule)
+			} else {
+				acl.global = append(acl.global, rule)
+			}
+		default:
+			return nil, fmt.Errorf("acl line %d: unknown keyword %q", n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseACLRule(fields []string) (aclRule, error) {
+	var rule aclRule
+	switch len(fields) {
+	case 1:
+		rule.access, rule.pattern = AccessReadWrite, fields[0]
+	case 2:
+		switch fields[0] {
+		case "read":
+			rule.access = AccessRead
+		case "write":
+			rule.access = AccessWrite
+		case "readwrite":
+			rule.access = AccessReadWrite
+		case "deny":
+			rule.access = 0
+		default:
+			return rule, fmt.Errorf("unknown access %q", fields[0])
+		}
+		rule.pattern = fields[1]
+	default:
+		return rule, fmt.Errorf("topic rule needs [access] pattern")
+	}
+	return rule, nil
+}
+
+// Authorize implements Authorizer
+func (this *ACL) Authorize(clientID string, username string, access Access, topic string) bool {
+	allowed := false
+	for _, rules := range [][]aclRule{this.global, this.users[username]} {
+		for _, rule := range rules {
+			pattern, ok := expandPattern(rule.pattern, clientID, username)
+			if !ok {
+				continue
+			}
+			if rule.access == 0 {
+				// a filter reaching any denied topic is denied
+				if aclOverlap(pattern, access, topic) {
+					return false
+				}
+				continue
+			}
+			if rule.access&access == access && aclMatch(pattern, access, topic) {
+				allowed = true
+			}
+		}
+	}
+	return allowed
+}
+
+// expandPattern replaces %c and %u of a pattern. Rules naming an empty
+// user name or values with wildcards or '/' never apply.
+func expandPattern(pattern string, clientID string, username string) (string, bool) {
+	if !strings.Contains(pattern, "%") {
+		return pattern, true
+	}
+	for _, sub := range []struct{ key, value string }{{"%c", clientID}, {"%u", username}} {
+		if !strings.Contains(pattern, sub.key) {
+			continue
+		}
+		if sub.value == "" || strings.ContainsAny(sub.value, "+#/") {
+			return "", false
+		}
+		pattern = strings.Replace(pattern, sub.key, sub.value, -1)
+	}
+	return pattern, true
+}
+
+// aclMatch reports whether a rule pattern covers a topic name on write or
+// every topic of a topic filter on read
+func aclMatch(pattern string, access Access, topic string) bool {
+	if access == AccessWrite {
+		return matchTopic(pattern, topic)
+	}
+	pl := strings.Split(pattern, "/")
+	fl := strings.Split(topic, "/")
+	for i, p := range pl {
+		if p == "#" {
+			return true
+		}
+		if i >= len(fl) || fl[i] == "#" {
+			return false
+		}
+		if p != "+" && p != fl[i] {
+			return false
+		}
+	}
+	return len(pl) == len(fl)
+}
+
+// aclOverlap reports whether a rule pattern and a topic name, or on read a
+// topic filter, have a topic in common
+func aclOverlap(pattern string, access Access, topic string) bool {
+	if access == AccessWrite {
+		return matchTopic(pattern, topic)
+	}
+	pl := strings.Split(pattern, "/")
+	fl := strings.Split(topic, "/")
+	for i := 0; i < len(pl) && i < len(fl); i++ {
+		if pl[i] == "#" || fl[i] == "#" {
+			return true
+		}
+		if pl[i] != "+" && fl[i] != "+" && pl[i] != fl[i] {
+			return false
+		}
+	}
+	return len(pl) == len(fl)
+}
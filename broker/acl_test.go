@@ -0,0 +1,269 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func mustParseACL(t *testing.T, rules string) *ACL {
+	t.Helper()
+	acl, err := ParseACL(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acl
+}
+
+func TestParseACLErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   string
+	}{
+		{"topic a/b\nuser\n", "acl line 2: user needs a name"},
+		{"# comment\n\ntopic\n", "acl line 3: topic rule needs [access] pattern"},
+		{"topic read a/b c\n", "acl line 1: topic rule needs [access] pattern"},
+		{"topic a\ngroup admins\n", "acl line 2: unknown keyword \"group\""},
+		{"pattern publish a/%c\n", "acl line 1: unknown access \"publish\""},
+	}
+	for _, tt := range tests {
+		_, err := ParseACL(strings.NewReader(tt.rules))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: error %v, want %s", tt.rules, err, tt.err)
+		}
+	}
+}
+
+func TestACLAuthorize(t *testing.T) {
+	acl := mustParseACL(t, `
+# every client
+topic read public/#
+topic write in/+
+pattern readwrite clients/%c/#
+pattern read users/%u/+
+
+user alice
+topic alice/#
+topic deny alice/secret
+`)
+	tests := []struct {
+		clientID string
+		username string
+		access   Access
+		topic    string
+		want     bool
+	}{
+		{"c1", "", AccessRead, "public/news", true},
+		{"c1", "", AccessRead, "public/#", true},
+		{"c1", "", AccessWrite, "public/news", false},
+		{"c1", "", AccessWrite, "in/x", true},
+		{"c1", "", AccessWrite, "in/x/y", false},
+		{"c1", "", AccessRead, "in/x", false},
+
+		// a filter is granted if the rule covers all of its topics
+		{"c1", "", AccessRead, "#", false},
+		{"c1", "", AccessRead, "public/+/x", true},
+
+		// %c and %u stand for the client ID and the user name
+		{"c1", "", AccessWrite, "clients/c1/status", true},
+		{"c1", "", AccessRead, "clients/c1/#", true},
+		{"c1", "", AccessWrite, "clients/c2/status", false},
+		{"c1", "bob", AccessRead, "users/bob/inbox", true},
+		{"c1", "bob", AccessRead, "users/alice/inbox", false},
+		{"c1", "", AccessRead, "users//inbox", false},
+		{"a/b", "", AccessWrite, "clients/a/b/status", false},
+
+		// user rules apply to that user only
+		{"c1", "alice", AccessWrite, "alice/inbox", true},
+		{"c1", "bob", AccessWrite, "alice/inbox", false},
+		{"c1", "alice", AccessRead, "public/news", true},
+	}
+	for _, tt := range tests {
+		if got := acl.Authorize(tt.clientID, tt.username, tt.access, tt.topic); got != tt.want {
+			t.Errorf("%s/%s access %d to %s: %t, want %t", tt.clientID, tt.username, tt.access, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestACLDenyOverAllow(t *testing.T) {
+	acl := mustParseACL(t, `
+topic deny private/#
+user alice
+topic #
+topic deny alice/secret
+`)
+	tests := []struct {
+		access Access
+		topic  string
+		want   bool
+	}{
+		{AccessWrite, "alice/inbox", true},
+		{AccessWrite, "alice/secret", false},
+		{AccessWrite, "private/x", false},
+		{AccessRead, "alice/+", false},
+		{AccessRead, "private/+/x", false},
+		{AccessRead, "+/x", false},
+		{AccessRead, "#", false},
+		{AccessRead, "public/#", true},
+	}
+	for _, tt := range tests {
+		if got := acl.Authorize("c1", "alice", tt.access, tt.topic); got != tt.want {
+			t.Errorf("access %d to %s: %t, want %t", tt.access, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// startACLServer serves a broker with an ACL allowing clients to read
+// every topic and to write below clients/<client ID> only
+func startACLServer(t *testing.T) *pipeListener {
+	t.Helper()
+	acl := mustParseACL(t, "topic read #\npattern write clients/%c/#\n")
+	_, l := startServer(t, func(srv *Server) {
+		srv.Authorizer = acl
+	})
+	return l
+}
+
+func TestACLPublish(t *testing.T) {
+	for _, v := range []byte{mqttp.MQTT311, mqttp.MQTT50} {
+		t.Run(versionName(v), func(t *testing.T) {
+			l := startACLServer(t)
+			sub := newTestClient(t, l.dial())
+			sub.connect(mqttp.MQTT50, "sub")
+			sub.subscribe("#", mqttp.QoS0)
+
+			c := newTestClient(t, l.dial())
+			c.connect(v, "c1")
+
+			// an unauthorized message is acknowledged but not forwarded,
+			// MQTT 5.0 clients are told by the reason code
+			pub := mqttp.NewPublish()
+			pub.SetTopic("clients/c2/x")
+			pub.SetQos(mqttp.QoS1)
+			pub.SetPacketID(1)
+			c.send(pub)
+			ack, ok := c.receive().(*mqttp.PubAck)
+			if !ok {
+				t.Fatal("expected PUBACK")
+			}
+			want := mqttp.CodeSuccess
+			if v == mqttp.MQTT50 {
+				want = mqttp.CodeNotAuthorized
+			}
+			if ack.ReasonCode() != want {
+				t.Errorf("PUBACK reason code 0x%02X, want 0x%02X", ack.ReasonCode().Value(), want.Value())
+			}
+			if pkt := sub.tryReceive(100 * time.Millisecond); pkt != nil {
+				t.Fatal("unauthorized message forwarded")
+			}
+
+			pub = mqttp.NewPublish()
+			pub.SetTopic("clients/c2/x")
+			pub.SetQos(mqttp.QoS2)
+			pub.SetPacketID(2)
+			c.send(pub)
+			rec, ok := c.receive().(*mqttp.PubRec)
+			if !ok {
+				t.Fatal("expected PUBREC")
+			}
+			if rec.ReasonCode() != want {
+				t.Errorf("PUBREC reason code 0x%02X, want 0x%02X", rec.ReasonCode().Value(), want.Value())
+			}
+
+			pub = mqttp.NewPublish()
+			pub.SetTopic("clients/c1/x")
+			pub.SetPayload([]byte("ok"))
+			c.send(pub)
+			got, ok := sub.receive().(*mqttp.Publish)
+			if !ok || got.Topic() != "clients/c1/x" {
+				t.Fatal("authorized message not forwarded")
+			}
+		})
+	}
+}
+
+func TestACLSubscribe(t *testing.T) {
+	acl := mustParseACL(t, "topic read public/#\n")
+	for _, v := range []byte{mqttp.MQTT311, mqttp.MQTT50} {
+		t.Run(versionName(v), func(t *testing.T) {
+			_, l := startServer(t, func(srv *Server) {
+				srv.Authorizer = acl
+			})
+			c := newTestClient(t, l.dial())
+			c.connect(v, "c1")
+
+			sub := mqttp.NewSubscribe()
+			sub.SetPacketID(1)
+			sub.AddTopic("public/+", mqttp.SubOps(mqttp.QoS1))
+			sub.AddTopic("#", mqttp.SubOps(mqttp.QoS1))
+			c.send(sub)
+			ack, ok := c.receive().(*mqttp.SubAck)
+			if !ok {
+				t.Fatal("expected SUBACK")
+			}
+			failure := mqttp.CodeUnspecifiedError
+			if v == mqttp.MQTT50 {
+				failure = mqttp.CodeNotAuthorized
+			}
+			codes := ack.ReasonCodes()
+			if len(codes) != 2 || codes[0] != mqttp.ReasonCode(mqttp.QoS1) || codes[1] != failure {
+				t.Errorf("SUBACK reason codes %v", codes)
+			}
+		})
+	}
+}
+
+// MQTT 3.1 has no failure return code in SUBACK
+func TestACLSubscribeMQTT31(t *testing.T) {
+	_, l := startServer(t, func(srv *Server) {
+		srv.Authorizer = mustParseACL(t, "topic read public/#\n")
+	})
+	c := newTestClient(t, l.dial())
+	c.connect(mqttp.MQTT31, "c1")
+	c.subscribe("public/+", mqttp.QoS1)
+
+	sub := mqttp.NewSubscribe()
+	sub.SetPacketID(2)
+	sub.AddTopic("#", mqttp.SubOps(mqttp.QoS1))
+	c.send(sub)
+	if !closed(c.conn, time.Second) {
+		t.Error("refused MQTT 3.1 subscription did not disconnect")
+	}
+}
+
+func TestACLWill(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"clients/c1/will", true},
+		{"clients/c2/will", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			l := startACLServer(t)
+			watcher := newTestClient(t, l.dial())
+			watcher.connect(mqttp.MQTT50, "watcher")
+			watcher.subscribe("clients/#", mqttp.QoS0)
+
+			c := newTestClient(t, l.dial())
+			connect := mqttp.NewConnect()
+			connect.SetVersion(mqttp.MQTT50)
+			connect.SetClean(true)
+			connect.SetClientID("c1")
+			connect.SetWill(tt.topic, []byte("gone"), mqttp.QoS0, false)
+			c.send(connect)
+			if _, ok := c.receive().(*mqttp.ConnAck); !ok {
+				t.Fatal("expected CONNACK")
+			}
+			c.conn.Close()
+
+			_, got := watcher.tryReceive(200 * time.Millisecond).(*mqttp.Publish)
+			if got != tt.want {
+				t.Errorf("will received %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// ConnInfo describes the network connection a CONNECT arrived on
+type ConnInfo struct {
+	Listener   string // name of the listener
+	RemoteAddr net.Addr
+	TLS        *tls.ConnectionState // nil for plain TCP
+
+	// Identity is the user name taken from the verified client
+	// certificate as selected by Server.CertIdentity, empty if none
+	Identity string
+}
+
+// AuthResult is the decision of an Authenticator
+type AuthResult int
+
+const (
+	// AuthIgnore leaves the decision to the next authenticator of a chain
+	AuthIgnore AuthResult = iota
+	// AuthAllow accepts the connection
+	AuthAllow
+	// AuthDeny refuses the connection with the returned reason code
+	AuthDeny
+)
+
+// Authenticator decides whether a client may connect. On AuthDeny the
+// reason code is sent in CONNACK. MQTT 5.0 codes such as
+// CodeBadUserOrPassword and CodeNotAuthorized are mapped to their MQTT 3.1.1
+// counterparts for older clients.
+type Authenticator interface {
+	Authenticate(pkt *mqttp.Connect, info *ConnInfo) (AuthResult, mqttp.ReasonCode)
+}
+
+// AuthFunc adapts a function to the Authenticator interface
+type AuthFunc func(pkt *mqttp.Connect, info *ConnInfo) (AuthResult, mqttp.ReasonCode)
+
+// Authenticate calls f(pkt, info)
+func (f AuthFunc) Authenticate(pkt *mqttp.Connect, info *ConnInfo) (AuthResult, mqttp.ReasonCode) {
+	return f(pkt, info)
+}
+
+// AuthChain asks its authenticators in order, the first one allowing or
+// denying decides. The connection is refused with CodeNotAuthorized if none
+// of them does.
+type AuthChain []Authenticator
+
+// Authenticate implements Authenticator
+func (this AuthChain) Authenticate(pkt *mqttp.Connect, info *ConnInfo) (AuthResult, mqttp.ReasonCode) {
+	for _, auth := range this {
+		result, code := auth.Authenticate(pkt, info)
+		if result != AuthIgnore {
+			return result, code
+		}
+	}
+	return AuthDeny, mqttp.CodeNotAuthorized
+}
+
+// connAckCode maps a CONNACK reason code to the return codes of MQTT 3.1.1
+func connAckCode(version byte, code mqttp.ReasonCode) mqttp.ReasonCode {
+	if version == mqttp.MQTT50 || code <= mqttp.CodeRefusedNotAuthorized {
+		return code
+	}
+	switch code {
+	case mqttp.CodeBadUserOrPassword:
+		return mqttp.CodeRefusedBadUsernameOrPassword
+	case mqttp.CodeInvalidClientID:
+		return mqttp.CodeRefusedIdentifierRejected
+	case mqttp.CodeUnsupportedProtocol:
+		return mqttp.CodeRefusedUnacceptableProtocolVersion
+	case mqttp.CodeServerUnavailable, mqttp.CodeServerBusy, mqttp.CodeServerShuttingDown:
+		return mqttp.CodeRefusedServerUnavailable
+	default:
+		return mqttp.CodeRefusedNotAuthorized
+	}
+}
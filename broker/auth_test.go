@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// fixedAuth decides every CONNECT the same way and counts the calls
+type fixedAuth struct {
+	result AuthResult
+	code   mqttp.ReasonCode
+	calls  int
+}
+
+func (this *fixedAuth) Authenticate(pkt *mqttp.Connect, info *ConnInfo) (AuthResult, mqttp.ReasonCode) {
+	this.calls++
+	return this.result, this.code
+}
+
+func TestAuthChain(t *testing.T) {
+	ignore := func() *fixedAuth { return &fixedAuth{result: AuthIgnore} }
+	allow := func() *fixedAuth { return &fixedAuth{result: AuthAllow} }
+	deny := func() *fixedAuth { return &fixedAuth{result: AuthDeny, code: mqttp.CodeBanned} }
+	tests := []struct {
+		name   string
+		auths  []*fixedAuth
+		result AuthResult
+		code   mqttp.ReasonCode
+		calls  []int
+	}{
+		{"first allows", []*fixedAuth{allow(), deny()}, AuthAllow, mqttp.CodeSuccess, []int{1, 0}},
+		{"first denies", []*fixedAuth{deny(), allow()}, AuthDeny, mqttp.CodeBanned, []int{1, 0}},
+		{"falls through", []*fixedAuth{ignore(), ignore(), allow()}, AuthAllow, mqttp.CodeSuccess, []int{1, 1, 1}},
+		{"none decides", []*fixedAuth{ignore(), ignore()}, AuthDeny, mqttp.CodeNotAuthorized, []int{1, 1}},
+		{"empty", nil, AuthDeny, mqttp.CodeNotAuthorized, nil},
+	}
+	for _, tt := range tests {
+		var chain AuthChain
+		for _, auth := range tt.auths {
+			chain = append(chain, auth)
+		}
+		result, code := chain.Authenticate(mqttp.NewConnect(), &ConnInfo{})
+		if result != tt.result || code != tt.code {
+			t.Errorf("%s: %d 0x%02X, want %d 0x%02X", tt.name, result, code.Value(), tt.result, tt.code.Value())
+		}
+		for i, auth := range tt.auths {
+			if auth.calls != tt.calls[i] {
+				t.Errorf("%s: authenticator %d called %d times, want %d", tt.name, i, auth.calls, tt.calls[i])
+			}
+		}
+	}
+}
+
+func TestConnAckCode(t *testing.T) {
+	tests := []struct {
+		code mqttp.ReasonCode
+		v311 mqttp.ReasonCode
+	}{
+		{mqttp.CodeSuccess, mqttp.CodeSuccess},
+		{mqttp.CodeRefusedNotAuthorized, mqttp.CodeRefusedNotAuthorized},
+		{mqttp.CodeBadUserOrPassword, mqttp.CodeRefusedBadUsernameOrPassword},
+		{mqttp.CodeInvalidClientID, mqttp.CodeRefusedIdentifierRejected},
+		{mqttp.CodeUnsupportedProtocol, mqttp.CodeRefusedUnacceptableProtocolVersion},
+		{mqttp.CodeServerUnavailable, mqttp.CodeRefusedServerUnavailable},
+		{mqttp.CodeServerBusy, mqttp.CodeRefusedServerUnavailable},
+		{mqttp.CodeServerShuttingDown, mqttp.CodeRefusedServerUnavailable},
+		{mqttp.CodeNotAuthorized, mqttp.CodeRefusedNotAuthorized},
+		{mqttp.CodeBanned, mqttp.CodeRefusedNotAuthorized},
+	}
+	for _, tt := range tests {
+		for _, v := range []byte{mqttp.MQTT31, mqttp.MQTT311} {
+			if got := connAckCode(v, tt.code); got != tt.v311 {
+				t.Errorf("%s: 0x%02X mapped to 0x%02X, want 0x%02X", versionName(v), tt.code.Value(), got.Value(), tt.v311.Value())
+			}
+		}
+		if got := connAckCode(mqttp.MQTT50, tt.code); got != tt.code {
+			t.Errorf("MQTT 5.0: 0x%02X mapped to 0x%02X", tt.code.Value(), got.Value())
+		}
+	}
+}
+
+func TestAuthenticateRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		auth *fixedAuth
+		v    byte
+		want mqttp.ReasonCode
+	}{
+		{"denied 5.0", &fixedAuth{result: AuthDeny, code: mqttp.CodeBadUserOrPassword}, mqttp.MQTT50, mqttp.CodeBadUserOrPassword},
+		{"denied 3.1.1", &fixedAuth{result: AuthDeny, code: mqttp.CodeBadUserOrPassword}, mqttp.MQTT311, mqttp.CodeRefusedBadUsernameOrPassword},
+		{"denied without code", &fixedAuth{result: AuthDeny}, mqttp.MQTT50, mqttp.CodeNotAuthorized},
+		{"ignored 5.0", &fixedAuth{result: AuthIgnore}, mqttp.MQTT50, mqttp.CodeNotAuthorized},
+		{"ignored 3.1.1", &fixedAuth{result: AuthIgnore}, mqttp.MQTT311, mqttp.CodeRefusedNotAuthorized},
+		{"allowed", &fixedAuth{result: AuthAllow}, mqttp.MQTT311, mqttp.CodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, l := startServer(t, func(srv *Server) {
+				srv.Authenticator = tt.auth
+			})
+			c := newTestClient(t, l.dial())
+			if ack := c.connect(tt.v, "c1"); ack.ReasonCode() != tt.want {
+				t.Errorf("CONNACK reason code 0x%02X, want 0x%02X", ack.ReasonCode().Value(), tt.want.Value())
+			}
+		})
+	}
+}
@@ -0,0 +1,815 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+	"github.com/wonderivan/logger"
+)
+
+// outbound queue length per connection
+const sendQueueSize = 256
+
+// client is a single network connection speaking MQTT
+type client struct {
+	srv      *Server
+	listener *Listener
+	conn     net.Conn
+	dec      *mqttp.Decoder
+	enc      *mqttp.Encoder
+	id       string
+	username string
+	version  byte
+	limits   connLimits // taken on CONNECT
+
+	// connTimeout is the time to wait for CONNECT, 0 for no limit
+	connTimeout time.Duration
+
+	// keepAlive is the Keep Alive in effect, 0 if disabled
+	keepAlive time.Duration
+
+	maxPacketSize uint32 // largest packet accepted from the client
+	sendLimit     uint32 // largest packet the client accepts, 0 for no limit
+
+	out       chan mqttp.Packet
+	done      chan struct{}
+	closeOnce sync.Once
+
+	written       chan struct{} // closed when the write loop returns
+	disconnecting int32         // set once DISCONNECT is queued
+
+	stopped chan struct{}
+	session *session
+	expiry  uint32 // Session Expiry Interval asked for by CONNECT
+
+	will      *mqttp.Publish // will message, nil after a normal DISCONNECT
+	willDelay uint32         // Will Delay Interval in seconds
+
+	// unacked counts the inbound QoS 1 messages whose PUBACK is not
+	// written yet, they take slots of the Receive Maximum
+	unacked int32
+}
+
+func newClient(srv *Server, conn net.Conn, ln *Listener) *client {
+	dec, enc := mqttp.NewCodec(conn, conn)
+	srv.conf.RLock()
+	max := ln.MaxPacketSize
+	if max == 0 {
+		max = srv.MaxPacketSize
+	}
+	policy := reservePrefix(srv.ClientIDPolicy, srv.AssignedIDPrefix)
+	timeout := srv.ConnectTimeout
+	srv.conf.RUnlock()
+	dec.SetMaxPacketSize(max)
+	dec.SetClientIDPolicy(policy)
+	return &client{
+		srv:           srv,
+		listener:      ln,
+		conn:          conn,
+		dec:           dec,
+		enc:           enc,
+		maxPacketSize: max,
+		connTimeout:   timeout,
+		out:           make(chan mqttp.Packet, sendQueueSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		written:       make(chan struct{}),
+	}
+}
+
+// serve runs the read loop of the connection until it ends
+func (this *client) serve() {
+	defer this.listener.release()
+	defer this.srv.trackConn(this, false)
+	defer close(this.stopped)
+	defer this.close()
+
+	if this.connTimeout > 0 {
+		this.conn.SetReadDeadline(time.Now().Add(this.connTimeout))
+	}
+	pkt, err := this.dec.Decode()
+	if err == mqttp.CodeInvalidClientID && pkt != nil {
+		// refused with 0x85, or 0x02 for MQTT 3.1.1 [MQTT-3.1.3-9]
+		this.version = this.dec.Version()
+		logger.Warn(fmt.Sprintf("Client ID %q from %s refused by policy", pkt.(*mqttp.Connect).ClientID(), this.conn.RemoteAddr()))
+		this.refuse(mqttp.CodeInvalidClientID)
+		return
+	}
+	if err == mqttp.CodeUnsupportedProtocol {
+		// refused with 0x84, or 0x01 before MQTT 5.0 [MQTT-3.1.2-2]
+		this.version = mqttp.MQTT311
+		if pkt != nil && pkt.GetVersion() >= mqttp.MQTT50 {
+			this.version = mqttp.MQTT50
+		}
+		this.enc.SetVersion(this.version)
+		logger.Warn(fmt.Sprintf("Unsupported protocol from %s", this.conn.RemoteAddr()))
+		this.refuse(mqttp.CodeUnsupportedProtocol)
+		return
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed reading CONNECT from %s: %s", this.conn.RemoteAddr(), err))
+		return
+	}
+	connect, ok := pkt.(*mqttp.Connect)
+	if !ok {
+		logger.Error(fmt.Sprintf("First packet from %s is not CONNECT", this.conn.RemoteAddr()))
+		return
+	}
+	if !this.handleConnect(connect) {
+		return
+	}
+	defer this.srv.detach(this)
+	// from here on the Keep Alive bounds the reads
+	this.conn.SetReadDeadline(time.Time{})
+
+	go this.writeLoop()
+	defer this.flush()
+
+	// retransmit the unacknowledged messages of a resumed session, then
+	// the messages queued while it was offline
+	for _, pkt := range this.session.flight.pending() {
+		if p, ok := pkt.(*mqttp.Publish); ok {
+			this.prepare(p)
+		}
+		this.send(pkt)
+	}
+	for _, pkt := range this.session.flight.fill() {
+		this.forward(pkt)
+	}
+
+	for {
+		// a client silent for one and a half times the Keep Alive is
+		// disconnected [MQTT-3.1.2-22]
+		var deadline time.Time
+		if this.keepAlive > 0 {
+			deadline = time.Now().Add(this.keepAlive * 3 / 2)
+			this.conn.SetReadDeadline(deadline)
+		}
+		pkt, err := this.dec.Decode()
+		if err != nil && !deadline.IsZero() && !time.Now().Before(deadline) {
+			logger.Warn(fmt.Sprintf("Client %s keep alive timed out", this.id))
+			this.disconnect(mqttp.CodeKeepAliveTimeout)
+			return
+		}
+		if err == mqttp.CodePacketTooLarge {
+			logger.Warn(fmt.Sprintf("Client %s sent a packet over %d bytes", this.id, this.maxPacketSize))
+			this.disconnect(mqttp.CodePacketTooLarge)
+			return
+		}
+		if err != nil {
+			select {
+			case <-this.done:
+			default:
+				logger.Info(fmt.Sprintf("Client %s connection lost: %s", this.id, err))
+			}
+			return
+		}
+		if !this.handle(pkt) {
+			return
+		}
+	}
+}
+
+// writeLoop sends queued packets until the connection is closed
+func (this *client) writeLoop() {
+	defer close(this.written)
+	for {
+		select {
+		case pkt := <-this.out:
+			if !this.fits(pkt) {
+				this.dequeued(pkt)
+				continue
+			}
+			err := this.enc.Encode(pkt)
+			this.dequeued(pkt)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Client %s write failed: %s", this.id, err))
+				this.close()
+				return
+			}
+			if _, ok := pkt.(*mqttp.Disconnect); ok {
+				this.close()
+				return
+			}
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// send queues pkt for writing, it reports false when the connection is gone
+// or its queue is full
+func (this *client) send(pkt mqttp.Packet) bool {
+	select {
+	case this.out <- pkt:
+		return true
+	case <-this.done:
+		this.dequeued(pkt)
+		return false
+	default:
+		logger.Warn(fmt.Sprintf("Client %s send queue is full, dropping %s", this.id, pkt.String()))
+		this.dequeued(pkt)
+		return false
+	}
+}
+
+// dequeued is called once pkt is written or dropped. The payload buffer a
+// PUBLISH shares with the message it was forwarded from is given back, a
+// PUBACK frees its slot of the inbound window.
+func (this *client) dequeued(pkt mqttp.Packet) {
+	switch p := pkt.(type) {
+	case *mqttp.Publish:
+		p.Release()
+	case *mqttp.PubAck:
+		atomic.AddInt32(&this.unacked, -1)
+	}
+}
+
+// fits reports whether pkt is within the Maximum Packet Size of the client.
+// A PUBLISH too large for the client is dropped as if it had been
+// delivered [MQTT-3.1.2-25], so is one outside the mountpoint which has no
+// topic name left for the client. Other packets are always sent.
+func (this *client) fits(pkt mqttp.Packet) bool {
+	pub, ok := pkt.(*mqttp.Publish)
+	if !ok {
+		return true
+	}
+	if pub.Topic() == "" {
+		logger.Warn(fmt.Sprintf("Client %s: dropping message outside mountpoint %s", this.id, this.listener.Mountpoint))
+		if pub.GetQos() > mqttp.QoS0 {
+			this.complete(pub.GetPacketID())
+		}
+		return false
+	}
+	if this.sendLimit == 0 {
+		return true
+	}
+	if pub.GetVersion() != this.version {
+		pub.SetVersion(this.version)
+	}
+	if size := pub.Size(); size > int(this.sendLimit) {
+		logger.Warn(fmt.Sprintf("Client %s: dropping message on %s, %d bytes exceed its maximum packet size %d", this.id, pub.Topic(), size, this.sendLimit))
+		if pub.GetQos() > mqttp.QoS0 {
+			this.complete(pub.GetPacketID())
+		}
+		return false
+	}
+	return true
+}
+
+// flushTimeout bounds the wait for a DISCONNECT to be written before the
+// connection is closed
+const flushTimeout = 5 * time.Second
+
+// flush waits for a queued DISCONNECT to be written, so that the read loop
+// ending the connection does not close it before the client is told why
+func (this *client) flush() {
+	if atomic.LoadInt32(&this.disconnecting) == 0 {
+		return
+	}
+	select {
+	case <-this.written:
+	case <-time.After(flushTimeout):
+	}
+}
+
+// close tears the network connection down, it is safe to call more than once
+func (this *client) close() {
+	this.closeOnce.Do(func() {
+		close(this.done)
+		this.conn.Close()
+	})
+}
+
+// disconnect sends DISCONNECT with the reason code to MQTT 5.0 clients and
+// closes the connection once it is written
+func (this *client) disconnect(code mqttp.ReasonCode) {
+	if this.version != mqttp.MQTT50 {
+		this.close()
+		return
+	}
+	pkt := mqttp.NewDisconnect()
+	pkt.SetReasonCode(code)
+	if !this.send(pkt) {
+		this.close()
+		return
+	}
+	atomic.StoreInt32(&this.disconnecting, 1)
+}
+
+func (this *client) handleConnect(pkt *mqttp.Connect) bool {
+	this.version = this.dec.Version()
+	this.id = pkt.ClientID()
+	this.username, _ = pkt.Credentials()
+	this.limits = this.srv.limits()
+
+	// a client without ID gets one assigned, MQTT 3.1.1 clients cannot
+	// learn it and must not resume a session [MQTT-3.1.3-6] [MQTT-3.1.3-8]
+	assigned := this.id == ""
+	if assigned {
+		if this.version != mqttp.MQTT50 && !pkt.IsClean() {
+			logger.Warn(fmt.Sprintf("Client from %s without client ID asked for a session", this.conn.RemoteAddr()))
+			this.refuse(mqttp.CodeInvalidClientID)
+			return false
+		}
+		this.id = this.srv.assignClientID(this.limits.idPrefix, this.limits.idFormat)
+	}
+
+	this.srv.conf.RLock()
+	allowed := this.listener.allowsVersion(this.version)
+	this.srv.conf.RUnlock()
+	if !allowed {
+		logger.Warn(fmt.Sprintf("Client %s: MQTT %s is not allowed on listener %s", this.id, versionName(this.version), this.listener))
+		this.refuse(mqttp.CodeUnsupportedProtocol)
+		return false
+	}
+
+	info := this.connInfo()
+	if info.Identity != "" {
+		this.username = info.Identity
+	}
+	if !this.authenticate(pkt, info) {
+		return false
+	}
+	// a will the server cannot publish refuses the connection [MQTT-3.2.2-12] [MQTT-3.2.2-13]
+	if pkt.HasWill() && pkt.WillQos() > this.limits.maximumQoS {
+		this.refuse(mqttp.CodeNotSupportedQoS)
+		return false
+	}
+	if pkt.HasWill() && pkt.WillRetain() && !this.limits.retainAvailable {
+		this.refuse(mqttp.CodeRetainNotSupported)
+		return false
+	}
+
+	// a Maximum Packet Size of zero is a protocol error [MQTT-3.1.2-24]
+	if this.version == mqttp.MQTT50 {
+		if n, ok := pkt.Props().MaximumPacketSize(); ok {
+			if n == 0 {
+				this.refuse(mqttp.CodeProtocolError)
+				return false
+			}
+			this.sendLimit = n
+		}
+	}
+
+	keepAlive := this.serverKeepAlive(pkt)
+	this.keepAlive = time.Duration(keepAlive) * time.Second
+
+	sendMax := this.sendWindow(pkt)
+	recvMax := int(this.limits.receiveMaximum)
+	this.expiry = this.sessionExpiry(pkt)
+	flight := newInflight(sendMax, recvMax, this.limits.maxQueued)
+
+	s, present := this.srv.attach(this, pkt.IsClean(), this.expiry, flight)
+	this.session = s
+	s.flight.setLimits(sendMax, recvMax)
+
+	ack := mqttp.NewConnAck()
+	ack.SetReasonCode(mqttp.CodeSuccess)
+	ack.SetSessionPresent(present)
+	if this.version == mqttp.MQTT50 {
+		ack.Props().SetReceiveMaximum(this.limits.receiveMaximum)
+		this.setCapabilities(ack)
+		if assigned {
+			ack.Props().SetAssignedClientIdentifier(this.id)
+		}
+		if keepAlive != pkt.KeepAlive() {
+			// the client uses the Server Keep Alive instead of its own [MQTT-3.2.2-21]
+			ack.Props().SetServerKeepAlive(keepAlive)
+		}
+		// tell the client when its Session Expiry Interval was capped [MQTT-3.2.2-3]
+		if asked, _ := pkt.Props().SessionExpiryInterval(); asked != this.expiry {
+			ack.Props().SetSessionExpiryInterval(this.expiry)
+		}
+	}
+	err := this.enc.Encode(ack)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Client %s failed writing CONNACK: %s", this.id, err))
+		this.srv.detach(this)
+		return false
+	}
+	if pkt.HasWill() {
+		this.will, this.willDelay = newWill(pkt)
+		if !this.authorized(AccessWrite, this.will.Topic()) {
+			logger.Warn(fmt.Sprintf("Client %s is not authorized to publish its will on %s", this.id, this.will.Topic()))
+			this.will = nil
+		} else {
+			this.will.SetTopic(this.listener.mount(this.will.Topic()))
+		}
+	}
+	logger.Info(fmt.Sprintf("Client %s connected from %s", this.id, this.conn.RemoteAddr()))
+	return true
+}
+
+// authenticate asks the Authenticator of the server about the CONNECT and
+// refuses the connection in CONNACK when it is denied
+func (this *client) authenticate(pkt *mqttp.Connect, info *ConnInfo) bool {
+	this.srv.conf.RLock()
+	auth := this.listener.Authenticator
+	if auth == nil {
+		auth = this.srv.Authenticator
+	}
+	this.srv.conf.RUnlock()
+	if auth == nil {
+		return true
+	}
+	result, code := auth.Authenticate(pkt, info)
+	if result == AuthAllow {
+		return true
+	}
+	if result == AuthIgnore || code == mqttp.CodeSuccess {
+		code = mqttp.CodeNotAuthorized
+	}
+	logger.Warn(fmt.Sprintf("Client %s from %s refused: %s", this.id, this.conn.RemoteAddr(), code.Desc()))
+	this.refuse(code)
+	return false
+}
+
+// setCapabilities adds the properties of the features the server lacks
+// to CONNACK, absent properties mean supported
+func (this *client) setCapabilities(ack *mqttp.ConnAck) {
+	props := ack.Props()
+	if this.limits.maximumQoS < mqttp.QoS2 {
+		props.SetMaximumQoS(this.limits.maximumQoS)
+	}
+	if !this.limits.retainAvailable {
+		props.SetRetainAvailable(0)
+	}
+	if !this.limits.wildcardSubscriptions {
+		props.SetWildcardSubscriptionAvailable(0)
+	}
+	if !this.limits.sharedSubscriptions {
+		props.SetSharedSubscriptionAvailable(0)
+	}
+	// Subscription Identifiers are not implemented
+	props.SetSubscriptionIdentifierAvailable(0)
+	if this.maxPacketSize > 0 {
+		props.SetMaximumPacketSize(this.maxPacketSize)
+	}
+}
+
+// refuse answers CONNECT with a failure reason code in CONNACK
+func (this *client) refuse(code mqttp.ReasonCode) {
+	ack := mqttp.NewConnAck()
+	ack.SetReasonCode(connAckCode(this.version, code))
+	err := this.enc.Encode(ack)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Client %s failed writing CONNACK: %s", this.id, err))
+	}
+}
+
+// authorized asks the Authorizer of the server whether the client may
+// access a topic
+func (this *client) authorized(access Access, topic string) bool {
+	authz := this.srv.authorizer()
+	if authz == nil {
+		return true
+	}
+	return authz.Authorize(this.id, this.username, access, topic)
+}
+
+// connInfo describes the network connection for authenticators
+func (this *client) connInfo() *ConnInfo {
+	info := &ConnInfo{Listener: this.listener.String(), RemoteAddr: this.conn.RemoteAddr()}
+	if state := tlsState(this.conn); state != nil {
+		info.TLS = state
+		this.srv.conf.RLock()
+		identity := this.srv.CertIdentity
+		this.srv.conf.RUnlock()
+		info.Identity = identity.identity(state)
+	}
+	return info
+}
+
+// tlsState returns the TLS state of a connection, nil for plain TCP
+func tlsState(conn net.Conn) *tls.ConnectionState {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		return &state
+	case *wsConn:
+		return tlsState(c.Conn)
+	}
+	return nil
+}
+
+// handle dispatches a packet, it returns false when the connection must end
+func (this *client) handle(pkt mqttp.Packet) bool {
+	switch p := pkt.(type) {
+	case *mqttp.Publish:
+		return this.handlePublish(p)
+	case *mqttp.PubAck:
+		this.complete(p.GetPacketID())
+	case *mqttp.PubRec:
+		this.handlePubRec(p)
+	case *mqttp.PubRel:
+		comp := mqttp.NewPubComp()
+		comp.SetPacketID(p.GetPacketID())
+		if !this.session.flight.release(p.GetPacketID()) {
+			comp.SetReasonCode(mqttp.CodePacketIDNotFound)
+		}
+		this.send(comp)
+	case *mqttp.PubComp:
+		this.complete(p.GetPacketID())
+	case *mqttp.Subscribe:
+		this.handleSubscribe(p)
+	case *mqttp.UnSubscribe:
+		this.handleUnSubscribe(p)
+	case *mqttp.PingReq:
+		this.send(mqttp.NewPingResp())
+	case *mqttp.Disconnect:
+		logger.Info(fmt.Sprintf("Client %s disconnected", this.id))
+		this.handleDisconnect(p)
+		return false
+	default:
+		// a second CONNECT or a server side packet is a protocol error [MQTT-3.1.0-2]
+		logger.Error(fmt.Sprintf("Client %s sent unexpected %s", this.id, pkt.String()))
+		this.disconnect(mqttp.CodeProtocolError)
+		return false
+	}
+	return true
+}
+
+func (this *client) handlePublish(pkt *mqttp.Publish) bool {
+	// the copies sent to subscribers hold their own reference to the payload
+	defer pkt.Release()
+	pid := pkt.GetPacketID()
+	// unauthorized messages are acknowledged but not forwarded, MQTT 5.0
+	// clients learn about it from the reason code
+	allowed := this.authorized(AccessWrite, pkt.Topic())
+	if !allowed {
+		logger.Warn(fmt.Sprintf("Client %s is not authorized to publish on %s", this.id, pkt.Topic()))
+	}
+	if pkt.GetQos() > this.limits.maximumQoS {
+		logger.Warn(fmt.Sprintf("Client %s sent QoS %d over the maximum", this.id, pkt.GetQos()))
+		this.disconnect(mqttp.CodeNotSupportedQoS)
+		return false
+	}
+	if pkt.GetRetain() && !this.limits.retainAvailable {
+		logger.Warn(fmt.Sprintf("Client %s sent a retained message", this.id))
+		this.disconnect(mqttp.CodeRetainNotSupported)
+		return false
+	}
+	pkt.SetTopic(this.listener.mount(pkt.Topic()))
+	switch pkt.GetQos() {
+	case mqttp.QoS0:
+		if allowed {
+			this.srv.publish(this, pkt)
+		}
+	case mqttp.QoS1:
+		// the message holds a slot of the window until its PUBACK is written
+		unacked := atomic.AddInt32(&this.unacked, 1)
+		if !this.session.flight.admit(int(unacked) - 1) {
+			logger.Warn(fmt.Sprintf("Client %s exceeded Receive Maximum", this.id))
+			this.disconnect(mqttp.CodeReceiveMaximumExceeded)
+			return false
+		}
+		ack := mqttp.NewPubAck()
+		ack.SetPacketID(pid)
+		if allowed {
+			this.srv.publish(this, pkt)
+		} else if this.version == mqttp.MQTT50 {
+			ack.SetReasonCode(mqttp.CodeNotAuthorized)
+		}
+		this.send(ack)
+	case mqttp.QoS2:
+		if !allowed && this.version == mqttp.MQTT50 {
+			// a failure reason code ends the flow, no PUBREL follows
+			rec := mqttp.NewPubRec()
+			rec.SetPacketID(pid)
+			rec.SetReasonCode(mqttp.CodeNotAuthorized)
+			this.send(rec)
+			return true
+		}
+		// deliver on the first PUBLISH only, duplicates just get a PUBREC again
+		dup, exceeded := this.session.flight.receive(pid, int(atomic.LoadInt32(&this.unacked)))
+		if exceeded {
+			logger.Warn(fmt.Sprintf("Client %s exceeded Receive Maximum", this.id))
+			this.disconnect(mqttp.CodeReceiveMaximumExceeded)
+			return false
+		}
+		if !dup && allowed {
+			this.srv.publish(this, pkt)
+		}
+		rec := mqttp.NewPubRec()
+		rec.SetPacketID(pid)
+		this.send(rec)
+	default:
+		this.disconnect(mqttp.CodeMalformedPacket)
+		return false
+	}
+	return true
+}
+
+func (this *client) handleSubscribe(pkt *mqttp.Subscribe) {
+	if this.version == mqttp.MQTT50 && len(pkt.Props().SubscriptionIdentifiers()) > 0 {
+		this.disconnect(mqttp.CodeSubscriptionIDNotSupported)
+		return
+	}
+	ack := mqttp.NewSubAck()
+	ack.SetPacketID(pkt.GetPacketID())
+	// retained messages are sent after SUBACK
+	var retained []*mqttp.Publish
+	var granted []mqttp.SubOps
+	for _, tops := range pkt.TopicOpsList() {
+		filter := tops.TopicFilter()
+		_, topicFilter, shared := parseShared(filter)
+		if !shared {
+			topicFilter = filter
+		}
+		if !mqttp.TopicFilterRegexp.MatchString(topicFilter) {
+			if !this.refuseFilter(ack, mqttp.CodeInvalidTopicFilter) {
+				return
+			}
+			continue
+		}
+		if shared && !this.limits.sharedSubscriptions {
+			if !this.refuseFilter(ack, mqttp.CodeSharedSubscriptionNotSupported) {
+				return
+			}
+			continue
+		}
+		if !this.limits.wildcardSubscriptions && strings.ContainsAny(topicFilter, "+#") {
+			if !this.refuseFilter(ack, mqttp.CodeWildcardSubscriptionsNotSupported) {
+				return
+			}
+			continue
+		}
+		if shared && tops.Options().NL() {
+			// No Local on a shared subscription is a protocol error [MQTT-3.8.3-4]
+			this.disconnect(mqttp.CodeProtocolError)
+			return
+		}
+		if !this.authorized(AccessRead, topicFilter) {
+			logger.Warn(fmt.Sprintf("Client %s is not authorized to subscribe to %s", this.id, filter))
+			if !this.refuseFilter(ack, mqttp.CodeNotAuthorized) {
+				return
+			}
+			continue
+		}
+		ops := tops.Options()
+		if ops.QoS() > this.limits.maximumQoS {
+			ops = ops.WithQoS(this.limits.maximumQoS)
+		}
+		existed := this.srv.subs.subscribe(this.id, this.listener.mount(filter), ops)
+		ack.AddReasonCode(mqttp.ReasonCode(ops.QoS()))
+
+		// no retained messages for shared subscriptions [MQTT-3.8.4-8] and
+		// Retain Handling 1 sends them for new subscriptions only, 2 never
+		handling := tops.Options().RetainHandling()
+		if shared || handling == 2 || (handling == 1 && existed) {
+			continue
+		}
+		for _, msg := range this.srv.retained.match(this.listener.mount(topicFilter)) {
+			retained = append(retained, msg)
+			granted = append(granted, ops)
+		}
+	}
+	this.send(ack)
+
+	for i, msg := range retained {
+		f := newFanout(msg)
+		this.session.deliver(f, grantedQoS(msg, granted[i]), true, "")
+		f.release()
+	}
+}
+
+func (this *client) handleUnSubscribe(pkt *mqttp.UnSubscribe) {
+	ack := mqttp.NewUnSubAck()
+	ack.SetPacketID(pkt.GetPacketID())
+	for _, filter := range pkt.TopicList {
+		existed := this.srv.subs.unsubscribe(this.id, this.listener.mount(filter))
+		// MQTT 3.1.1 UNSUBACK carries no payload
+		if this.version != mqttp.MQTT50 {
+			continue
+		}
+		if existed {
+			ack.AddReasonCode(mqttp.CodeSuccess)
+		} else {
+			ack.AddReasonCode(mqttp.CodeNoSubscriptionExisted)
+		}
+	}
+	this.send(ack)
+}
+
+// refuseFilter answers a topic filter of SUBSCRIBE which is not subscribed to.
+// MQTT 3.1.1 knows the single failure code 0x80, MQTT 3.1 has none and the
+// client is disconnected instead. It reports false when the connection is
+// closed and SUBACK must not be sent.
+func (this *client) refuseFilter(ack *mqttp.SubAck, code mqttp.ReasonCode) bool {
+	switch this.version {
+	case mqttp.MQTT50:
+		ack.AddReasonCode(code)
+	case mqttp.MQTT311:
+		ack.AddReasonCode(mqttp.CodeUnspecifiedError)
+	default:
+		logger.Warn(fmt.Sprintf("Client %s subscription refused with 0x%02X, disconnecting", this.id, code.Value()))
+		this.disconnect(code)
+		return false
+	}
+	return true
+}
+
+// prepare removes the mountpoint of the listener from the topic of an
+// outgoing message and sets its Message Expiry Interval to the time left
+// [MQTT-3.3.2-6]
+func (this *client) prepare(pkt *mqttp.Publish) *mqttp.Publish {
+	if this.listener.Mountpoint != "" {
+		pkt.SetValidTopic(this.listener.unmount(pkt.Topic()))
+	}
+	if expireAt := pkt.ExpireAt(); !expireAt.IsZero() && this.version == mqttp.MQTT50 {
+		left := time.Until(expireAt) + time.Second - 1
+		pkt.Props().SetMessageExpiryInterval(uint32(left / time.Second))
+	}
+	return pkt
+}
+
+// forward sends a QoS 1/2 message of the outbound window. The window keeps
+// pkt until it is acknowledged, the connection writes a prepared copy.
+func (this *client) forward(pkt *mqttp.Publish) {
+	this.send(this.prepare(pkt.Copy()))
+}
+
+// handleDisconnect takes the Session Expiry Interval of a MQTT 5.0
+// DISCONNECT. A session which was to end with the connection cannot be
+// kept by DISCONNECT [MQTT-3.14.2-2]. The will is dropped unless reason
+// code 0x04 asks for it [MQTT-3.14.4-3].
+func (this *client) handleDisconnect(pkt *mqttp.Disconnect) {
+	if this.version == mqttp.MQTT50 {
+		if expiry, ok := pkt.Props().SessionExpiryInterval(); ok {
+			if this.expiry == 0 && expiry != 0 {
+				logger.Error(fmt.Sprintf("Client %s set Session Expiry Interval on DISCONNECT", this.id))
+				this.disconnect(mqttp.CodeProtocolError)
+				return
+			}
+			if max := this.limits.maxSessionExpiry; max > 0 && expiry > max {
+				expiry = max
+			}
+			this.session.setExpiry(expiry)
+		}
+		if pkt.ReasonCode() == mqttp.CodeDisconnectWithWill {
+			return
+		}
+	}
+	this.will = nil
+}
+
+// serverKeepAlive is the Keep Alive of CONNECT within MinKeepAlive and
+// MaxKeepAlive. MQTT 3.1.1 clients cannot be told about another value and
+// keep theirs.
+func (this *client) serverKeepAlive(pkt *mqttp.Connect) uint16 {
+	v := pkt.KeepAlive()
+	if this.version != mqttp.MQTT50 {
+		return v
+	}
+	if max := this.limits.maxKeepAlive; max > 0 && (v == 0 || v > max) {
+		v = max
+	}
+	if min := this.limits.minKeepAlive; v > 0 && v < min {
+		v = min
+	}
+	return v
+}
+
+// sendWindow is the number of unacknowledged QoS 1/2 messages the client
+// accepts, the Receive Maximum of MQTT 5.0 clients [MQTT-3.3.4-7]
+func (this *client) sendWindow(pkt *mqttp.Connect) int {
+	if this.version != mqttp.MQTT50 {
+		return int(this.limits.maxInflight)
+	}
+	if v, ok := pkt.Props().ReceiveMaximum(); ok && v > 0 {
+		return int(v)
+	}
+	return 65535
+}
+
+func (this *client) handlePubRec(pkt *mqttp.PubRec) {
+	pid := pkt.GetPacketID()
+	// a failure reason code ends the flow [MQTT-4.3.3]
+	if pkt.ReasonCode() >= mqttp.CodeUnspecifiedError {
+		this.complete(pid)
+		return
+	}
+	rel, found := this.session.flight.received(pid)
+	if !found {
+		rel = mqttp.NewPubRel()
+		rel.SetPacketID(pid)
+		rel.SetReasonCode(mqttp.CodePacketIDNotFound)
+	}
+	this.send(rel)
+}
+
+// complete ends an outbound flow and sends the queued messages which fit
+// into the window now
+func (this *client) complete(pid uint16) {
+	ready, _ := this.session.flight.ack(pid)
+	for _, pkt := range ready {
+		this.forward(pkt)
+	}
+}
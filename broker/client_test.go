@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// connectKeepAlive connects with the given Keep Alive and returns the CONNACK
+func (this *testClient) connectKeepAlive(v byte, id string, keepAlive uint16) *mqttp.ConnAck {
+	this.t.Helper()
+	c := mqttp.NewConnect()
+	c.SetVersion(v)
+	c.SetClean(true)
+	c.SetClientID(id)
+	c.SetKeepAlive(keepAlive)
+	this.send(c)
+	ack, ok := this.receive().(*mqttp.ConnAck)
+	if !ok {
+		this.t.Fatal("expected CONNACK")
+	}
+	return ack
+}
+
+// closed reports whether the server closes conn within d
+func closed(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestConnectTimeout(t *testing.T) {
+	_, l := startServer(t, func(srv *Server) {
+		srv.ConnectTimeout = 100 * time.Millisecond
+	})
+
+	silent := l.dial()
+	defer silent.Close()
+	if !closed(silent, time.Second) {
+		t.Fatal("connection without CONNECT kept open")
+	}
+
+	// the Keep Alive takes over once connected, 0 disables it
+	c := newTestClient(t, l.dial())
+	c.connectKeepAlive(mqttp.MQTT311, "c1", 0)
+	time.Sleep(200 * time.Millisecond)
+	c.send(mqttp.NewPingReq())
+	if _, ok := c.receive().(*mqttp.PingResp); !ok {
+		t.Fatal("expected PINGRESP after the connect timeout")
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	_, l := startServer(t, nil)
+
+	// a client sending within the Keep Alive stays connected
+	alive := newTestClient(t, l.dial())
+	alive.connectKeepAlive(mqttp.MQTT50, "alive", 1)
+	for i := 0; i < 4; i++ {
+		time.Sleep(500 * time.Millisecond)
+		alive.send(mqttp.NewPingReq())
+		if _, ok := alive.receive().(*mqttp.PingResp); !ok {
+			t.Fatal("expected PINGRESP")
+		}
+	}
+
+	// a silent one is disconnected after one and a half times the Keep
+	// Alive [MQTT-3.1.2-22]
+	c5 := newTestClient(t, l.dial())
+	c5.connectKeepAlive(mqttp.MQTT50, "c5", 1)
+	start := time.Now()
+	d, ok := c5.tryReceive(3 * time.Second).(*mqttp.Disconnect)
+	if !ok || d.ReasonCode() != mqttp.CodeKeepAliveTimeout {
+		t.Fatal("expected DISCONNECT with keep alive timeout")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("disconnected after %s, before the Keep Alive", elapsed)
+	}
+
+	c3 := newTestClient(t, l.dial())
+	c3.connectKeepAlive(mqttp.MQTT311, "c3", 1)
+	if !closed(c3.conn, 3*time.Second) {
+		t.Fatal("silent MQTT 3.1.1 client kept connected")
+	}
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   byte
+		keepAlive uint16
+		want      uint16 // Keep Alive in effect
+		told      bool   // Server Keep Alive in CONNACK
+	}{
+		{"within bounds", mqttp.MQTT50, 20, 20, false},
+		{"above max", mqttp.MQTT50, 120, 60, true},
+		{"disabled", mqttp.MQTT50, 0, 60, true},
+		{"below min", mqttp.MQTT50, 5, 10, true},
+		{"MQTT 3.1.1 keeps its own", mqttp.MQTT311, 120, 120, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, l := startServer(t, func(srv *Server) {
+				srv.MinKeepAlive = 10
+				srv.MaxKeepAlive = 60
+			})
+			c := newTestClient(t, l.dial())
+			ack := c.connectKeepAlive(tt.version, "c1", tt.keepAlive)
+			v, ok := ack.Props().ServerKeepAlive()
+			if ok != tt.told || (ok && v != tt.want) {
+				t.Errorf("Server Keep Alive %d %t, want %d %t", v, ok, tt.want, tt.told)
+			}
+
+			srv.mu.Lock()
+			var keepAlive time.Duration
+			for conn := range srv.conns {
+				keepAlive = conn.keepAlive
+			}
+			srv.mu.Unlock()
+			if keepAlive != time.Duration(tt.want)*time.Second {
+				t.Errorf("Keep Alive in effect %s, want %ds", keepAlive, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerKeepAliveEnforced(t *testing.T) {
+	_, l := startServer(t, func(srv *Server) {
+		srv.MaxKeepAlive = 1
+	})
+	c := newTestClient(t, l.dial())
+	ack := c.connectKeepAlive(mqttp.MQTT50, "c1", 60)
+	if v, ok := ack.Props().ServerKeepAlive(); !ok || v != 1 {
+		t.Fatalf("Server Keep Alive %d %t, want 1", v, ok)
+	}
+	// the client is held to the Keep Alive of the server
+	d, ok := c.tryReceive(3 * time.Second).(*mqttp.Disconnect)
+	if !ok || d.ReasonCode() != mqttp.CodeKeepAliveTimeout {
+		t.Fatal("expected DISCONNECT with keep alive timeout")
+	}
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// ClientIDFormat chooses how client IDs are generated for clients which
+// connect with an empty one
+type ClientIDFormat string
+
+const (
+	// ClientIDRandom is 32 random hexadecimal digits, the default
+	ClientIDRandom ClientIDFormat = "random"
+	// ClientIDUUID is a random UUID as of RFC 4122 version 4
+	ClientIDUUID ClientIDFormat = "uuid"
+	// ClientIDSequence is a counter starting at 1 in every process. The IDs
+	// are easy to guess, use it with a prefix only.
+	ClientIDSequence ClientIDFormat = "sequence"
+)
+
+// ParseClientIDFormat checks the name of a ClientIDFormat, "" is random
+func ParseClientIDFormat(name string) (ClientIDFormat, error) {
+	switch v := ClientIDFormat(strings.ToLower(name)); v {
+	case "":
+		return ClientIDRandom, nil
+	case ClientIDRandom, ClientIDUUID, ClientIDSequence:
+		return v, nil
+	}
+	return ClientIDRandom, fmt.Errorf("unknown client ID format %q", name)
+}
+
+// generate returns a new identifier in the format
+func (this ClientIDFormat) generate(seq *uint64) string {
+	switch this {
+	case ClientIDSequence:
+		*seq++
+		return strconv.FormatUint(*seq, 10)
+	case ClientIDUUID:
+		b := make([]byte, 16)
+		rand.Read(b)
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// assignClientID returns a client ID no session uses
+func (this *Server) assignClientID(prefix string, format ClientIDFormat) string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for {
+		id := prefix + format.generate(&this.idSeq)
+		_, used := this.sessions[id]
+		_, busy := this.attaching[id]
+		if !used && !busy {
+			return id
+		}
+	}
+}
+
+// reservedPrefix refuses the client IDs starting with the prefix of the
+// assigned IDs, then asks the policy, so that no client takes an ID the
+// server may assign or the session of a client it assigned one to
+type reservedPrefix struct {
+	prefix string
+	policy mqttp.ClientIDPolicy
+}
+
+// reservePrefix returns policy with prefix reserved, policy itself if
+// prefix is empty. A nil policy is mqttp.DefaultClientIDPolicy.
+func reservePrefix(policy mqttp.ClientIDPolicy, prefix string) mqttp.ClientIDPolicy {
+	if policy == nil {
+		policy = mqttp.DefaultClientIDPolicy
+	}
+	if prefix == "" {
+		return policy
+	}
+	return &reservedPrefix{prefix: prefix, policy: policy}
+}
+
+// AllowClientID implements mqttp.ClientIDPolicy
+func (this *reservedPrefix) AllowClientID(id string) bool {
+	return !strings.HasPrefix(id, this.prefix) && this.policy.AllowClientID(id)
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func TestReservePrefix(t *testing.T) {
+	rules := &mqttp.ClientIDRules{Pattern: regexp.MustCompile(`^[a-z0-9-]+$`)}
+	tests := []struct {
+		name   string
+		policy mqttp.ClientIDPolicy
+		prefix string
+		id     string
+		allow  bool
+	}{
+		{"no prefix", nil, "", "1", true},
+		{"other id", nil, "auto-", "sensor-1", true},
+		{"reserved", nil, "auto-", "auto-1", false},
+		{"prefix alone", nil, "auto-", "auto-", false},
+		{"inside the id", nil, "auto-", "x-auto-1", true},
+		{"policy refuses", rules, "auto-", "Sensor", false},
+		{"policy allows", rules, "auto-", "sensor", true},
+		{"policy allows reserved", rules, "auto-", "auto-7", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reservePrefix(tt.policy, tt.prefix).AllowClientID(tt.id); got != tt.allow {
+				t.Errorf("AllowClientID(%q) %t, want %t", tt.id, got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestAssignedIDReserved(t *testing.T) {
+	_, l := startServer(t, func(srv *Server) {
+		srv.AssignedIDPrefix = "auto-"
+		srv.AssignedIDFormat = ClientIDSequence
+	})
+
+	c := newTestClient(t, l.dial())
+	ack := c.connect(mqttp.MQTT50, "")
+	id, ok := ack.Props().AssignedClientIdentifier()
+	if ack.ReasonCode() != mqttp.CodeSuccess || !ok || id != "auto-1" {
+		t.Fatalf("CONNACK 0x%02X assigned %q, want auto-1", ack.ReasonCode().Value(), id)
+	}
+
+	for _, v := range []byte{mqttp.MQTT311, mqttp.MQTT50} {
+		t.Run(versionName(v), func(t *testing.T) {
+			other := newTestClient(t, l.dial())
+			ack := other.connect(v, id)
+			want := mqttp.CodeInvalidClientID
+			if v != mqttp.MQTT50 {
+				want = mqttp.CodeRefusedIdentifierRejected
+			}
+			if ack.ReasonCode() != want {
+				t.Errorf("CONNACK 0x%02X, want 0x%02X", ack.ReasonCode().Value(), want.Value())
+			}
+		})
+	}
+}
+
+func TestClientIDPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  mqttp.ClientIDPolicy
+		connect []byte
+		want    []byte // CONNACK
+	}{
+		{"default refuses 3.1.1", nil,
+			[]byte{0x10, 15, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 3, 'a', '_', 'b'},
+			[]byte{0x20, 2, 0, 0x02}},
+		{"default refuses 5.0", nil,
+			[]byte{0x10, 16, 0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 60, 0, 0, 3, 'a', '_', 'b'},
+			[]byte{0x20, 3, 0, 0x85, 0}},
+		{"policy allows", &mqttp.ClientIDRules{MaxLength: 3},
+			[]byte{0x10, 15, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 3, 'a', '_', 'b'},
+			[]byte{0x20, 2, 0, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, l := startServer(t, func(srv *Server) {
+				srv.ClientIDPolicy = tt.policy
+			})
+			conn := l.dial()
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+
+			if _, err := conn.Write(tt.connect); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.want))
+			if _, err := readFull(conn, got); err != nil {
+				t.Fatalf("reading CONNACK: %s", err)
+			}
+			if string(got) != string(tt.want) {
+				t.Fatalf("CONNACK % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// fanout builds the packets a message is forwarded with, once for all the
+// subscribers alike. A QoS 0 packet is prepared once for every mountpoint
+// and protocol level, QoS 1/2 packets once per QoS and retain flag. Every
+// delivery gets a copy which shares the payload buffer of the message and
+// is released once it is written, the buffer goes back to the Decoder after
+// the last one. A fanout is used by one goroutine and released when the
+// message is delivered.
+type fanout struct {
+	msg  *mqttp.Publish
+	pkts map[fanoutKey]*mqttp.Publish
+}
+
+// fanoutKey tells the packets of a fanout apart, mountpoint and version
+// are only set for the QoS 0 packets which are sent unchanged
+type fanoutKey struct {
+	qos        byte
+	retain     bool
+	mountpoint string
+	version    byte
+}
+
+func newFanout(msg *mqttp.Publish) *fanout {
+	return &fanout{msg: msg, pkts: make(map[fanoutKey]*mqttp.Publish)}
+}
+
+// shared returns a copy of the QoS 0 packet for connection c, prepared for
+// its listener and protocol level
+func (this *fanout) shared(c *client, retain bool) *mqttp.Publish {
+	key := fanoutKey{qos: mqttp.QoS0, retain: retain, mountpoint: c.listener.Mountpoint, version: c.version}
+	pkt := this.pkts[key]
+	if pkt == nil {
+		pkt = c.prepare(this.build(mqttp.QoS0, retain))
+		pkt.SetVersion(c.version)
+		this.pkts[key] = pkt
+	}
+	return pkt.Copy()
+}
+
+// copy returns a QoS 1/2 packet of its own which still has the topic of
+// the message. It is kept until acknowledged, every write of it is a copy
+// prepared for the connection.
+func (this *fanout) copy(qos byte, retain bool) *mqttp.Publish {
+	key := fanoutKey{qos: qos, retain: retain}
+	pkt := this.pkts[key]
+	if pkt == nil {
+		pkt = this.build(qos, retain)
+		this.pkts[key] = pkt
+	}
+	return pkt.Copy()
+}
+
+// build makes a packet of the message with the properties passed on to
+// subscribers, it holds a reference to the payload buffer of the message
+// until the fanout is released
+func (this *fanout) build(qos byte, retain bool) *mqttp.Publish {
+	pkt := mqttp.NewPublish()
+	pkt.SetValidTopic(this.msg.Topic())
+	pkt.SharePayload(this.msg)
+	pkt.SetQos(qos)
+	pkt.SetRetain(retain)
+	pkt.SetExpireAt(this.msg.ExpireAt())
+	copyProps(pkt.Props(), this.msg.Props())
+	return pkt
+}
+
+// release drops the references of the built packets to the payload buffer,
+// the copies handed out keep theirs
+func (this *fanout) release() {
+	for _, pkt := range this.pkts {
+		pkt.Release()
+	}
+}
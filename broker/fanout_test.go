@@ -0,0 +1,175 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// addSubscriber attaches a connection without network to a new session of
+// srv and subscribes it to filter, the packets sent to it stay in its queue
+func addSubscriber(srv *Server, id string, v byte, ln *Listener, filter string, qos byte) *client {
+	c := &client{
+		srv:      srv,
+		listener: ln,
+		id:       id,
+		version:  v,
+		out:      make(chan mqttp.Packet, sendQueueSize),
+		done:     make(chan struct{}),
+	}
+	s := newSession(id, newInflight(int(DefaultMaxInflight), int(DefaultReceiveMaximum), DefaultMaxQueued))
+	s.client = c
+	c.session = s
+	srv.sessions[id] = s
+	srv.subs.subscribe(id, ln.mount(filter), mqttp.SubOps(qos))
+	return c
+}
+
+// sent returns the packet c was sent last, nil if none
+func (this *client) sent() *mqttp.Publish {
+	select {
+	case pkt := <-this.out:
+		return pkt.(*mqttp.Publish)
+	default:
+		return nil
+	}
+}
+
+func TestFanout(t *testing.T) {
+	srv := NewServer("")
+	plain := &Listener{}
+	mounted := &Listener{Mountpoint: "dev/"}
+	a := addSubscriber(srv, "a", mqttp.MQTT311, plain, "dev/#", mqttp.QoS0)
+	b := addSubscriber(srv, "b", mqttp.MQTT311, plain, "dev/+", mqttp.QoS0)
+	c := addSubscriber(srv, "c", mqttp.MQTT50, plain, "dev/x", mqttp.QoS0)
+	d := addSubscriber(srv, "d", mqttp.MQTT311, mounted, "x", mqttp.QoS0)
+	e := addSubscriber(srv, "e", mqttp.MQTT50, plain, "#", mqttp.QoS1)
+	f := addSubscriber(srv, "f", mqttp.MQTT50, plain, "#", mqttp.QoS1)
+
+	msg := mqttp.NewPublish()
+	msg.SetTopic("dev/x")
+	msg.SetQos(mqttp.QoS1)
+	msg.SetPayload([]byte("hello"))
+	msg.Props().SetContentType("text/plain")
+	srv.publish(nil, msg)
+
+	pa, pb, pc, pd, pe, pf := a.sent(), b.sent(), c.sent(), d.sent(), e.sent(), f.sent()
+	for i, p := range []*mqttp.Publish{pa, pb, pc, pd, pe, pf} {
+		if p == nil {
+			t.Fatalf("subscriber %c got nothing", 'a'+i)
+		}
+		if string(p.Payload()) != "hello" {
+			t.Errorf("subscriber %c got payload %q", 'a'+i, p.Payload())
+		}
+		if ct, _ := p.Props().ContentType(); ct != "text/plain" {
+			t.Errorf("subscriber %c got content type %q", 'a'+i, ct)
+		}
+	}
+	if pa == pb || &pa.Payload()[0] != &pb.Payload()[0] {
+		t.Error("QoS 0 subscribers need copies of their own which share the payload")
+	}
+	if pc == pa || pc.GetVersion() != mqttp.MQTT50 {
+		t.Error("MQTT 5.0 subscriber shares the packet of MQTT 3.1.1 ones")
+	}
+	if pd == pa || pd.Topic() != "x" || pa.Topic() != "dev/x" {
+		t.Errorf("mounted subscriber got %s, others %s", pd.Topic(), pa.Topic())
+	}
+	if pe == pf || pe.GetQos() != mqttp.QoS1 || pe.GetPacketID() == 0 || pf.GetPacketID() == 0 {
+		t.Error("QoS 1 subscribers need packets of their own with packet IDs")
+	}
+	if &pe.Payload()[0] != &pf.Payload()[0] {
+		t.Error("QoS 1 copies do not share the payload")
+	}
+}
+
+// decoded returns msg as read by a Decoder, its payload is in a pooled buffer
+func decoded(t *testing.T, msg *mqttp.Publish) *mqttp.Publish {
+	t.Helper()
+	var buff bytes.Buffer
+	enc := mqttp.NewEncoder(&buff)
+	enc.SetVersion(mqttp.MQTT311)
+	if err := enc.Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	dec := mqttp.NewDecoder(&buff)
+	dec.SetVersion(mqttp.MQTT311)
+	pkt, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt.(*mqttp.Publish)
+}
+
+func TestFanoutSharesFrame(t *testing.T) {
+	srv := NewServer("")
+	ln := &Listener{}
+	a := addSubscriber(srv, "a", mqttp.MQTT311, ln, "t", mqttp.QoS0)
+	b := addSubscriber(srv, "b", mqttp.MQTT311, ln, "t", mqttp.QoS1)
+
+	msg := newMessage("t", "hello")
+	msg.SetPacketID(1)
+	msg = decoded(t, msg)
+	srv.publish(nil, msg)
+	payload := &msg.Payload()[0]
+	msg.Release()
+
+	pa, pb := a.sent(), b.sent()
+	if pa == nil || pb == nil {
+		t.Fatal("message not sent")
+	}
+	if &pa.Payload()[0] != payload || &pb.Payload()[0] != payload {
+		t.Fatal("payload copied out of the decoded buffer")
+	}
+	a.dequeued(pa)
+	b.dequeued(pb)
+	if pa.Payload() != nil || pb.Payload() != nil {
+		t.Error("written packets keep the payload")
+	}
+
+	// the window keeps the message until it is acknowledged
+	window := b.session.flight.out[pb.GetPacketID()].pkt.(*mqttp.Publish)
+	if string(window.Payload()) != "hello" {
+		t.Fatalf("window payload %q", window.Payload())
+	}
+	dup := b.session.flight.pending()[0].(*mqttp.Publish)
+	if &dup.Payload()[0] != payload || !dup.GetDup() {
+		t.Error("retransmission does not share the payload")
+	}
+	b.session.flight.ack(pb.GetPacketID())
+	if window.Payload() != nil {
+		t.Error("acknowledged message keeps the payload")
+	}
+}
+
+func BenchmarkFanout(b *testing.B) {
+	for _, n := range []int{1, 10, 1000} {
+		for _, qos := range []byte{mqttp.QoS0, mqttp.QoS1} {
+			b.Run(fmt.Sprintf("%d subscribers QoS %d", n, qos), func(b *testing.B) {
+				srv := NewServer("")
+				ln := &Listener{}
+				subs := make([]*client, n)
+				for i := range subs {
+					subs[i] = addSubscriber(srv, fmt.Sprintf("c%d", i), mqttp.MQTT311, ln, "a/+", qos)
+				}
+				msg := mqttp.NewPublish()
+				msg.SetTopic("a/b")
+				msg.SetQos(qos)
+				msg.SetPayload(make([]byte, 256))
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					srv.publish(nil, msg)
+					for _, c := range subs {
+						pkt := c.sent()
+						if qos > mqttp.QoS0 {
+							c.session.flight.ack(pkt.GetPacketID())
+						}
+					}
+				}
+			})
+		}
+	}
+}
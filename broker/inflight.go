@@ -0,0 +1,271 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// outFlight is an outbound QoS 1/2 message waiting for acknowledgement.
+// pkt is the PUBLISH until PUBREC arrives for QoS 2, then the PUBREL. The
+// window holds a reference to the payload buffer of the PUBLISH until then.
+type outFlight struct {
+	pkt   mqttp.Packet
+	share string // shared subscription the message was sent for, if any
+}
+
+// queued is a message waiting for a free slot of the outbound window
+type queued struct {
+	pkt   *mqttp.Publish
+	share string
+}
+
+// inflight holds the QoS 1 and QoS 2 state of a client in both directions.
+// The outbound window is bounded by the Receive Maximum of the client, the
+// messages beyond it wait in a queue. The inbound window is bounded by our
+// own Receive Maximum, it holds the QoS 2 messages waiting for PUBREL here
+// and the QoS 1 messages whose PUBACK the connection has not written yet.
+type inflight struct {
+	mu       sync.Mutex
+	nextID   uint16
+	sendMax  int
+	maxQueue int
+	out      map[uint16]*outFlight
+	order    []uint16 // outbound packet IDs in send order
+	queue    []*queued
+	recvMax  int
+	in       map[uint16]bool // inbound QoS 2 packet IDs waiting for PUBREL
+}
+
+func newInflight(sendMax int, recvMax int, maxQueue int) *inflight {
+	return &inflight{
+		sendMax:  sendMax,
+		recvMax:  recvMax,
+		maxQueue: maxQueue,
+		out:      make(map[uint16]*outFlight),
+		in:       make(map[uint16]bool),
+	}
+}
+
+// setLimits changes the window sizes, used when a session is resumed by a
+// connection with a different Receive Maximum
+func (this *inflight) setLimits(sendMax int, recvMax int) {
+	this.mu.Lock()
+	this.sendMax = sendMax
+	this.recvMax = recvMax
+	this.mu.Unlock()
+}
+
+// push assigns a packet ID to a QoS 1/2 message and returns it if the
+// window has room. Otherwise the message is queued and nil is returned.
+// ok is false when the queue is full and the message is dropped.
+func (this *inflight) push(pkt *mqttp.Publish, share string) (ready *mqttp.Publish, ok bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.out) >= this.sendMax || len(this.queue) > 0 {
+		if this.maxQueue > 0 && len(this.queue) >= this.maxQueue {
+			return nil, false
+		}
+		this.queue = append(this.queue, &queued{pkt: pkt, share: share})
+		return nil, true
+	}
+	this.add(pkt, share)
+	return pkt, true
+}
+
+// enqueue queues a message of an offline session without assigning a
+// packet ID, it reports false when the queue is full
+func (this *inflight) enqueue(pkt *mqttp.Publish, share string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.maxQueue > 0 && len(this.queue) >= this.maxQueue {
+		return false
+	}
+	this.queue = append(this.queue, &queued{pkt: pkt, share: share})
+	return true
+}
+
+// fill moves queued messages into the window while it has room and returns
+// them for sending
+func (this *inflight) fill() []*mqttp.Publish {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.fillLocked()
+}
+
+func (this *inflight) fillLocked() (ready []*mqttp.Publish) {
+	for len(this.queue) > 0 && len(this.out) < this.sendMax {
+		q := this.queue[0]
+		this.queue = this.queue[1:]
+		this.add(q.pkt, q.share)
+		ready = append(ready, q.pkt)
+	}
+	return ready
+}
+
+// add puts a message into the window, this.mu must be held
+func (this *inflight) add(pkt *mqttp.Publish, share string) {
+	pid := this.newPacketID()
+	pkt.SetPacketID(pid)
+	this.out[pid] = &outFlight{pkt: pkt, share: share}
+	this.order = append(this.order, pid)
+}
+
+// newPacketID returns an unused non zero packet ID, this.mu must be held
+func (this *inflight) newPacketID() uint16 {
+	for {
+		this.nextID++
+		if this.nextID == 0 {
+			continue
+		}
+		if _, ok := this.out[this.nextID]; !ok {
+			return this.nextID
+		}
+	}
+}
+
+// ack completes the flow of pid on PUBACK or PUBCOMP and returns the
+// queued messages which now fit into the window. found is false for an
+// unknown packet ID.
+func (this *inflight) ack(pid uint16) (ready []*mqttp.Publish, found bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, found := this.out[pid]
+	if !found {
+		return nil, false
+	}
+	if p, ok := f.pkt.(*mqttp.Publish); ok {
+		p.Release()
+	}
+	delete(this.out, pid)
+	for i, id := range this.order {
+		if id == pid {
+			this.order = append(this.order[:i], this.order[i+1:]...)
+			break
+		}
+	}
+	return this.fillLocked(), true
+}
+
+// received moves a QoS 2 message to the PUBREL step on PUBREC. The slot
+// stays taken until PUBCOMP. found is false for an unknown packet ID.
+func (this *inflight) received(pid uint16) (rel *mqttp.PubRel, found bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	f, found := this.out[pid]
+	if !found {
+		return nil, false
+	}
+	if p, ok := f.pkt.(*mqttp.Publish); ok {
+		p.Release()
+	}
+	rel = mqttp.NewPubRel()
+	rel.SetPacketID(pid)
+	f.pkt = rel
+	// the receiver owns the message now, it is no longer redelivered
+	f.share = ""
+	return rel, true
+}
+
+// pending returns copies of the unacknowledged PUBLISH and PUBREL packets
+// in send order for retransmission on reconnect, PUBLISH packets get the
+// DUP flag [MQTT-4.4.0-1]. The packets of the window are left untouched.
+func (this *inflight) pending() []mqttp.Packet {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	pkts := make([]mqttp.Packet, 0, len(this.order))
+	for _, pid := range this.order {
+		switch p := this.out[pid].pkt.(type) {
+		case *mqttp.Publish:
+			dup := p.Copy()
+			dup.SetDup(true)
+			pkts = append(pkts, dup)
+		case *mqttp.PubRel:
+			rel := mqttp.NewPubRel()
+			rel.SetPacketID(pid)
+			pkts = append(pkts, rel)
+		}
+	}
+	return pkts
+}
+
+// shared returns the unacknowledged and queued messages that were sent
+// for shared subscriptions, grouped by subscription in send order. They
+// stay in the window until remove is called for them.
+func (this *inflight) shared() map[string][]*mqttp.Publish {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	result := make(map[string][]*mqttp.Publish)
+	for _, pid := range this.order {
+		f := this.out[pid]
+		if f.share != "" {
+			result[f.share] = append(result[f.share], f.pkt.(*mqttp.Publish))
+		}
+	}
+	for _, q := range this.queue {
+		if q.share != "" {
+			result[q.share] = append(result[q.share], q.pkt)
+		}
+	}
+	return result
+}
+
+// remove drops an unacknowledged or queued message, once another member
+// of its shared subscription took it over
+func (this *inflight) remove(pkt *mqttp.Publish) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, pid := range this.order {
+		if this.out[pid].pkt == mqttp.Packet(pkt) {
+			pkt.Release()
+			delete(this.out, pid)
+			this.order = append(this.order[:i], this.order[i+1:]...)
+			return
+		}
+	}
+	for i, q := range this.queue {
+		if q.pkt == pkt {
+			pkt.Release()
+			this.queue = append(this.queue[:i], this.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// receive records an inbound QoS 2 PUBLISH, unacked is the number of QoS 1
+// messages of the connection waiting for their PUBACK. dup is true when
+// the packet ID is already waiting for PUBREL, exceeded is true when the
+// sender went beyond our Receive Maximum [MQTT-3.3.4-9].
+func (this *inflight) receive(pid uint16, unacked int) (dup bool, exceeded bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.in[pid] {
+		return true, false
+	}
+	if len(this.in)+unacked >= this.recvMax {
+		return false, true
+	}
+	this.in[pid] = true
+	return false, false
+}
+
+// admit reports whether an inbound QoS 1 PUBLISH fits into the window,
+// unacked is the number of QoS 1 messages of the connection waiting for
+// their PUBACK before this one
+func (this *inflight) admit(unacked int) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.in)+unacked < this.recvMax
+}
+
+// release completes an inbound QoS 2 flow on PUBREL, found is false for an
+// unknown packet ID
+func (this *inflight) release(pid uint16) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.in[pid] {
+		return false
+	}
+	delete(this.in, pid)
+	return true
+}
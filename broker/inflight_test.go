@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func newTestPublish(topic string, qos byte) *mqttp.Publish {
+	pkt := mqttp.NewPublish()
+	pkt.SetTopic(topic)
+	pkt.SetQos(qos)
+	pkt.SetPayload([]byte(topic))
+	return pkt
+}
+
+func TestInflightWindow(t *testing.T) {
+	f := newInflight(2, 10, 1)
+	var sent []*mqttp.Publish
+	for i, topic := range []string{"a", "b", "c", "d"} {
+		ready, ok := f.push(newTestPublish(topic, mqttp.QoS1), "")
+		wantOK := i < 3 // two in the window, one queued, then the queue is full
+		if ok != wantOK {
+			t.Fatalf("push %s ok %t, want %t", topic, ok, wantOK)
+		}
+		if ready != nil {
+			sent = append(sent, ready)
+		}
+	}
+	if len(sent) != 2 {
+		t.Fatalf("%d messages sent at once, want 2", len(sent))
+	}
+
+	ready, found := f.ack(sent[0].GetPacketID())
+	if !found || len(ready) != 1 || ready[0].Topic() != "c" {
+		t.Fatalf("ack released %v found %t, want the queued message", ready, found)
+	}
+	if _, found := f.ack(sent[0].GetPacketID()); found {
+		t.Error("second ack of the same packet ID found it")
+	}
+}
+
+func TestInflightPendingCopies(t *testing.T) {
+	f := newInflight(10, 10, 0)
+	pub, _ := f.push(newTestPublish("a", mqttp.QoS1), "")
+	qos2, _ := f.push(newTestPublish("b", mqttp.QoS2), "")
+	rel, _ := f.received(qos2.GetPacketID())
+
+	pkts := f.pending()
+	if len(pkts) != 2 {
+		t.Fatalf("%d pending packets, want 2", len(pkts))
+	}
+	dup, ok := pkts[0].(*mqttp.Publish)
+	if !ok || dup == pub {
+		t.Fatal("pending PUBLISH is not a copy")
+	}
+	if !dup.GetDup() || dup.GetPacketID() != pub.GetPacketID() || dup.Topic() != "a" || string(dup.Payload()) != "a" {
+		t.Errorf("copy dup %t pid %d topic %s", dup.GetDup(), dup.GetPacketID(), dup.Topic())
+	}
+	if pub.GetDup() {
+		t.Error("pending set DUP on the original PUBLISH")
+	}
+	if r, ok := pkts[1].(*mqttp.PubRel); !ok || r == rel || r.GetPacketID() != rel.GetPacketID() {
+		t.Error("pending PUBREL is not a copy with the same packet ID")
+	}
+}
+
+// pending runs while the previous connection may still resend the packets
+func TestInflightPendingRace(t *testing.T) {
+	f := newInflight(10, 10, 0)
+	pub, _ := f.push(newTestPublish("a", mqttp.QoS1), "")
+	pub.SetVersion(mqttp.MQTT311) // sent once already
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		enc := mqttp.NewEncoder(&bytes.Buffer{})
+		enc.SetVersion(mqttp.MQTT311)
+		for i := 0; i < 100; i++ {
+			enc.Encode(pub)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		f.pending()
+	}
+	wg.Wait()
+}
+
+func TestInflightReceiveWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		recvMax int
+		qos2    int // QoS 2 messages waiting for PUBREL
+		unacked int // QoS 1 messages waiting for PUBACK
+		admit   bool
+	}{
+		{"empty", 2, 0, 0, true},
+		{"QoS 2 fills", 2, 2, 0, false},
+		{"QoS 1 fills", 2, 0, 2, false},
+		{"both fill", 2, 1, 1, false},
+		{"room left", 3, 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newInflight(10, tt.recvMax, 0)
+			for pid := 1; pid <= tt.qos2; pid++ {
+				if _, exceeded := f.receive(uint16(pid), 0); exceeded {
+					t.Fatal("window exceeded while filling it")
+				}
+			}
+			if got := f.admit(tt.unacked); got != tt.admit {
+				t.Errorf("admit %t, want %t", got, tt.admit)
+			}
+			dup, exceeded := f.receive(100, tt.unacked)
+			if dup || exceeded == tt.admit {
+				t.Errorf("receive dup %t exceeded %t, want exceeded %t", dup, exceeded, !tt.admit)
+			}
+		})
+	}
+
+	f := newInflight(10, 1, 0)
+	f.receive(1, 0)
+	if dup, exceeded := f.receive(1, 0); !dup || exceeded {
+		t.Errorf("duplicate QoS 2 gave dup %t exceeded %t", dup, exceeded)
+	}
+	if !f.release(1) || f.release(1) {
+		t.Error("PUBREL releases the packet ID once")
+	}
+}
+
+func TestReceiveMaximumCountsQoS1(t *testing.T) {
+	_, l := startServer(t, func(srv *Server) { srv.ReceiveMaximum = 1 })
+	c := newTestClient(t, l.dial())
+	c.connect(mqttp.MQTT50, "c1")
+
+	// the PUBACK of the first message is not read, so it is still unsent
+	// when the second message arrives. The server reads the second message
+	// before handling it, the pause keeps its PUBACK unread until then.
+	for pid := uint16(1); pid <= 2; pid++ {
+		pub := newTestPublish("a", mqttp.QoS1)
+		pub.SetPacketID(pid)
+		c.send(pub)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ack, ok := c.receive().(*mqttp.PubAck); !ok || ack.GetPacketID() != 1 {
+		t.Fatal("expected PUBACK of packet 1")
+	}
+	d, ok := c.receive().(*mqttp.Disconnect)
+	if !ok || d.ReasonCode() != mqttp.CodeReceiveMaximumExceeded {
+		t.Fatal("expected DISCONNECT with Receive Maximum exceeded")
+	}
+}
@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+	"github.com/wonderivan/logger"
+)
+
+// Listener is a network endpoint of the server with its own policy, so
+// that internal services and external devices can get different rules in
+// one broker process
+type Listener struct {
+	// Name identifies the listener in logs and in ConnInfo
+	Name string
+
+	// Network is "tcp" or "unix", "tcp" if empty
+	Network string
+	Addr    string
+
+	// TLS makes the listener speak TLS when not nil
+	TLS *tls.Config
+
+	// WebSocket serves MQTT over WebSocket when not nil
+	WebSocket *WSOptions
+
+	// Versions are the allowed protocol levels such as mqttp.MQTT31,
+	// mqttp.MQTT311 and mqttp.MQTT50, all of them if empty
+	Versions []byte
+
+	// Authenticator replaces Server.Authenticator for this listener
+	Authenticator Authenticator
+
+	// MaxConnections limits the open connections, 0 for no limit
+	MaxConnections int
+
+	// MaxPacketSize limits the size of packets sent by clients in bytes,
+	// 0 for the limit of the server
+	MaxPacketSize uint32
+
+	// Mountpoint is put in front of the topics of the clients of this
+	// listener and removed from the messages sent to them. It is a whole
+	// topic level, a '/' is added if it does not end with one.
+	Mountpoint string
+
+	conns int32
+}
+
+// String names the listener for logs
+func (this *Listener) String() string {
+	if this.Name != "" {
+		return this.Name
+	}
+	return this.Addr
+}
+
+// acquire takes a connection slot, it reports false when the listener is full
+func (this *Listener) acquire() bool {
+	n := atomic.AddInt32(&this.conns, 1)
+	if this.MaxConnections > 0 && int(n) > this.MaxConnections {
+		atomic.AddInt32(&this.conns, -1)
+		return false
+	}
+	return true
+}
+
+// release frees the slot of a connection
+func (this *Listener) release() {
+	atomic.AddInt32(&this.conns, -1)
+}
+
+// allowsVersion reports whether clients of protocol level v may connect
+func (this *Listener) allowsVersion(v byte) bool {
+	if len(this.Versions) == 0 {
+		return true
+	}
+	for _, allowed := range this.Versions {
+		if allowed == v {
+			return true
+		}
+	}
+	return false
+}
+
+// mountpoint is the Mountpoint ending with a topic level separator
+func (this *Listener) mountpoint() string {
+	if this.Mountpoint == "" || strings.HasSuffix(this.Mountpoint, "/") {
+		return this.Mountpoint
+	}
+	return this.Mountpoint + "/"
+}
+
+// mount puts the mountpoint in front of a topic name or filter, for a
+// shared subscription in front of its topic filter
+func (this *Listener) mount(topic string) string {
+	mp := this.mountpoint()
+	if mp == "" {
+		return topic
+	}
+	if group, filter, ok := parseShared(topic); ok {
+		return sharePrefix + group + "/" + mp + filter
+	}
+	return mp + topic
+}
+
+// unmount removes the mountpoint from a topic name below it. A topic which
+// is not below the mountpoint, like the parent level a mounted "#" also
+// matches, has no name for the client and becomes "", so does the
+// mountpoint itself.
+func (this *Listener) unmount(topic string) string {
+	mp := this.mountpoint()
+	if mp == "" {
+		return topic
+	}
+	if !strings.HasPrefix(topic, mp) {
+		return ""
+	}
+	return topic[len(mp):]
+}
+
+// ListenAndServeListener opens the network endpoint of ln and serves it.
+// A stale Unix socket file is removed first.
+func (this *Server) ListenAndServeListener(ln *Listener) error {
+	if this.shuttingDown() {
+		return ErrServerClosed
+	}
+	network := ln.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		if err := os.Remove(ln.Addr); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l, err := net.Listen(network, ln.Addr)
+	if err != nil {
+		return err
+	}
+	if ln.TLS != nil {
+		l = tls.NewListener(l, ln.TLS)
+	}
+	return this.ServeListener(l, ln)
+}
+
+// ServeListener accepts incoming connections on l with the policy of ln
+// and starts a client goroutine for each of them. It always closes l
+// before returning.
+func (this *Server) ServeListener(l net.Listener, ln *Listener) error {
+	if ln.WebSocket != nil {
+		return this.serveWS(l, ln)
+	}
+	if !this.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer this.trackListener(l, false)
+	defer l.Close()
+
+	logger.Info(fmt.Sprintf("Listening on %s", l.Addr()))
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if this.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				logger.Warn(fmt.Sprintf("Accept error: %s; retrying in %v", err, tempDelay))
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		this.conf.RLock()
+		ok := ln.acquire()
+		this.conf.RUnlock()
+		if !ok {
+			logger.Warn(fmt.Sprintf("Listener %s is full, refusing %s", ln, conn.RemoteAddr()))
+			conn.Close()
+			continue
+		}
+		c := newClient(this, conn, ln)
+		if !this.trackConn(c, true) {
+			ln.release()
+			conn.Close()
+			return ErrServerClosed
+		}
+		go c.serve()
+	}
+}
+
+// versionName is the protocol level in logs
+func versionName(v byte) string {
+	switch v {
+	case mqttp.MQTT50:
+		return "5.0"
+	case mqttp.MQTT31:
+		return "3.1"
+	}
+	return "3.1.1"
+}
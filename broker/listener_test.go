@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func TestListenerMount(t *testing.T) {
+	tests := []struct {
+		mountpoint string
+		topic      string
+		mounted    string
+	}{
+		{"", "a/b", "a/b"},
+		{"dev/", "x", "dev/x"},
+		{"dev", "x", "dev/x"},
+		{"dev/", "$share/g/x/#", "$share/g/dev/x/#"},
+		{"dev", "$share/g/x", "$share/g/dev/x"},
+		{"a/b/", "#", "a/b/#"},
+	}
+	for _, tt := range tests {
+		ln := &Listener{Mountpoint: tt.mountpoint}
+		if got := ln.mount(tt.topic); got != tt.mounted {
+			t.Errorf("mountpoint %q: mount(%q) %q, want %q", tt.mountpoint, tt.topic, got, tt.mounted)
+		}
+	}
+}
+
+func TestListenerUnmount(t *testing.T) {
+	tests := []struct {
+		mountpoint string
+		topic      string
+		unmounted  string
+	}{
+		{"", "a/b", "a/b"},
+		{"dev/", "dev/x", "x"},
+		{"dev", "dev/x", "x"},
+		{"dev", "device/x", ""},
+		{"dev/", "device/x", ""},
+		{"dev/", "dev/", ""},
+		{"dev/", "dev", ""},
+		{"dev", "dev", ""},
+		{"a/b/", "a/b/c/d", "c/d"},
+	}
+	for _, tt := range tests {
+		ln := &Listener{Mountpoint: tt.mountpoint}
+		if got := ln.unmount(tt.topic); got != tt.unmounted {
+			t.Errorf("mountpoint %q: unmount(%q) %q, want %q", tt.mountpoint, tt.topic, got, tt.unmounted)
+		}
+	}
+}
+
+func TestMountpointTopicDropped(t *testing.T) {
+	// "dev/#" matches the mountpoint itself and its parent level "dev"
+	for _, topic := range []string{"dev/", "dev"} {
+		srv := NewServer("")
+		c := addSubscriber(srv, "c", mqttp.MQTT311, &Listener{Mountpoint: "dev/"}, "#", mqttp.QoS1)
+
+		msg := mqttp.NewPublish()
+		msg.SetTopic(topic)
+		msg.SetQos(mqttp.QoS1)
+		srv.publish(nil, msg)
+
+		pkt := c.sent()
+		if pkt == nil || pkt.Topic() != "" {
+			t.Fatalf("%s: expected the message with an empty topic queued", topic)
+		}
+		if c.fits(pkt) {
+			t.Errorf("%s: message without topic name fits", topic)
+		}
+		if _, found := c.session.flight.ack(pkt.GetPacketID()); found {
+			t.Errorf("%s: dropped message is still in flight", topic)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+	"github.com/wonderivan/logger"
+)
+
+// Password hashes use the mosquitto_passwd format
+// "$7$<iterations>$<base64 salt>$<base64 PBKDF2-HMAC-SHA512 key>"
+const (
+	hashPrefix       = "$7$"
+	hashSaltSize     = 12
+	hashKeySize      = sha512.Size
+	DefaultHashIters = 10000
+)
+
+// ErrInvalidHash is returned for a password hash in an unknown format
+var ErrInvalidHash = errors.New("broker: invalid password hash")
+
+// HashPassword returns a salted PBKDF2-SHA512 hash of password
+func HashPassword(password string, iterations int) (string, error) {
+	if iterations <= 0 {
+		iterations = DefaultHashIters
+	}
+	salt := make([]byte, hashSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, iterations, hashKeySize)
+	return fmt.Sprintf("%s%d$%s$%s", hashPrefix, iterations,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches a hash of HashPassword
+func CheckPassword(hash string, password string) (bool, error) {
+	if !strings.HasPrefix(hash, hashPrefix) {
+		return false, ErrInvalidHash
+	}
+	parts := strings.Split(hash[len(hashPrefix):], "$")
+	if len(parts) != 3 {
+		return false, ErrInvalidHash
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations <= 0 {
+		return false, ErrInvalidHash
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(want) == 0 {
+		return false, ErrInvalidHash
+	}
+	key := pbkdf2([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(key, want) == 1, nil
+}
+
+// pbkdf2 derives a key with HMAC-SHA512 as the pseudorandom function (RFC 8018)
+func pbkdf2(password []byte, salt []byte, iterations int, size int) []byte {
+	prf := hmac.New(sha512.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
+
+// PasswordFile is an Authenticator checking user names and passwords
+// against a file of "user:hash" lines. Clients without a user name are left
+// to the next authenticator of a chain.
+type PasswordFile struct {
+	Path string
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+}
+
+// LoadPasswordFile reads a password file
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	pf := &PasswordFile{Path: path, users: make(map[string]string)}
+	if err := pf.Reload(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// Reload reads the file again
+func (this *PasswordFile) Reload() error {
+	info, err := os.Stat(this.Path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(this.Path)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return fmt.Errorf("%s line %d: expected user:hash", this.Path, n)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	this.users = users
+	this.modTime = info.ModTime()
+	this.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, checking
+// every interval until stop is called
+func (this *PasswordFile) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				info, err := os.Stat(this.Path)
+				if err != nil {
+					continue
+				}
+				this.mu.RLock()
+				changed := !info.ModTime().Equal(this.modTime)
+				this.mu.RUnlock()
+				if !changed {
+					continue
+				}
+				if err := this.Reload(); err != nil {
+					logger.Error(fmt.Sprintf("Failed reloading %s: %s", this.Path, err))
+					continue
+				}
+				logger.Info(fmt.Sprintf("Reloaded %s", this.Path))
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Set adds a user or changes its password
+func (this *PasswordFile) Set(user string, password string) error {
+	if user == "" || strings.ContainsAny(user, ":\r\n") {
+		return fmt.Errorf("invalid user name %q", user)
+	}
+	hash, err := HashPassword(password, DefaultHashIters)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	this.users[user] = hash
+	this.mu.Unlock()
+	return nil
+}
+
+// Remove deletes a user, it reports whether the user existed
+func (this *PasswordFile) Remove(user string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, ok := this.users[user]
+	delete(this.users, user)
+	return ok
+}
+
+// dummyHash is checked for unknown users, so that they take as long as
+// known ones and the time of a failed login does not tell them apart
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+func unknownUserHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPassword("", DefaultHashIters)
+	})
+	return dummyHash
+}
+
+// Check reports whether user exists and has the password
+func (this *PasswordFile) Check(user string, password string) bool {
+	this.mu.RLock()
+	hash, ok := this.users[user]
+	this.mu.RUnlock()
+	if !ok {
+		CheckPassword(unknownUserHash(), password)
+		return false
+	}
+	match, err := CheckPassword(hash, password)
+	if err != nil {
+		logger.Error(fmt.Sprintf("%s: user %s: %s", this.Path, user, err))
+	}
+	return match
+}
+
+// Save writes the users sorted by name to a temporary file renamed over
+// the file, so that a failed save keeps the previous file
+func (this *PasswordFile) Save() error {
+	this.mu.RLock()
+	names := make([]string, 0, len(this.users))
+	for name := range this.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s:%s\n", name, this.users[name])
+	}
+	this.mu.RUnlock()
+
+	tmp := this.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, this.Path)
+}
+
+// Authenticate implements Authenticator
+func (this *PasswordFile) Authenticate(pkt *mqttp.Connect, info *ConnInfo) (AuthResult, mqttp.ReasonCode) {
+	user, password := pkt.Credentials()
+	if user == "" {
+		return AuthIgnore, mqttp.CodeSuccess
+	}
+	if !this.Check(user, password) {
+		return AuthDeny, mqttp.CodeBadUserOrPassword
+	}
+	return AuthAllow, mqttp.CodeSuccess
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("secret", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+		wantErr  error
+	}{
+		{"match", hash, "secret", true, nil},
+		{"mismatch", hash, "Secret", false, nil},
+		{"empty", hash, "", false, nil},
+		{"no prefix", hash[3:], "secret", false, ErrInvalidHash},
+		{"missing part", "$7$100$c2FsdA==", "secret", false, ErrInvalidHash},
+		{"bad iterations", "$7$0$c2FsdA==$a2V5", "secret", false, ErrInvalidHash},
+		{"bad salt", "$7$100$!!$a2V5", "secret", false, ErrInvalidHash},
+		{"empty key", "$7$100$c2FsdA==$", "secret", false, ErrInvalidHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CheckPassword(tt.hash, tt.password)
+			if got != tt.want || err != tt.wantErr {
+				t.Errorf("got %t, %v, want %t, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// PBKDF2-HMAC-SHA512 of "password" and "salt" with 2 iterations, a
+// published test vector
+func TestPBKDF2(t *testing.T) {
+	key := pbkdf2([]byte("password"), []byte("salt"), 2, 16)
+	want := []byte{0xe1, 0xd9, 0xc1, 0x6a, 0xa6, 0x81, 0x70, 0x8a, 0x45, 0xf5, 0xc7, 0xc4, 0xe2, 0x15, 0xce, 0xb6}
+	if string(key) != string(want) {
+		t.Errorf("key % x, want % x", key, want)
+	}
+}
+
+func TestPasswordFileSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(path, []byte("# users\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"bob", "alice"} {
+		if err := pf.Set(user, user+"-pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, user := range []string{"", "a:b", "a\nb"} {
+		if err := pf.Set(user, "x"); err == nil {
+			t.Errorf("Set accepted user name %q", user)
+		}
+	}
+	if err := pf.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("file mode %o, want 600", perm)
+	}
+
+	loaded, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "alice-pw", true},
+		{"bob", "bob-pw", true},
+		{"bob", "alice-pw", false},
+		{"carol", "carol-pw", false},
+	}
+	for _, tt := range tests {
+		if got := loaded.Check(tt.user, tt.password); got != tt.want {
+			t.Errorf("Check(%q, %q) = %t, want %t", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	// a save that cannot write keeps the previous file
+	os.Mkdir(path+".tmp", 0700)
+	loaded.Remove("alice")
+	if err := loaded.Save(); err == nil {
+		t.Fatal("Save succeeded with the temporary file blocked")
+	}
+	again, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Check("alice", "alice-pw") {
+		t.Error("failed save changed the file")
+	}
+}
+
+func TestPasswordFileUnknownUserTiming(t *testing.T) {
+	pf := &PasswordFile{users: make(map[string]string)}
+	if err := pf.Set("known", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	unknownUserHash()
+
+	elapsed := func(user string) time.Duration {
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			pf.Check(user, "wrong")
+		}
+		return time.Since(start)
+	}
+	known, unknown := elapsed("known"), elapsed("unknown")
+	// an unknown user runs the same key derivation, not a map lookup only
+	if unknown < known/4 {
+		t.Errorf("unknown user took %v, known user %v", unknown, known)
+	}
+}
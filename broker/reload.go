@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/wonderivan/logger"
+)
+
+// connLimits are the settings of the server a connection keeps from
+// CONNECT on, as it was told about them in CONNACK
+type connLimits struct {
+	receiveMaximum   uint16
+	maxInflight      uint16
+	maxQueued        int
+	maxSessionExpiry uint32
+	minKeepAlive     uint16
+	maxKeepAlive     uint16
+	idPrefix         string
+	idFormat         ClientIDFormat
+
+	maximumQoS            byte
+	retainAvailable       bool
+	wildcardSubscriptions bool
+	sharedSubscriptions   bool
+}
+
+// limits copies the current limits and capabilities
+func (this *Server) limits() connLimits {
+	this.conf.RLock()
+	defer this.conf.RUnlock()
+	return connLimits{
+		receiveMaximum:        this.ReceiveMaximum,
+		maxInflight:           this.MaxInflight,
+		maxQueued:             this.MaxQueued,
+		maxSessionExpiry:      this.MaxSessionExpiry,
+		minKeepAlive:          this.MinKeepAlive,
+		maxKeepAlive:          this.MaxKeepAlive,
+		idPrefix:              this.AssignedIDPrefix,
+		idFormat:              this.AssignedIDFormat,
+		maximumQoS:            this.MaximumQoS,
+		retainAvailable:       this.RetainAvailable,
+		wildcardSubscriptions: this.WildcardSubscriptions,
+		sharedSubscriptions:   this.SharedSubscriptions,
+	}
+}
+
+// authorizer returns the current Authorizer
+func (this *Server) authorizer() Authorizer {
+	this.conf.RLock()
+	defer this.conf.RUnlock()
+	return this.Authorizer
+}
+
+// shareStrategy returns the current ShareStrategy
+func (this *Server) shareStrategy() ShareStrategy {
+	this.conf.RLock()
+	defer this.conf.RUnlock()
+	return this.ShareStrategy
+}
+
+// Reconfigure changes the settings of a running server without closing any
+// connection. update is called with the configuration locked and may set
+// the exported fields of the server and of the listeners it serves, except
+// Network, Addr, TLS, WebSocket and Mountpoint of a listener which are only
+// read when it starts. Connections keep the limits and capabilities they
+// were given in CONNACK, new connections get the new ones. Subscriptions
+// the Authorizer no longer allows are removed from every session.
+func (this *Server) Reconfigure(update func()) {
+	this.conf.Lock()
+	update()
+	this.conf.Unlock()
+	this.recheckSubscriptions()
+}
+
+// recheckSubscriptions asks the Authorizer about the subscriptions of every
+// session again and removes the denied ones
+func (this *Server) recheckSubscriptions() {
+	authz := this.authorizer()
+	if authz == nil {
+		return
+	}
+	this.mu.Lock()
+	sessions := make([]*session, 0, len(this.sessions))
+	for _, s := range this.sessions {
+		sessions = append(sessions, s)
+	}
+	this.mu.Unlock()
+
+	for _, s := range sessions {
+		s.mu.Lock()
+		username, ln := s.username, s.listener
+		s.mu.Unlock()
+		for filter := range this.subs.filters(s.id) {
+			_, topicFilter, shared := parseShared(filter)
+			if !shared {
+				topicFilter = filter
+			}
+			if ln != nil {
+				topicFilter = ln.unmount(topicFilter)
+			}
+			if authz.Authorize(s.id, username, AccessRead, topicFilter) {
+				continue
+			}
+			this.subs.unsubscribe(s.id, filter)
+			logger.Warn(fmt.Sprintf("Session %s lost its subscription to %s", s.id, filter))
+		}
+	}
+}
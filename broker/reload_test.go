@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func sessionFilters(srv *Server, id string) []string {
+	var result []string
+	for filter := range srv.subs.filters(id) {
+		result = append(result, filter)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestRecheckSubscriptions(t *testing.T) {
+	srv := NewServer("")
+	ln := &Listener{Mountpoint: "dev/"}
+	c := addSubscriber(srv, "c1", mqttp.MQTT50, ln, "a/#", mqttp.QoS1)
+	c.session.listener = ln
+	for _, filter := range []string{"b/#", "$share/g/b/x", "$share/g/a/x"} {
+		srv.subs.subscribe("c1", ln.mount(filter), mqttp.SubOps(mqttp.QoS1))
+	}
+
+	// without an Authorizer nothing is checked
+	srv.Reconfigure(func() {})
+	if got := sessionFilters(srv, "c1"); len(got) != 4 {
+		t.Fatalf("filters %v", got)
+	}
+
+	// the ACL sees the filters the client subscribed to, not the mounted
+	// ones, shared subscriptions are checked by their topic filter
+	acl, err := ParseACL(strings.NewReader("topic read b/#\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Reconfigure(func() {
+		srv.Authorizer = acl
+	})
+	want := []string{"$share/g/dev/b/x", "dev/b/#"}
+	got := sessionFilters(srv, "c1")
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("filters %v, want %v", got, want)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	srv, l := startServer(t, func(srv *Server) {
+		srv.ReceiveMaximum = 10
+	})
+	old := newTestClient(t, l.dial())
+	old.connect(mqttp.MQTT50, "old")
+	old.subscribe("a/#", mqttp.QoS1)
+	old.subscribe("b/#", mqttp.QoS1)
+
+	acl, err := ParseACL(strings.NewReader("topic readwrite b/#\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Reconfigure(func() {
+		srv.ReceiveMaximum = 5
+		srv.MaximumQoS = mqttp.QoS1
+		srv.Authorizer = acl
+	})
+	if got := sessionFilters(srv, "old"); len(got) != 1 || got[0] != "b/#" {
+		t.Fatalf("filters of the connected client %v, want [b/#]", got)
+	}
+
+	// new connections get the new settings in CONNACK
+	c := newTestClient(t, l.dial())
+	ack := c.connect(mqttp.MQTT50, "new")
+	if v, _ := ack.Props().ReceiveMaximum(); v != 5 {
+		t.Errorf("Receive Maximum %d, want 5", v)
+	}
+	if v, ok := ack.Props().MaximumQoS(); !ok || v != mqttp.QoS1 {
+		t.Errorf("Maximum QoS %d %t, want 1", v, ok)
+	}
+
+	// connected ones keep what they were told
+	srv.mu.Lock()
+	var limits connLimits
+	for conn := range srv.conns {
+		if conn.id == "old" {
+			limits = conn.limits
+		}
+	}
+	srv.mu.Unlock()
+	if limits.receiveMaximum != 10 || limits.maximumQoS != mqttp.QoS2 {
+		t.Errorf("connected client has Receive Maximum %d and Maximum QoS %d", limits.receiveMaximum, limits.maximumQoS)
+	}
+}
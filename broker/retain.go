@@ -0,0 +1,203 @@
+package broker
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// retainNode is one topic level of the retained message store
+type retainNode struct {
+	parent   *retainNode
+	level    string
+	children map[string]*retainNode
+	msg      *mqttp.Publish
+}
+
+func newRetainNode(parent *retainNode, level string) *retainNode {
+	return &retainNode{parent: parent, level: level, children: make(map[string]*retainNode)}
+}
+
+// retainStore keeps the last retained message of every topic in a trie
+// keyed on topic levels, so that wildcard filters of SUBSCRIBE only visit
+// the topics they can match.
+type retainStore struct {
+	mu   sync.Mutex
+	root *retainNode
+}
+
+func newRetainStore() *retainStore {
+	return &retainStore{root: newRetainNode(nil, "")}
+}
+
+// store replaces the retained message of the topic of msg, a message with
+// a zero length payload deletes it [MQTT-3.3.1-6]. The store keeps msg, its
+// payload is copied out of the buffer it was decoded into.
+func (this *retainStore) store(msg *mqttp.Publish) {
+	msg.Detach()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(msg.Payload()) == 0 {
+		node := this.root
+		for _, level := range strings.Split(msg.Topic(), "/") {
+			child, ok := node.children[level]
+			if !ok {
+				return
+			}
+			node = child
+		}
+		this.remove(node)
+		return
+	}
+
+	node := this.root
+	for _, level := range strings.Split(msg.Topic(), "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newRetainNode(node, level)
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.msg = msg
+}
+
+// remove drops the message of node and prunes the empty branch
+func (this *retainStore) remove(node *retainNode) {
+	node.msg = nil
+	for node != this.root && node.msg == nil && len(node.children) == 0 {
+		delete(node.parent.children, node.level)
+		node = node.parent
+	}
+}
+
+// match returns the retained messages matching a topic filter, expired
+// messages are dropped on the way
+func (this *retainStore) match(filter string) []*mqttp.Publish {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var result []*mqttp.Publish
+	var expired []*retainNode
+	this.collect(this.root, strings.Split(filter, "/"), &result, &expired)
+	for _, node := range expired {
+		this.remove(node)
+	}
+	return result
+}
+
+func (this *retainStore) collect(node *retainNode, levels []string, result *[]*mqttp.Publish, expired *[]*retainNode) {
+	if len(levels) == 0 {
+		this.add(node, result, expired)
+		return
+	}
+	level := levels[0]
+	switch level {
+	case "#":
+		// '#' matches the parent level and every level below it
+		if node != this.root {
+			this.add(node, result, expired)
+		}
+		this.addAll(node, node == this.root, result, expired)
+	case "+":
+		for name, child := range node.children {
+			// wildcards at the first level never match topics starting with '$' [MQTT-4.7.2-1]
+			if node == this.root && strings.HasPrefix(name, "$") {
+				continue
+			}
+			this.collect(child, levels[1:], result, expired)
+		}
+	default:
+		if child, ok := node.children[level]; ok {
+			this.collect(child, levels[1:], result, expired)
+		}
+	}
+}
+
+// addAll adds the messages of every node below node
+func (this *retainStore) addAll(node *retainNode, root bool, result *[]*mqttp.Publish, expired *[]*retainNode) {
+	for name, child := range node.children {
+		if root && strings.HasPrefix(name, "$") {
+			continue
+		}
+		this.add(child, result, expired)
+		this.addAll(child, false, result, expired)
+	}
+}
+
+func (this *retainStore) add(node *retainNode, result *[]*mqttp.Publish, expired *[]*retainNode) {
+	if node.msg == nil {
+		return
+	}
+	if node.msg.Expired() {
+		*expired = append(*expired, node)
+		return
+	}
+	*result = append(*result, node.msg)
+}
+
+// all returns every retained message which has not expired
+func (this *retainStore) all() []*mqttp.Publish {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var result []*mqttp.Publish
+	var expired []*retainNode
+	this.add(this.root, &result, &expired)
+	this.addAll(this.root, false, &result, &expired)
+	for _, node := range expired {
+		this.remove(node)
+	}
+	return result
+}
+
+// SaveRetained writes the retained messages to w as MQTT 5.0 PUBLISH
+// packets, the Message Expiry Interval of each is the time it has left
+func (this *Server) SaveRetained(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := mqttp.NewEncoder(bw)
+	enc.SetVersion(mqttp.MQTT50)
+	for _, msg := range this.retained.all() {
+		pkt := mqttp.NewPublish()
+		pkt.SetTopic(msg.Topic())
+		pkt.SetPayload(msg.Payload())
+		pkt.SetQos(msg.GetQos())
+		if msg.GetQos() > mqttp.QoS0 {
+			// a will has no packet identifier, the file needs a valid one
+			pkt.SetPacketID(1)
+		}
+		pkt.SetRetain(true)
+		copyProps(pkt.Props(), msg.Props())
+		if expireAt := msg.ExpireAt(); !expireAt.IsZero() {
+			left := time.Until(expireAt) + time.Second - 1
+			pkt.Props().SetMessageExpiryInterval(uint32(left / time.Second))
+		}
+		if err := enc.Encode(pkt); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadRetained reads retained messages written by SaveRetained
+func (this *Server) LoadRetained(r io.Reader) error {
+	dec := mqttp.NewDecoder(bufio.NewReader(r))
+	dec.SetVersion(mqttp.MQTT50)
+	for {
+		pkt, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg, ok := pkt.(*mqttp.Publish)
+		if !ok {
+			return mqttp.CodeMalformedPacket
+		}
+		this.retained.store(msg)
+	}
+}
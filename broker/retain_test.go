@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func newRetained(topic string, payload string) *mqttp.Publish {
+	msg := newMessage(topic, payload)
+	msg.SetRetain(true)
+	return msg
+}
+
+func retainedTopics(msgs []*mqttp.Publish) []string {
+	var topics []string
+	for _, msg := range msgs {
+		topics = append(topics, msg.Topic())
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func TestRetainStoreMatch(t *testing.T) {
+	store := newRetainStore()
+	for _, topic := range []string{"a", "a/b", "a/b/c", "a/x/c", "$SYS/load"} {
+		store.store(newRetained(topic, topic))
+	}
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"a/b", []string{"a/b"}},
+		{"a/+", []string{"a/b"}},
+		{"a/+/c", []string{"a/b/c", "a/x/c"}},
+		{"a/#", []string{"a", "a/b", "a/b/c", "a/x/c"}},
+		{"#", []string{"a", "a/b", "a/b/c", "a/x/c"}},
+		{"+/b", []string{"a/b"}},
+		{"$SYS/#", []string{"$SYS/load"}},
+		{"b", nil},
+	}
+	for _, tt := range tests {
+		got := retainedTopics(store.match(tt.filter))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %v, want %v", tt.filter, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: %v, want %v", tt.filter, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRetainStoreDelete(t *testing.T) {
+	store := newRetainStore()
+	store.store(newRetained("a/b/c", "1"))
+	store.store(newRetained("a/b/c", "2"))
+	if msgs := store.match("a/b/c"); len(msgs) != 1 || string(msgs[0].Payload()) != "2" {
+		t.Fatal("retained message not replaced")
+	}
+
+	// an empty payload deletes the message and prunes its branch [MQTT-3.3.1-6]
+	store.store(newRetained("a/b/x", ""))
+	store.store(newRetained("a/b/c", ""))
+	if msgs := store.match("#"); len(msgs) != 0 {
+		t.Fatalf("%d messages left", len(msgs))
+	}
+	if n := len(store.root.children); n != 0 {
+		t.Errorf("%d branches left", n)
+	}
+}
+
+func TestRetainStoreExpiry(t *testing.T) {
+	store := newRetainStore()
+	expired := newRetained("a/old", "x")
+	expired.SetExpireAt(time.Now().Add(-time.Second))
+	store.store(expired)
+	alive := newRetained("a/new", "x")
+	alive.SetExpireAt(time.Now().Add(time.Minute))
+	store.store(alive)
+
+	if got := retainedTopics(store.match("a/+")); len(got) != 1 || got[0] != "a/new" {
+		t.Fatalf("matched %v, want [a/new]", got)
+	}
+	if _, ok := store.root.children["a"].children["old"]; ok {
+		t.Error("expired message kept in the store")
+	}
+	if got := retainedTopics(store.all()); len(got) != 1 {
+		t.Errorf("all %v, want [a/new]", got)
+	}
+}
+
+func TestSaveLoadRetained(t *testing.T) {
+	srv := NewServer("")
+	msg := newRetained("a/b", "payload")
+	msg.SetExpireAt(time.Now().Add(time.Hour))
+	srv.retained.store(msg)
+	// a retained will has no packet identifier
+	srv.retained.store(newRetained("a/will", "gone"))
+
+	var buff bytes.Buffer
+	if err := srv.SaveRetained(&buff); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewServer("")
+	if err := loaded.LoadRetained(&buff); err != nil {
+		t.Fatal(err)
+	}
+	if got := retainedTopics(loaded.retained.all()); len(got) != 2 {
+		t.Fatalf("loaded %v", got)
+	}
+	msgs := loaded.retained.match("a/b")
+	if len(msgs) != 1 || string(msgs[0].Payload()) != "payload" {
+		t.Fatalf("loaded %v", msgs)
+	}
+	if left := time.Until(msgs[0].ExpireAt()); left <= 59*time.Minute || left > time.Hour {
+		t.Errorf("loaded message expires in %s", left)
+	}
+}
+
+// subscribeWith subscribes to filter with ops and waits for SUBACK
+func (this *testClient) subscribeWith(filter string, ops mqttp.SubOps) {
+	this.t.Helper()
+	sub := mqttp.NewSubscribe()
+	sub.SetPacketID(1)
+	sub.AddTopic(filter, ops)
+	this.send(sub)
+	if _, ok := this.receive().(*mqttp.SubAck); !ok {
+		this.t.Fatal("expected SUBACK")
+	}
+}
+
+// publishRetained sends a QoS 0 retained message, the PINGRESP after it
+// tells that the server has stored it
+func (this *testClient) publishRetained(topic string, payload string) {
+	this.t.Helper()
+	pub := mqttp.NewPublish()
+	pub.SetTopic(topic)
+	pub.SetRetain(true)
+	pub.SetPayload([]byte(payload))
+	this.send(pub)
+	this.send(mqttp.NewPingReq())
+	if _, ok := this.receive().(*mqttp.PingResp); !ok {
+		this.t.Fatal("expected PINGRESP")
+	}
+}
+
+func TestRetainHandling(t *testing.T) {
+	_, l := startServer(t, nil)
+	p := newTestClient(t, l.dial())
+	p.connect(mqttp.MQTT50, "p")
+	p.publishRetained("r/a", "x")
+
+	c := newTestClient(t, l.dial())
+	c.connect(mqttp.MQTT50, "c")
+	tests := []struct {
+		name     string
+		filter   string
+		handling byte
+		want     bool
+	}{
+		{"0 on a new subscription", "r/a", 0, true},
+		{"0 on an existing subscription", "r/a", 0, true},
+		{"1 on a new subscription", "r/+", 1, true},
+		{"1 on an existing subscription", "r/+", 1, false},
+		{"2 never", "r/#", 2, false},
+	}
+	for _, tt := range tests {
+		c.subscribeWith(tt.filter, mqttp.SubOps(mqttp.QoS0|tt.handling<<4))
+		pkt := c.tryReceive(100 * time.Millisecond)
+		pub, got := pkt.(*mqttp.Publish)
+		if got != tt.want {
+			t.Fatalf("Retain Handling %s: retained message received %t", tt.name, got)
+		}
+		// retained messages sent on SUBSCRIBE keep the flag [MQTT-3.3.1-9]
+		if got && (!pub.GetRetain() || string(pub.Payload()) != "x") {
+			t.Errorf("Retain Handling %s: retain %t payload %q", tt.name, pub.GetRetain(), pub.Payload())
+		}
+	}
+}
+
+func TestRetainAsPublished(t *testing.T) {
+	_, l := startServer(t, nil)
+	rap := newTestClient(t, l.dial())
+	rap.connect(mqttp.MQTT50, "rap")
+	rap.subscribeWith("r/#", mqttp.SubOps(mqttp.QoS0|0x08))
+	plain := newTestClient(t, l.dial())
+	plain.connect(mqttp.MQTT50, "plain")
+	plain.subscribeWith("r/#", mqttp.SubOps(mqttp.QoS0))
+
+	p := newTestClient(t, l.dial())
+	p.connect(mqttp.MQTT50, "p")
+	p.publishRetained("r/a", "x")
+
+	// Retain As Published keeps the flag, otherwise it is cleared [MQTT-3.3.1-12]
+	if pub, ok := rap.receive().(*mqttp.Publish); !ok || !pub.GetRetain() {
+		t.Error("retain flag cleared with Retain As Published")
+	}
+	if pub, ok := plain.receive().(*mqttp.Publish); !ok || pub.GetRetain() {
+		t.Error("retain flag kept without Retain As Published")
+	}
+}
+
+func TestRetainedDeleted(t *testing.T) {
+	_, l := startServer(t, nil)
+	p := newTestClient(t, l.dial())
+	p.connect(mqttp.MQTT50, "p")
+	p.publishRetained("r/a", "x")
+	p.publishRetained("r/a", "")
+
+	c := newTestClient(t, l.dial())
+	c.connect(mqttp.MQTT50, "c")
+	c.subscribe("r/#", mqttp.QoS0)
+	if pkt := c.tryReceive(100 * time.Millisecond); pkt != nil {
+		t.Fatal("deleted retained message sent")
+	}
+}
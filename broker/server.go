@@ -1,49 +1,314 @@
-package server
+package broker
+
 import (
-	"net"
+	"context"
 	"errors"
-	"regexp"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
-	"github.com/gomqtt/mqttp"
+
+	"github.com/chenglinning/gomqtt/mqttp"
 )
 
-type Server interface {
-
-}
-
-func process(conn net.Conn){
-	defer conn.Close()
-	for {
-	   var buf [128]byte
-	   n ,err := conn.Read(buf[:])
-	   if err != nil {
-		  fmt.Println("Read from tcp server failed,err:",err)
-		  break
-	   }
-	   data := string(buf[:n])
-	   fmt.Printf("Recived from client,data:%s\n",data)
-	}
- }
- 
- func main() {
-	// 监听TCP 服务端口
-	listener,err := net.Listen("tcp","0.0.0.0:9090")
-	if err != nil {
-	   fmt.Println("Listen tcp server failed,err:",err)
-	   return
-	}
- 
-	for{
-	   // 建立socket连接
-	   conn,err := listener.Accept()
-	   if err != nil {
-		  fmt.Println("Listen.Accept failed,err:",err)
-		  continue
-	   }
- 
-	   // 业务处理逻辑
-	   go process(conn)
-	}
- }
-  
\ No newline at end of file
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown
+var ErrServerClosed = errors.New("broker: Server closed")
+
+// DefaultAddr is the listen address used when Server.Addr is empty
+const DefaultAddr = ":1883"
+
+// Defaults of the in-flight limits
+const (
+	DefaultReceiveMaximum uint16 = 64
+	DefaultMaxInflight    uint16 = 20
+	DefaultMaxQueued             = 1000
+)
+
+// DefaultConnectTimeout is the time new connections have to send CONNECT
+const DefaultConnectTimeout = 10 * time.Second
+
+// Server is an MQTT broker. It accepts network connections, decodes
+// MQTT packets from each of them and routes messages between clients.
+type Server struct {
+	// TCP address to listen on, ":1883" if empty
+	Addr string
+
+	// ShareStrategy balances the messages of shared subscriptions
+	ShareStrategy ShareStrategy
+
+	// Authenticator checks every CONNECT, nil accepts all clients
+	Authenticator Authenticator
+
+	// Authorizer checks PUBLISH and SUBSCRIBE, nil allows every topic
+	Authorizer Authorizer
+
+	// CertIdentity makes the verified client certificate of a TLS
+	// connection give the user name instead of CONNECT
+	CertIdentity CertIdentity
+
+	// ReceiveMaximum is the number of QoS 1 messages waiting for PUBACK
+	// and QoS 2 messages waiting for PUBREL a client may have, advertised
+	// to MQTT 5.0 clients in CONNACK
+	ReceiveMaximum uint16
+
+	// MaxInflight is the number of unacknowledged messages sent to an
+	// MQTT 3.1.1 client, MQTT 5.0 clients set it by their Receive Maximum
+	MaxInflight uint16
+
+	// MaxQueued is the number of QoS 1/2 messages waiting for a free
+	// in-flight slot per client, 0 for no limit
+	MaxQueued int
+
+	// MaxSessionExpiry caps the Session Expiry Interval asked for by
+	// clients in seconds, 0 for no limit
+	MaxSessionExpiry uint32
+
+	// MinKeepAlive and MaxKeepAlive bound the Keep Alive of MQTT 5.0
+	// clients in seconds, a value out of range is replaced by Server Keep
+	// Alive in CONNACK. 0 for no bound, MaxKeepAlive also applies to
+	// clients asking for no keep alive at all.
+	MinKeepAlive uint16
+	MaxKeepAlive uint16
+
+	// ConnectTimeout is the time a new connection has to send CONNECT
+	// before it is closed, 0 for no limit. The Keep Alive applies after.
+	ConnectTimeout time.Duration
+
+	// MaxPacketSize limits the size of packets sent by clients in bytes
+	// on listeners without a limit of their own, 0 for no limit. It is
+	// advertised to MQTT 5.0 clients in CONNACK. CONNECT is never allowed
+	// more than mqttp.MaxConnectSize.
+	MaxPacketSize uint32
+
+	// ClientIDPolicy checks the client IDs of CONNECT, nil for
+	// mqttp.DefaultClientIDPolicy
+	ClientIDPolicy mqttp.ClientIDPolicy
+
+	// AssignedIDPrefix and AssignedIDFormat make the client IDs assigned to
+	// clients connecting with an empty one. Client IDs starting with the
+	// prefix are refused in CONNECT whatever the ClientIDPolicy, so an
+	// assigned ID cannot be taken by another client.
+	AssignedIDPrefix string
+	AssignedIDFormat ClientIDFormat
+
+	// Capabilities advertised to MQTT 5.0 clients in CONNACK and enforced
+	// for every client: the highest QoS accepted and granted, whether
+	// retained messages, wildcard filters and shared subscriptions are
+	// supported
+	MaximumQoS            byte
+	RetainAvailable       bool
+	WildcardSubscriptions bool
+	SharedSubscriptions   bool
+
+	conf sync.RWMutex // guards the exported fields, see Reconfigure
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*client]struct{}
+	sessions   map[string]*session
+	attaching  map[string]chan struct{} // client IDs being attached
+	subs       *subscriptions
+	retained   *retainStore
+	inShutdown int32
+	idSeq      uint64 // last ClientIDSequence number, guarded by mu
+	wg         sync.WaitGroup
+}
+
+// NewServer returns a broker listening on addr once ListenAndServe is called
+func NewServer(addr string) *Server {
+	return &Server{
+		Addr:           addr,
+		ShareStrategy:  NewRoundRobinStrategy(),
+		ReceiveMaximum: DefaultReceiveMaximum,
+		MaxInflight:    DefaultMaxInflight,
+		MaxQueued:      DefaultMaxQueued,
+		ConnectTimeout: DefaultConnectTimeout,
+
+		AssignedIDFormat: ClientIDRandom,
+
+		MaximumQoS:            mqttp.QoS2,
+		RetainAvailable:       true,
+		WildcardSubscriptions: true,
+		SharedSubscriptions:   true,
+
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*client]struct{}),
+		sessions:  make(map[string]*session),
+		attaching: make(map[string]chan struct{}),
+		subs:      newSubscriptions(),
+		retained:  newRetainStore(),
+	}
+}
+
+// ListenAndServe listens on the TCP address this.Addr and then calls Serve.
+// It always returns a non-nil error; after Shutdown it is ErrServerClosed.
+func (this *Server) ListenAndServe() error {
+	addr := this.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	return this.ListenAndServeListener(&Listener{Addr: addr})
+}
+
+// Serve accepts incoming connections on l and starts a client goroutine
+// for each of them. Serve always closes l before returning.
+func (this *Server) Serve(l net.Listener) error {
+	return this.ServeListener(l, &Listener{Addr: l.Addr().String()})
+}
+
+// Shutdown stops the listeners, asks every connected client to go away
+// and waits for their goroutines to finish. If ctx expires first the
+// remaining connections are closed and ctx.Err() is returned.
+func (this *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&this.inShutdown, 1)
+
+	this.mu.Lock()
+	lnerr := this.closeListenersLocked()
+	for c := range this.conns {
+		c.disconnect(mqttp.CodeServerShuttingDown)
+	}
+	this.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		this.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return lnerr
+	case <-ctx.Done():
+		this.mu.Lock()
+		for c := range this.conns {
+			c.close()
+		}
+		this.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (this *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&this.inShutdown) != 0
+}
+
+func (this *Server) trackListener(l net.Listener, add bool) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if add {
+		if this.shuttingDown() {
+			return false
+		}
+		this.listeners[l] = struct{}{}
+	} else {
+		delete(this.listeners, l)
+	}
+	return true
+}
+
+func (this *Server) closeListenersLocked() error {
+	var err error
+	for l := range this.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (this *Server) trackConn(c *client, add bool) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if add {
+		if this.shuttingDown() {
+			return false
+		}
+		this.conns[c] = struct{}{}
+		this.wg.Add(1)
+	} else {
+		if _, ok := this.conns[c]; ok {
+			delete(this.conns, c)
+			this.wg.Done()
+		}
+	}
+	return true
+}
+
+func (this *Server) lookup(id string) *session {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.sessions[id]
+}
+
+// publish routes msg from the sender to every matching subscriber and to
+// one member of every matching shared subscription group. A message with
+// the retain flag replaces the retained message of its topic.
+func (this *Server) publish(from *client, msg *mqttp.Publish) {
+	var publisher string
+	if from != nil {
+		publisher = from.id
+	}
+	if msg.GetRetain() {
+		this.retained.store(msg)
+	}
+	subs, groups := this.subs.match(msg.Topic())
+	f := newFanout(msg)
+	for id, ops := range subs {
+		if ops.NL() && publisher == id {
+			continue
+		}
+		s := this.lookup(id)
+		if s == nil {
+			continue
+		}
+		// Retain As Published keeps the flag, otherwise it is cleared [MQTT-3.3.1-12]
+		s.deliver(f, grantedQoS(msg, ops), ops.RAP() && msg.GetRetain(), "")
+	}
+	for _, g := range groups {
+		this.publishShared(publisher, f, g, "")
+	}
+	f.release()
+}
+
+// publishShared delivers the message of f to one member of a shared
+// subscription group other than exclude, it reports false if there is none.
+// Connected members are preferred, the session of an offline member queues
+// the message.
+func (this *Server) publishShared(publisher string, f *fanout, g *sharedMatch, exclude string) bool {
+	var online, offline []string
+	for id := range g.members {
+		s := this.lookup(id)
+		if id == exclude || s == nil {
+			continue
+		}
+		if s.conn() != nil {
+			online = append(online, id)
+		} else {
+			offline = append(offline, id)
+		}
+	}
+	members := online
+	if len(members) == 0 {
+		members = offline
+	}
+	if len(members) == 0 {
+		return false
+	}
+	sort.Strings(members)
+	id := this.shareStrategy().Pick(g.key(), members, publisher, f.msg)
+	s := this.lookup(id)
+	if s == nil {
+		return false
+	}
+	s.deliver(f, grantedQoS(f.msg, g.members[id]), false, g.key())
+	return true
+}
+
+// grantedQoS is the QoS a message is forwarded with to a subscription
+func grantedQoS(msg *mqttp.Publish, ops mqttp.SubOps) byte {
+	if ops.QoS() < msg.GetQos() {
+		return ops.QoS()
+	}
+	return msg.GetQos()
+}
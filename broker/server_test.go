@@ -0,0 +1,228 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// pipeListener hands the server ends of net.Pipe connections to Serve
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (this *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-this.conns:
+		return c, nil
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (this *pipeListener) Close() error {
+	select {
+	case <-this.done:
+	default:
+		close(this.done)
+	}
+	return nil
+}
+
+func (this *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// dial returns the client end of a new connection
+func (this *pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	this.conns <- server
+	return client
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// startServer serves a new Server over a pipeListener until the test ends
+func startServer(t *testing.T, setup func(*Server)) (*Server, *pipeListener) {
+	t.Helper()
+	srv := NewServer("")
+	if setup != nil {
+		setup(srv)
+	}
+	l := newPipeListener()
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv, l
+}
+
+// testClient speaks MQTT over the client end of a pipe
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *mqttp.Decoder
+	enc  *mqttp.Encoder
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	dec, enc := mqttp.NewCodec(conn, conn)
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, dec: dec, enc: enc}
+}
+
+func (this *testClient) send(pkt mqttp.Packet) {
+	this.t.Helper()
+	this.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := this.enc.Encode(pkt); err != nil {
+		this.t.Fatalf("send %s: %s", pkt.GetType().Name(), err)
+	}
+}
+
+func (this *testClient) receive() mqttp.Packet {
+	this.t.Helper()
+	this.conn.SetReadDeadline(time.Now().Add(time.Second))
+	pkt, err := this.dec.Decode()
+	if err != nil {
+		this.t.Fatalf("receive: %s", err)
+	}
+	return pkt
+}
+
+// connect sends CONNECT and returns the CONNACK
+func (this *testClient) connect(v byte, id string) *mqttp.ConnAck {
+	this.t.Helper()
+	c := mqttp.NewConnect()
+	c.SetVersion(v)
+	c.SetClean(true)
+	c.SetClientID(id)
+	this.send(c)
+	ack, ok := this.receive().(*mqttp.ConnAck)
+	if !ok {
+		this.t.Fatal("expected CONNACK")
+	}
+	return ack
+}
+
+func TestConnectSubscribePublish(t *testing.T) {
+	for _, v := range []byte{mqttp.MQTT31, mqttp.MQTT311, mqttp.MQTT50} {
+		t.Run(versionName(v), func(t *testing.T) {
+			_, l := startServer(t, nil)
+			c := newTestClient(t, l.dial())
+
+			if ack := c.connect(v, "c1"); ack.ReasonCode() != mqttp.CodeSuccess {
+				t.Fatalf("CONNACK reason code 0x%02X", ack.ReasonCode().Value())
+			}
+
+			sub := mqttp.NewSubscribe()
+			sub.SetPacketID(1)
+			sub.AddTopic("a/+", mqttp.SubOps(mqttp.QoS1))
+			c.send(sub)
+			suback, ok := c.receive().(*mqttp.SubAck)
+			if !ok || suback.GetPacketID() != 1 {
+				t.Fatal("expected SUBACK of packet 1")
+			}
+			if codes := suback.ReasonCodes(); len(codes) != 1 || codes[0] != mqttp.ReasonCode(mqttp.QoS1) {
+				t.Fatalf("SUBACK reason codes %v", codes)
+			}
+
+			pub := mqttp.NewPublish()
+			pub.SetQos(mqttp.QoS1)
+			pub.SetPacketID(2)
+			pub.SetTopic("a/b")
+			pub.SetPayload([]byte("hello"))
+			c.send(pub)
+
+			var gotAck, gotPub bool
+			for !gotAck || !gotPub {
+				switch p := c.receive().(type) {
+				case *mqttp.PubAck:
+					if p.GetPacketID() != 2 {
+						t.Fatalf("PUBACK of packet %d", p.GetPacketID())
+					}
+					gotAck = true
+				case *mqttp.Publish:
+					if p.Topic() != "a/b" || string(p.Payload()) != "hello" || p.GetQos() != mqttp.QoS1 {
+						t.Fatalf("got PUBLISH %s %q qos %d", p.Topic(), p.Payload(), p.GetQos())
+					}
+					ack := mqttp.NewPubAck()
+					ack.SetPacketID(p.GetPacketID())
+					c.send(ack)
+					gotPub = true
+				default:
+					t.Fatalf("unexpected %s", p.GetType().Name())
+				}
+			}
+		})
+	}
+}
+
+func TestConnectUnsupportedProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		connect []byte
+		want    []byte // CONNACK
+	}{
+		{"unknown level",
+			[]byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 6, 0x02, 0, 60, 0, 1, 'c'},
+			[]byte{0x20, 3, 0, 0x84, 0}},
+		{"MQIsdp at level 4",
+			[]byte{0x10, 15, 0, 6, 'M', 'Q', 'I', 's', 'd', 'p', 4, 0x02, 0, 60, 0, 1, 'c'},
+			[]byte{0x20, 2, 0, 0x01}},
+		{"MQTT at level 3",
+			[]byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 3, 0x02, 0, 60, 0, 1, 'c'},
+			[]byte{0x20, 2, 0, 0x01}},
+		{"unknown protocol name",
+			[]byte{0x10, 13, 0, 4, 'M', 'Q', 'X', 'X', 4, 0x02, 0, 60, 0, 1, 'c'},
+			[]byte{0x20, 2, 0, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, l := startServer(t, nil)
+			conn := l.dial()
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+
+			if _, err := conn.Write(tt.connect); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.want))
+			if _, err := readFull(conn, got); err != nil {
+				t.Fatalf("reading CONNACK: %s", err)
+			}
+			if string(got) != string(tt.want) {
+				t.Fatalf("CONNACK % X, want % X", got, tt.want)
+			}
+			// the connection is closed after CONNACK
+			if n, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Fatalf("read %d more bytes, want the connection closed", n)
+			}
+		})
+	}
+}
+
+func readFull(conn net.Conn, buff []byte) (int, error) {
+	n := 0
+	for n < len(buff) {
+		m, err := conn.Read(buff[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,331 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+	"github.com/wonderivan/logger"
+)
+
+// NeverExpire is the Session Expiry Interval of a session which is kept
+// until the client asks for a clean one
+const NeverExpire uint32 = 0xFFFFFFFF
+
+// session is the state of a client ID. It keeps the subscriptions, the
+// in-flight messages and the messages queued while the client is offline
+// after its connection ends, until the Session Expiry Interval elapses.
+type session struct {
+	id     string
+	flight *inflight
+
+	mu       sync.Mutex
+	client   *client     // current connection, nil while offline
+	username string      // of the last connection, for the Authorizer
+	listener *Listener   // the last connection came through
+	expiry   uint32      // Session Expiry Interval in seconds
+	timer    *time.Timer // ends the session once it is offline for expiry
+
+	will      *mqttp.Publish // will message waiting for the Will Delay Interval
+	willTimer *time.Timer
+}
+
+func newSession(id string, flight *inflight) *session {
+	return &session{id: id, flight: flight}
+}
+
+// conn returns the current connection, nil while offline
+func (this *session) conn() *client {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.client
+}
+
+// setExpiry changes the Session Expiry Interval, on DISCONNECT for example
+func (this *session) setExpiry(v uint32) {
+	this.mu.Lock()
+	this.expiry = v
+	this.mu.Unlock()
+}
+
+// takeWill removes and returns the pending will message, nil if there is none
+func (this *session) takeWill() *mqttp.Publish {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.takeWillLocked()
+}
+
+func (this *session) takeWillLocked() *mqttp.Publish {
+	will := this.will
+	this.will = nil
+	if this.willTimer != nil {
+		this.willTimer.Stop()
+		this.willTimer = nil
+	}
+	return will
+}
+
+// copyProps copies the PUBLISH properties passed on to subscribers
+// unchanged [MQTT-3.3.2-15] [MQTT-3.3.2-17] [MQTT-3.3.2-18] from src
+// into dst
+func copyProps(dst *mqttp.PropertySet, src *mqttp.PropertySet) {
+	if v, ok := src.PayloadFormatIndicator(); ok {
+		dst.SetPayloadFormatIndicator(v)
+	}
+	if v, ok := src.ContentType(); ok {
+		dst.SetContentType(v)
+	}
+	if v, ok := src.ResponseTopic(); ok {
+		dst.SetResponseTopic(v)
+	}
+	if v, ok := src.CorrelationData(); ok {
+		dst.SetCorrelationData(v)
+	}
+	for _, p := range src.UserProperties() {
+		dst.AddUserProperty(p.Key(), p.Value())
+	}
+}
+
+// deliver sends the message of f with the given QoS and retain flag, share
+// is the shared subscription the message was picked for, if any. QoS 1/2
+// messages are queued while the client is offline, QoS 0 messages are
+// dropped. Expired messages are not sent.
+func (this *session) deliver(f *fanout, qos byte, retain bool, share string) {
+	if f.msg.Expired() {
+		return
+	}
+	c := this.conn()
+	if qos == mqttp.QoS0 {
+		if c != nil {
+			c.send(f.shared(c, retain))
+		}
+		return
+	}
+	pkt := f.copy(qos, retain)
+	if c == nil {
+		if !this.flight.enqueue(pkt, share) {
+			logger.Warn(fmt.Sprintf("Session %s queue is full, dropping message on %s", this.id, f.msg.Topic()))
+			pkt.Release()
+		}
+		return
+	}
+	ready, ok := this.flight.push(pkt, share)
+	if !ok {
+		logger.Warn(fmt.Sprintf("Client %s message queue is full, dropping message on %s", this.id, f.msg.Topic()))
+		pkt.Release()
+		return
+	}
+	if ready != nil {
+		c.forward(ready)
+	}
+}
+
+// takeoverTimeout bounds the wait for a connection being taken over to
+// write its DISCONNECT and stop
+const takeoverTimeout = 5 * time.Second
+
+// attach binds a connection to the session of its client ID. With clean
+// start an existing session is discarded, present reports whether an
+// existing session is resumed. Connections of the same client ID attach
+// one at a time.
+func (this *Server) attach(c *client, clean bool, expiry uint32, flight *inflight) (s *session, present bool) {
+	release := this.lockClientID(c.id)
+	defer release()
+
+	this.mu.Lock()
+	if s = this.sessions[c.id]; s != nil {
+		// detach the connection which still owns the session, so that it
+		// neither ends the session nor publishes a delayed will. Messages
+		// arriving meanwhile are queued for the new connection.
+		s.mu.Lock()
+		old := s.client
+		s.client = nil
+		s.mu.Unlock()
+		if old != nil {
+			this.mu.Unlock()
+			this.takeover(old)
+			this.mu.Lock()
+			// a delayed will of the connection taken over is handed to the
+			// session: clean start publishes it, a resume cancels it
+			if old.will != nil && old.willDelay > 0 {
+				s.mu.Lock()
+				s.will = old.will
+				s.mu.Unlock()
+			}
+		}
+	}
+
+	var ended *session
+	if s != nil && clean {
+		delete(this.sessions, c.id)
+		this.subs.removeClient(c.id)
+		ended, s = s, nil
+	}
+	if s == nil {
+		s = newSession(c.id, flight)
+		this.sessions[c.id] = s
+	} else {
+		present = true
+	}
+
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	// a reconnect before the Will Delay Interval cancels the will
+	s.takeWillLocked()
+	s.client = c
+	s.username = c.username
+	s.listener = c.listener
+	s.expiry = expiry
+	s.mu.Unlock()
+	this.mu.Unlock()
+
+	// a session ended by clean start publishes its delayed will [MQTT-3.1.3-9]
+	if ended != nil {
+		if w := ended.takeWill(); w != nil {
+			this.publishWill(c.id, w)
+		}
+		this.redeliverShared(ended)
+	}
+	return s, present
+}
+
+// takeover closes a connection whose client ID connected again
+// [MQTT-3.1.4-3], MQTT 5.0 clients are told by DISCONNECT with reason code
+// 0x8E first. It returns once the connection has stopped.
+func (this *Server) takeover(old *client) {
+	logger.Info(fmt.Sprintf("Client %s reconnected, closing previous connection", old.id))
+	old.disconnect(mqttp.CodeSessionTakenOver)
+	select {
+	case <-old.stopped:
+		return
+	case <-time.After(takeoverTimeout):
+		old.close()
+	}
+	<-old.stopped
+}
+
+// lockClientID waits until no other connection of the client ID is
+// attaching and returns the function releasing it
+func (this *Server) lockClientID(id string) func() {
+	for {
+		this.mu.Lock()
+		wait, busy := this.attaching[id]
+		if !busy {
+			done := make(chan struct{})
+			this.attaching[id] = done
+			this.mu.Unlock()
+			return func() {
+				this.mu.Lock()
+				delete(this.attaching, id)
+				this.mu.Unlock()
+				close(done)
+			}
+		}
+		this.mu.Unlock()
+		<-wait
+	}
+}
+
+// detach unbinds a connection from its session when the connection ends.
+// The session ends at once with a zero expiry interval, otherwise it is
+// kept for the expiry interval and resends its unacknowledged messages on
+// resume. The will of the connection is published or scheduled unless
+// DISCONNECT dropped it.
+func (this *Server) detach(c *client) {
+	this.mu.Lock()
+	s := this.sessions[c.id]
+	if s == nil || s.conn() != c {
+		this.mu.Unlock()
+		// taken over, a will without delay is still published [MQTT-3.1.3-9],
+		// attach hands a delayed one to the session
+		if c.will != nil && c.willDelay == 0 {
+			this.publishWill(c.id, c.will)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	s.client = nil
+	expiry := s.expiry
+	if expiry != 0 && expiry != NeverExpire {
+		s.timer = time.AfterFunc(time.Duration(expiry)*time.Second, func() {
+			this.expire(s)
+		})
+	}
+	var will *mqttp.Publish
+	if c.will != nil {
+		will = this.scheduleWill(s, c.will, c.willDelay)
+	}
+	s.mu.Unlock()
+
+	if expiry == 0 {
+		delete(this.sessions, c.id)
+		this.subs.removeClient(c.id)
+	}
+	this.mu.Unlock()
+
+	if will != nil {
+		this.publishWill(c.id, will)
+	}
+	if expiry == 0 {
+		this.redeliverShared(s)
+	}
+}
+
+// expire ends a session which stayed offline for its expiry interval
+func (this *Server) expire(s *session) {
+	this.mu.Lock()
+	if this.sessions[s.id] != s || s.conn() != nil {
+		this.mu.Unlock()
+		return
+	}
+	delete(this.sessions, s.id)
+	this.subs.removeClient(s.id)
+	this.mu.Unlock()
+
+	logger.Info(fmt.Sprintf("Session %s expired", s.id))
+	if will := s.takeWill(); will != nil {
+		this.publishWill(s.id, will)
+	}
+	this.redeliverShared(s)
+}
+
+// redeliverShared hands the unacknowledged messages of shared subscriptions
+// of an ended session to other members of the groups. A message leaves the
+// session only once another member took it.
+func (this *Server) redeliverShared(s *session) {
+	for key, msgs := range s.flight.shared() {
+		group, filter, _ := parseShared(key)
+		for _, msg := range msgs {
+			g := this.subs.sharedGroup(group, filter)
+			f := newFanout(msg)
+			taken := g != nil && this.publishShared("", f, g, s.id)
+			f.release()
+			if !taken {
+				// no other member is left, neither for the later messages
+				break
+			}
+			s.flight.remove(msg)
+		}
+	}
+}
+
+// sessionExpiry is the Session Expiry Interval asked for by CONNECT, capped
+// by MaxSessionExpiry. MQTT 3.1.1 sessions end with the connection if clean
+// session is set and never expire otherwise.
+func (this *client) sessionExpiry(pkt *mqttp.Connect) uint32 {
+	var expiry uint32
+	if pkt.GetVersion() == mqttp.MQTT50 {
+		expiry, _ = pkt.Props().SessionExpiryInterval()
+	} else if !pkt.IsClean() {
+		expiry = NeverExpire
+	}
+	if max := this.limits.maxSessionExpiry; max > 0 && expiry > max {
+		expiry = max
+	}
+	return expiry
+}
@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// waitOffline waits until the session of a client ID has no connection
+func waitOffline(t *testing.T, srv *Server, id string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if s := srv.lookup(id); s != nil && s.conn() == nil {
+			return
+		}
+	}
+	t.Fatalf("session %s still connected", id)
+}
+
+// tryReceive returns the next packet or nil when none arrives within d
+func (this *testClient) tryReceive(d time.Duration) mqttp.Packet {
+	this.conn.SetReadDeadline(time.Now().Add(d))
+	pkt, err := this.dec.Decode()
+	if err != nil {
+		return nil
+	}
+	return pkt
+}
+
+// subscribe subscribes to filter and waits for SUBACK
+func (this *testClient) subscribe(filter string, qos byte) {
+	this.t.Helper()
+	sub := mqttp.NewSubscribe()
+	sub.SetPacketID(1)
+	sub.AddTopic(filter, mqttp.SubOps(qos))
+	this.send(sub)
+	if _, ok := this.receive().(*mqttp.SubAck); !ok {
+		this.t.Fatal("expected SUBACK")
+	}
+}
+
+func TestDelayedWillOnReconnect(t *testing.T) {
+	tests := []struct {
+		name  string
+		clean bool
+		want  bool
+	}{
+		{"clean start ends the session", true, true},
+		{"resumed session cancels the will", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, l := startServer(t, nil)
+			watcher := newTestClient(t, l.dial())
+			watcher.connect(mqttp.MQTT50, "watcher")
+			watcher.subscribe("will/c1", mqttp.QoS0)
+
+			conn := l.dial()
+			c1 := newTestClient(t, conn)
+			connect := mqttp.NewConnect()
+			connect.SetVersion(mqttp.MQTT50)
+			connect.SetClientID("c1")
+			connect.Props().SetSessionExpiryInterval(300)
+			connect.SetWill("will/c1", []byte("gone"), mqttp.QoS0, false)
+			connect.WillProps().SetWillDelayInterval(60)
+			c1.send(connect)
+			if _, ok := c1.receive().(*mqttp.ConnAck); !ok {
+				t.Fatal("expected CONNACK")
+			}
+			conn.Close()
+			waitOffline(t, srv, "c1")
+			if pkt := watcher.tryReceive(50 * time.Millisecond); pkt != nil {
+				t.Fatalf("will published before its delay: %s", pkt)
+			}
+
+			again := newTestClient(t, l.dial())
+			reconnect := mqttp.NewConnect()
+			reconnect.SetVersion(mqttp.MQTT50)
+			reconnect.SetClientID("c1")
+			reconnect.SetClean(tt.clean)
+			reconnect.Props().SetSessionExpiryInterval(300)
+			again.send(reconnect)
+			if _, ok := again.receive().(*mqttp.ConnAck); !ok {
+				t.Fatal("expected CONNACK")
+			}
+
+			pkt := watcher.tryReceive(200 * time.Millisecond)
+			pub, got := pkt.(*mqttp.Publish)
+			if got != tt.want {
+				t.Fatalf("will received %t, want %t", got, tt.want)
+			}
+			if got && (pub.Topic() != "will/c1" || string(pub.Payload()) != "gone") {
+				t.Errorf("will %s %q", pub.Topic(), pub.Payload())
+			}
+		})
+	}
+}
+
+func TestDelayedWillOnTakeover(t *testing.T) {
+	tests := []struct {
+		name  string
+		clean bool
+		want  bool
+	}{
+		{"clean start ends the session", true, true},
+		{"resumed session cancels the will", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, l := startServer(t, nil)
+			watcher := newTestClient(t, l.dial())
+			watcher.connect(mqttp.MQTT50, "watcher")
+			watcher.subscribe("will/c1", mqttp.QoS0)
+
+			c1 := newTestClient(t, l.dial())
+			connect := mqttp.NewConnect()
+			connect.SetVersion(mqttp.MQTT50)
+			connect.SetClientID("c1")
+			connect.Props().SetSessionExpiryInterval(300)
+			connect.SetWill("will/c1", []byte("gone"), mqttp.QoS0, false)
+			connect.WillProps().SetWillDelayInterval(60)
+			c1.send(connect)
+			if _, ok := c1.receive().(*mqttp.ConnAck); !ok {
+				t.Fatal("expected CONNACK")
+			}
+			// the first connection stays open and reads its DISCONNECT
+			taken := make(chan mqttp.Packet, 1)
+			go func() {
+				taken <- c1.tryReceive(time.Second)
+			}()
+
+			again := newTestClient(t, l.dial())
+			reconnect := mqttp.NewConnect()
+			reconnect.SetVersion(mqttp.MQTT50)
+			reconnect.SetClientID("c1")
+			reconnect.SetClean(tt.clean)
+			reconnect.Props().SetSessionExpiryInterval(300)
+			again.send(reconnect)
+			if _, ok := again.receive().(*mqttp.ConnAck); !ok {
+				t.Fatal("expected CONNACK")
+			}
+			if d, ok := (<-taken).(*mqttp.Disconnect); !ok || d.ReasonCode() != mqttp.CodeSessionTakenOver {
+				t.Fatal("first connection was not told about the takeover")
+			}
+
+			pkt := watcher.tryReceive(200 * time.Millisecond)
+			pub, got := pkt.(*mqttp.Publish)
+			if got != tt.want {
+				t.Fatalf("will received %t, want %t", got, tt.want)
+			}
+			if got && (pub.Topic() != "will/c1" || string(pub.Payload()) != "gone") {
+				t.Errorf("will %s %q", pub.Topic(), pub.Payload())
+			}
+		})
+	}
+}
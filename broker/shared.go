@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// ShareStrategy chooses which member of a shared subscription group
+// receives a message. Each message of a group goes to exactly one member.
+type ShareStrategy interface {
+	// Pick returns one of members, members is never empty and sorted.
+	// The payload of msg may be reused once Pick returns, see
+	// mqttp.Publish.Release.
+	Pick(group string, members []string, publisher string, msg *mqttp.Publish) string
+}
+
+// NewShareStrategy returns the strategy registered under name:
+// "round_robin", "random", "sticky" or "hash"
+func NewShareStrategy(name string) (ShareStrategy, error) {
+	switch name {
+	case "", "round_robin":
+		return NewRoundRobinStrategy(), nil
+	case "random":
+		return RandomStrategy{}, nil
+	case "sticky":
+		return NewStickyStrategy(), nil
+	case "hash":
+		return HashTopicStrategy{}, nil
+	}
+	return nil, fmt.Errorf("broker: unknown shared subscription strategy %q", name)
+}
+
+// RoundRobinStrategy hands the messages of a group to its members in turn
+type RoundRobinStrategy struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func NewRoundRobinStrategy() *RoundRobinStrategy {
+	return &RoundRobinStrategy{next: make(map[string]int)}
+}
+
+func (this *RoundRobinStrategy) Pick(group string, members []string, publisher string, msg *mqttp.Publish) string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	i := this.next[group] % len(members)
+	this.next[group] = i + 1
+	return members[i]
+}
+
+// RandomStrategy picks a member at random
+type RandomStrategy struct{}
+
+func (RandomStrategy) Pick(group string, members []string, publisher string, msg *mqttp.Publish) string {
+	return members[rand.Intn(len(members))]
+}
+
+// StickyStrategy keeps sending the messages of a publisher to the same
+// member for as long as that member stays in the group
+type StickyStrategy struct {
+	mu     sync.Mutex
+	chosen map[string]string // group + publisher -> member
+}
+
+func NewStickyStrategy() *StickyStrategy {
+	return &StickyStrategy{chosen: make(map[string]string)}
+}
+
+func (this *StickyStrategy) Pick(group string, members []string, publisher string, msg *mqttp.Publish) string {
+	key := group + "\x00" + publisher
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if id, ok := this.chosen[key]; ok {
+		for _, m := range members {
+			if m == id {
+				return id
+			}
+		}
+	}
+	id := members[rand.Intn(len(members))]
+	this.chosen[key] = id
+	return id
+}
+
+// HashTopicStrategy sends all messages of a topic to the same member, so
+// that their order is kept as long as the group does not change
+type HashTopicStrategy struct{}
+
+func (HashTopicStrategy) Pick(group string, members []string, publisher string, msg *mqttp.Publish) string {
+	h := fnv.New32a()
+	h.Write([]byte(msg.Topic()))
+	return members[h.Sum32()%uint32(len(members))]
+}
+
+// sharedMatch is a snapshot of a shared subscription group matching a topic
+type sharedMatch struct {
+	group   string
+	filter  string
+	members map[string]mqttp.SubOps
+}
+
+// key returns the subscription string "$share/{group}/{filter}"
+func (this *sharedMatch) key() string {
+	return sharePrefix + this.group + "/" + this.filter
+}
+
+const sharePrefix = "$share/"
+
+// parseShared splits a shared subscription "$share/{group}/{filter}",
+// ok is false for a non shared topic filter
+func parseShared(filter string) (group string, topicFilter string, ok bool) {
+	m := mqttp.SharedTopicRegexp.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[3], true
+}
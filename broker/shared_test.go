@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func newMessage(topic string, payload string) *mqttp.Publish {
+	msg := mqttp.NewPublish()
+	msg.SetTopic(topic)
+	msg.SetQos(mqttp.QoS1)
+	msg.SetPayload([]byte(payload))
+	return msg
+}
+
+func TestShareStrategies(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	msg := newMessage("t/1", "")
+
+	rr := NewRoundRobinStrategy()
+	for i, want := range []string{"a", "b", "c", "a"} {
+		if got := rr.Pick("g", members, "p", msg); got != want {
+			t.Errorf("round robin pick %d: %s, want %s", i, got, want)
+		}
+	}
+	if got := rr.Pick("other", members, "p", msg); got != "a" {
+		t.Errorf("round robin of another group starts with %s", got)
+	}
+
+	sticky := NewStickyStrategy()
+	first := sticky.Pick("g", members, "p", msg)
+	for i := 0; i < 10; i++ {
+		if got := sticky.Pick("g", members, "p", msg); got != first {
+			t.Fatalf("sticky moved from %s to %s", first, got)
+		}
+	}
+	var rest []string
+	for _, m := range members {
+		if m != first {
+			rest = append(rest, m)
+		}
+	}
+	moved := sticky.Pick("g", rest, "p", msg)
+	if moved == first {
+		t.Fatalf("sticky kept %s after it left the group", first)
+	}
+	if got := sticky.Pick("g", members, "p", msg); got != moved {
+		t.Errorf("sticky went back to %s, want %s", got, moved)
+	}
+
+	var hash HashTopicStrategy
+	want := hash.Pick("g", members, "p", msg)
+	for _, publisher := range []string{"p", "q", ""} {
+		if got := hash.Pick("g", members, publisher, msg); got != want {
+			t.Errorf("hash of the same topic picked %s and %s", want, got)
+		}
+	}
+
+	var random RandomStrategy
+	for i := 0; i < 20; i++ {
+		got := random.Pick("g", members, "p", msg)
+		if got != "a" && got != "b" && got != "c" {
+			t.Fatalf("random picked %q", got)
+		}
+	}
+}
+
+func TestNewShareStrategy(t *testing.T) {
+	for _, name := range []string{"", "round_robin", "random", "sticky", "hash"} {
+		if s, err := NewShareStrategy(name); err != nil || s == nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	if _, err := NewShareStrategy("fastest"); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+// firstStrategy always picks the first member
+type firstStrategy struct{}
+
+func (firstStrategy) Pick(group string, members []string, publisher string, msg *mqttp.Publish) string {
+	return members[0]
+}
+
+func TestRedeliverShared(t *testing.T) {
+	srv := NewServer("")
+	srv.ShareStrategy = firstStrategy{}
+	ln := &Listener{}
+	a := addSubscriber(srv, "a", mqttp.MQTT50, ln, "$share/g/t", mqttp.QoS1)
+	b := addSubscriber(srv, "b", mqttp.MQTT50, ln, "$share/g/t", mqttp.QoS1)
+	srv.publish(nil, newMessage("t", "m1"))
+	srv.publish(nil, newMessage("t", "m2"))
+	if a.sent() == nil || a.sent() == nil {
+		t.Fatal("a did not get both messages")
+	}
+
+	// a persistent session keeps its messages to resend them on resume
+	s := a.session
+	s.setExpiry(NeverExpire)
+	srv.detach(a)
+	if pkt := b.sent(); pkt != nil {
+		t.Fatalf("b got %q while the session of a is kept", pkt.Payload())
+	}
+	if n := len(s.flight.pending()); n != 2 {
+		t.Fatalf("session of a keeps %d messages, want 2", n)
+	}
+
+	// once the session ends they go to another member, in order
+	srv.expire(s)
+	for _, want := range []string{"m1", "m2"} {
+		pkt := b.sent()
+		if pkt == nil || string(pkt.Payload()) != want {
+			t.Fatalf("b got %v, want %s", pkt, want)
+		}
+	}
+	if n := len(s.flight.shared()); n != 0 {
+		t.Errorf("%d subscriptions left in the ended session", n)
+	}
+}
+
+func TestRedeliverSharedWithoutMember(t *testing.T) {
+	srv := NewServer("")
+	c := addSubscriber(srv, "c", mqttp.MQTT50, &Listener{}, "$share/g/t", mqttp.QoS1)
+	srv.publish(nil, newMessage("t", "m1"))
+	if c.sent() == nil {
+		t.Fatal("c got nothing")
+	}
+
+	srv.detach(c)
+	if srv.lookup("c") != nil {
+		t.Fatal("session with zero expiry interval kept")
+	}
+	if msgs := c.session.flight.shared()["$share/g/t"]; len(msgs) != 1 {
+		t.Errorf("%d messages left with the session, want 1", len(msgs))
+	}
+}
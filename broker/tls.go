@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// DefaultTLSAddr is the listen address of ListenAndServeTLS when addr is empty
+const DefaultTLSAddr = ":8883"
+
+// TLSOptions describes the TLS setup of a listener
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// CAFile is a PEM bundle client certificates are verified against,
+	// clients may connect without a certificate unless RequireClientCert
+	CAFile            string
+	RequireClientCert bool
+
+	// MinVersion is "1.0", "1.1", "1.2" or "1.3", "1.2" if empty
+	MinVersion string
+
+	// CipherSuites are names as listed by tls.CipherSuites, the Go
+	// defaults if empty. TLS 1.3 suites are not configurable.
+	CipherSuites []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config builds the tls.Config of the options
+func (this *TLSOptions) Config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(this.CertFile, this.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if this.MinVersion != "" {
+		v, ok := tlsVersions[this.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", this.MinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	if len(this.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range this.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	if this.CAFile != "" {
+		pem, err := ioutil.ReadFile(this.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", this.CAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if this.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if this.RequireClientCert {
+		return nil, errors.New("client certificates need a CA file")
+	}
+	return config, nil
+}
+
+// ReloadableTLS hands out the TLS configuration stored last to every new
+// handshake, so that the certificates of a listener can be replaced while
+// it serves. Established connections are not affected.
+type ReloadableTLS struct {
+	config atomic.Value
+}
+
+// NewReloadableTLS returns a ReloadableTLS holding config
+func NewReloadableTLS(config *tls.Config) *ReloadableTLS {
+	r := &ReloadableTLS{}
+	r.Store(config)
+	return r
+}
+
+// Store replaces the configuration
+func (this *ReloadableTLS) Store(config *tls.Config) {
+	this.config.Store(config)
+}
+
+// Config returns the configuration to give Listener.TLS
+func (this *ReloadableTLS) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return this.config.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// ListenAndServeTLS listens on addr, ":8883" if empty, and serves MQTT over
+// TLS with config
+func (this *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
+	if addr == "" {
+		addr = DefaultTLSAddr
+	}
+	return this.ListenAndServeListener(&Listener{Addr: addr, TLS: config})
+}
+
+// CertIdentity selects the part of a verified client certificate used as
+// the user name of a client
+type CertIdentity string
+
+const (
+	// CertIdentityNone ignores client certificates for user names
+	CertIdentityNone CertIdentity = ""
+	// CertIdentityCN uses the subject common name
+	CertIdentityCN CertIdentity = "cn"
+	// CertIdentitySAN uses the first DNS name, e-mail address or URI
+	// subject alternative name
+	CertIdentitySAN CertIdentity = "san"
+)
+
+// identity returns the user name of a verified client certificate
+func (this CertIdentity) identity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || this == CertIdentityNone {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	switch this {
+	case CertIdentityCN:
+		return cert.Subject.CommonName
+	case CertIdentitySAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// ParseCertIdentity checks the name of a CertIdentity
+func ParseCertIdentity(name string) (CertIdentity, error) {
+	switch v := CertIdentity(strings.ToLower(name)); v {
+	case CertIdentityNone, CertIdentityCN, CertIdentitySAN:
+		return v, nil
+	}
+	return CertIdentityNone, fmt.Errorf("unknown certificate identity %q", name)
+}
+
+// CertAuthenticator accepts clients which presented a verified certificate
+// with an identity, so that they need no password. Other clients are left
+// to the next authenticator of a chain.
+type CertAuthenticator struct{}
+
+// Authenticate implements Authenticator
+func (this CertAuthenticator) Authenticate(pkt *mqttp.Connect, info *ConnInfo) (AuthResult, mqttp.ReasonCode) {
+	if info.Identity == "" {
+		return AuthIgnore, mqttp.CodeSuccess
+	}
+	return AuthAllow, mqttp.CodeSuccess
+}
@@ -0,0 +1,244 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate and its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert signs template with the key of parent, a nil parent makes a
+// self-signed CA
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and the key as PEM files in dir
+func (this *testCert) write(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(this.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: this.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (this *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{this.der}, PrivateKey: this.key}
+}
+
+// handshake runs a TLS handshake over a pipe and returns the connection
+// states of the server and the client ends
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) (tls.ConnectionState, tls.ConnectionState) {
+	t.Helper()
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	s := tls.Server(sconn, server)
+	c := tls.Client(cconn, client)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Handshake()
+	}()
+	if err := c.Handshake(); err != nil {
+		t.Fatalf("client handshake: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server handshake: %s", err)
+	}
+	return s.ConnectionState(), c.ConnectionState()
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}}, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}, DNSNames: []string{"localhost"}}, ca)
+	certFile, keyFile := server.write(t, dir, "server")
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no certificates\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       TLSOptions
+		minVersion uint16
+		suites     int
+		clientAuth tls.ClientAuthType
+		fails      bool
+	}{
+		{"defaults", TLSOptions{}, tls.VersionTLS12, 0, tls.NoClientCert, false},
+		{"min version", TLSOptions{MinVersion: "1.3"}, tls.VersionTLS13, 0, tls.NoClientCert, false},
+		{"unknown version", TLSOptions{MinVersion: "1.4"}, 0, 0, 0, true},
+		{"cipher suites", TLSOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}},
+			tls.VersionTLS12, 2, tls.NoClientCert, false},
+		{"insecure cipher suite", TLSOptions{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, 0, 0, 0, true},
+		{"unknown cipher suite", TLSOptions{CipherSuites: []string{"TLS_FAST"}}, 0, 0, 0, true},
+		{"optional client certificate", TLSOptions{CAFile: caFile}, tls.VersionTLS12, 0, tls.VerifyClientCertIfGiven, false},
+		{"required client certificate", TLSOptions{CAFile: caFile, RequireClientCert: true}, tls.VersionTLS12, 0, tls.RequireAndVerifyClientCert, false},
+		{"required client certificate without CA", TLSOptions{RequireClientCert: true}, 0, 0, 0, true},
+		{"CA file without certificates", TLSOptions{CAFile: empty}, 0, 0, 0, true},
+		{"missing CA file", TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, 0, 0, 0, true},
+		{"missing key", TLSOptions{KeyFile: filepath.Join(dir, "missing.key")}, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		opts := tt.opts
+		opts.CertFile = certFile
+		if opts.KeyFile == "" {
+			opts.KeyFile = keyFile
+		}
+		config, err := opts.Config()
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if config.MinVersion != tt.minVersion || len(config.CipherSuites) != tt.suites || config.ClientAuth != tt.clientAuth {
+			t.Errorf("%s: min version %x, %d suites, client auth %d", tt.name, config.MinVersion, len(config.CipherSuites), config.ClientAuth)
+		}
+	}
+}
+
+func TestReloadableTLS(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+
+	first := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "first"}, DNSNames: []string{"localhost"}}, ca)
+	reloadable := NewReloadableTLS(&tls.Config{Certificates: []tls.Certificate{first.tlsCert()}})
+	config := reloadable.Config()
+	_, state := handshake(t, config, client)
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != "first" {
+		t.Fatalf("server presented %s", cn)
+	}
+
+	// new handshakes on the same listener configuration get the new one
+	second := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "second"}, DNSNames: []string{"localhost"}}, ca)
+	reloadable.Store(&tls.Config{Certificates: []tls.Certificate{second.tlsCert()}})
+	_, state = handshake(t, config, client)
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != "second" {
+		t.Fatalf("server presented %s after the reload", cn)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}}, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}, DNSNames: []string{"localhost"}}, ca)
+	certFile, keyFile := server.write(t, dir, "server")
+	opts := TLSOptions{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, RequireClientCert: true}
+	config, err := opts.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	uri, _ := url.Parse("spiffe://example.org/device/7")
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		cn   string
+		san  string
+	}{
+		{"DNS name", &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"alice.example.org", "other"}, EmailAddresses: []string{"alice@example.org"}},
+			"alice", "alice.example.org"},
+		{"e-mail address", &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}, EmailAddresses: []string{"bob@example.org"}, URIs: []*url.URL{uri}},
+			"bob", "bob@example.org"},
+		{"URI", &x509.Certificate{Subject: pkix.Name{CommonName: "device"}, URIs: []*url.URL{uri}},
+			"device", "spiffe://example.org/device/7"},
+		{"no SAN", &x509.Certificate{Subject: pkix.Name{CommonName: "carol"}}, "carol", ""},
+	}
+	for _, tt := range tests {
+		cert := newTestCert(t, tt.cert, ca)
+		state, _ := handshake(t, config, &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: []tls.Certificate{cert.tlsCert()}})
+		if got := CertIdentityCN.identity(&state); got != tt.cn {
+			t.Errorf("%s: cn identity %q, want %q", tt.name, got, tt.cn)
+		}
+		if got := CertIdentitySAN.identity(&state); got != tt.san {
+			t.Errorf("%s: san identity %q, want %q", tt.name, got, tt.san)
+		}
+		if got := CertIdentityNone.identity(&state); got != "" {
+			t.Errorf("%s: identity %q without CertIdentity", tt.name, got)
+		}
+	}
+
+	// certificates which were not verified give no identity
+	unverified := tls.ConnectionState{PeerCertificates: []*x509.Certificate{server.cert}}
+	if got := CertIdentityCN.identity(&unverified); got != "" {
+		t.Errorf("identity %q of an unverified certificate", got)
+	}
+	if got := CertIdentityCN.identity(nil); got != "" {
+		t.Errorf("identity %q without TLS", got)
+	}
+}
+
+func TestParseCertIdentity(t *testing.T) {
+	for name, want := range map[string]CertIdentity{"": CertIdentityNone, "cn": CertIdentityCN, "SAN": CertIdentitySAN} {
+		if got, err := ParseCertIdentity(name); err != nil || got != want {
+			t.Errorf("%q: %q %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseCertIdentity("subject"); err == nil {
+		t.Error("unknown identity accepted")
+	}
+}
@@ -0,0 +1,300 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+// topicNode is one topic level of the subscription trie
+type topicNode struct {
+	parent   *topicNode
+	level    string
+	children map[string]*topicNode
+	subs     map[string]mqttp.SubOps            // client ID -> options
+	shared   map[string]map[string]mqttp.SubOps // share group -> client ID -> options
+}
+
+func newTopicNode(parent *topicNode, level string) *topicNode {
+	return &topicNode{
+		parent:   parent,
+		level:    level,
+		children: make(map[string]*topicNode),
+		subs:     make(map[string]mqttp.SubOps),
+		shared:   make(map[string]map[string]mqttp.SubOps),
+	}
+}
+
+func (this *topicNode) empty() bool {
+	return len(this.children) == 0 && len(this.subs) == 0 && len(this.shared) == 0
+}
+
+// filter returns the topic filter ending at this node
+func (this *topicNode) filter() string {
+	if this.parent == nil {
+		return ""
+	}
+	if this.parent.parent == nil {
+		return this.level
+	}
+	return this.parent.filter() + "/" + this.level
+}
+
+// clients returns the subscribers of the node, for a shared subscription
+// group the members of the group
+func (this *topicNode) clients(group string) map[string]mqttp.SubOps {
+	if group == "" {
+		return this.subs
+	}
+	return this.shared[group]
+}
+
+// subscriptions is a trie keyed on topic levels holding the topic filters
+// of every client. Subscribe and unsubscribe cost one step per level of the
+// filter, match only visits the branches the topic can reach.
+type subscriptions struct {
+	mu      sync.RWMutex
+	root    *topicNode
+	clients map[string]map[string]struct{} // client ID -> filters, for removeClient
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		root:    newTopicNode(nil, ""),
+		clients: make(map[string]map[string]struct{}),
+	}
+}
+
+// subscribe adds or replaces the subscription of a client, it reports
+// whether the subscription already existed. A "$share/{group}/{filter}"
+// subscription makes the client a member of the shared group.
+func (this *subscriptions) subscribe(id string, filter string, ops mqttp.SubOps) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	group, topicFilter, ok := parseShared(filter)
+	if !ok {
+		topicFilter = filter
+	}
+	node := this.root
+	for _, level := range strings.Split(topicFilter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode(node, level)
+			node.children[level] = child
+		}
+		node = child
+	}
+	subs := node.clients(group)
+	if subs == nil {
+		subs = make(map[string]mqttp.SubOps)
+		node.shared[group] = subs
+	}
+	_, existed := subs[id]
+	subs[id] = ops
+
+	filters, ok := this.clients[id]
+	if !ok {
+		filters = make(map[string]struct{})
+		this.clients[id] = filters
+	}
+	filters[filter] = struct{}{}
+	return existed
+}
+
+// unsubscribe removes the subscription of a client, it reports whether
+// the subscription existed
+func (this *subscriptions) unsubscribe(id string, filter string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.unsubscribeLocked(id, filter)
+}
+
+func (this *subscriptions) unsubscribeLocked(id string, filter string) bool {
+	group, topicFilter, ok := parseShared(filter)
+	if !ok {
+		topicFilter = filter
+	}
+	node := this.find(topicFilter)
+	if node == nil {
+		return false
+	}
+	subs := node.clients(group)
+	if _, ok := subs[id]; !ok {
+		return false
+	}
+	delete(subs, id)
+	if group != "" && len(subs) == 0 {
+		delete(node.shared, group)
+	}
+	this.prune(node)
+
+	if filters, ok := this.clients[id]; ok {
+		delete(filters, filter)
+		if len(filters) == 0 {
+			delete(this.clients, id)
+		}
+	}
+	return true
+}
+
+// removeClient drops every subscription of a client
+func (this *subscriptions) removeClient(id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for filter := range this.clients[id] {
+		this.unsubscribeLocked(id, filter)
+	}
+	delete(this.clients, id)
+}
+
+// filters returns the topic filters a client is subscribed to
+func (this *subscriptions) filters(id string) map[string]mqttp.SubOps {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	result := make(map[string]mqttp.SubOps)
+	for filter := range this.clients[id] {
+		group, topicFilter, ok := parseShared(filter)
+		if !ok {
+			topicFilter = filter
+		}
+		if node := this.find(topicFilter); node != nil {
+			result[filter] = node.clients(group)[id]
+		}
+	}
+	return result
+}
+
+// sharedGroup returns a snapshot of a shared subscription group, nil if
+// the group has no members left
+func (this *subscriptions) sharedGroup(group string, filter string) *sharedMatch {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	node := this.find(filter)
+	if node == nil || len(node.shared[group]) == 0 {
+		return nil
+	}
+	return newSharedMatch(group, filter, node.shared[group])
+}
+
+func newSharedMatch(group string, filter string, members map[string]mqttp.SubOps) *sharedMatch {
+	m := &sharedMatch{group: group, filter: filter, members: make(map[string]mqttp.SubOps, len(members))}
+	for id, ops := range members {
+		m.members[id] = ops
+	}
+	return m
+}
+
+// find returns the node of a topic filter, nil if there is none
+func (this *subscriptions) find(filter string) *topicNode {
+	node := this.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// prune removes empty nodes from node up to the root
+func (this *subscriptions) prune(node *topicNode) {
+	for node != this.root && node.empty() {
+		delete(node.parent.children, node.level)
+		node = node.parent
+	}
+}
+
+// matchResult collects the subscribers of a topic
+type matchResult struct {
+	subs   map[string]mqttp.SubOps
+	shared []*sharedMatch
+}
+
+// add collects the subscribers of a node matching the topic. A client
+// with several matching filters gets the highest QoS of them.
+func (this *matchResult) add(node *topicNode) {
+	for id, ops := range node.subs {
+		if prev, ok := this.subs[id]; !ok || prev.QoS() < ops.QoS() {
+			this.subs[id] = ops
+		}
+	}
+	if len(node.shared) == 0 {
+		return
+	}
+	filter := node.filter()
+	for group, members := range node.shared {
+		this.shared = append(this.shared, newSharedMatch(group, filter, members))
+	}
+}
+
+// match returns the subscribers of topic with their options and the
+// shared subscription groups the topic matches
+func (this *subscriptions) match(topic string) (map[string]mqttp.SubOps, []*sharedMatch) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	result := &matchResult{subs: make(map[string]mqttp.SubOps)}
+	// wildcards at the first level never match topics starting with '$' [MQTT-4.7.2-1]
+	sys := strings.HasPrefix(topic, "$")
+	matchLevel(this.root, topic, sys, result)
+	return result.subs, result.shared
+}
+
+// matchLevel collects the subscribers below node matching the rest of the topic
+func matchLevel(node *topicNode, rest string, sys bool, result *matchResult) {
+	level, next, last := rest, "", true
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		level, next, last = rest[:i], rest[i+1:], false
+	}
+
+	if !sys {
+		// '#' matches this level and everything below it, and the parent too
+		if child, ok := node.children["#"]; ok {
+			result.add(child)
+		}
+		if child, ok := node.children["+"]; ok {
+			if last {
+				result.add(child)
+				if hash, ok := child.children["#"]; ok {
+					result.add(hash)
+				}
+			} else {
+				matchLevel(child, next, false, result)
+			}
+		}
+	}
+
+	if child, ok := node.children[level]; ok {
+		if last {
+			result.add(child)
+			if hash, ok := child.children["#"]; ok {
+				result.add(hash)
+			}
+		} else {
+			matchLevel(child, next, false, result)
+		}
+	}
+}
+
+// matchTopic reports whether a topic name matches a topic filter [MQTT-4.7]
+func matchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if f != "+" && f != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
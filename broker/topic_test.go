@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+var topicMatchTests = []struct {
+	filter string
+	topic  string
+	want   bool
+}{
+	{"a/b", "a/b", true},
+	{"a/b", "a/c", false},
+	{"a/b", "a/b/c", false},
+	{"a/+", "a/b", true},
+	{"a/+", "a/b/c", false},
+	{"a/+", "a", false},
+	{"a/+", "a/", true},
+	{"+/b", "a/b", true},
+	{"+/+", "a/b", true},
+	{"+", "a", true},
+	{"+", "a/b", false},
+	{"+", "/a", false},
+	{"+/a", "/a", true},
+	{"a/+/c", "a/b/c", true},
+	{"a/+/c", "a/b/d", false},
+	{"#", "a", true},
+	{"#", "a/b/c", true},
+	{"#", "/a", true},
+	{"a/#", "a/b/c", true},
+	{"a/#", "a", true}, // '#' also matches the parent level [MQTT-4.7.1-2]
+	{"a/#", "ab", false},
+	{"a/b/#", "a/b", true},
+	{"a/+/#", "a/b", true},
+	{"a/+/#", "a", false},
+	{"+/#", "a", true},
+	{"#", "$SYS/load", false}, // wildcards skip '$' topics [MQTT-4.7.2-1]
+	{"+/load", "$SYS/load", false},
+	{"+/#", "$SYS/load", false},
+	{"$SYS/#", "$SYS/load", true},
+	{"$SYS/+", "$SYS/load", true},
+	{"$SYS/load", "$SYS/load", true},
+	{"a/$b", "a/$b", true},
+	{"a/+", "a/$b", true},
+}
+
+func TestMatchTopic(t *testing.T) {
+	for _, tt := range topicMatchTests {
+		if got := matchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionsMatch(t *testing.T) {
+	for _, tt := range topicMatchTests {
+		subs := newSubscriptions()
+		subs.subscribe("c1", tt.filter, mqttp.SubOps(mqttp.QoS1))
+		matched, _ := subs.match(tt.topic)
+		if _, got := matched["c1"]; got != tt.want {
+			t.Errorf("filter %q topic %q matched %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionsHighestQoS(t *testing.T) {
+	subs := newSubscriptions()
+	subs.subscribe("c1", "a/+", mqttp.SubOps(mqttp.QoS0))
+	subs.subscribe("c1", "a/#", mqttp.SubOps(mqttp.QoS2))
+	subs.subscribe("c1", "a/b", mqttp.SubOps(mqttp.QoS1))
+	subs.subscribe("c2", "a/b", mqttp.SubOps(mqttp.QoS0))
+
+	matched, _ := subs.match("a/b")
+	tests := []struct {
+		id  string
+		qos byte
+	}{
+		{"c1", mqttp.QoS2},
+		{"c2", mqttp.QoS0},
+	}
+	for _, tt := range tests {
+		ops, ok := matched[tt.id]
+		if !ok || ops.QoS() != tt.qos {
+			t.Errorf("%s matched %t with QoS %d, want QoS %d", tt.id, ok, ops.QoS(), tt.qos)
+		}
+	}
+}
+
+func TestSubscriptionsShared(t *testing.T) {
+	subs := newSubscriptions()
+	subs.subscribe("c1", "$share/g/a/+", mqttp.SubOps(mqttp.QoS1))
+	subs.subscribe("c2", "$share/g/a/+", mqttp.SubOps(mqttp.QoS0))
+	subs.subscribe("c3", "$share/h/a/#", mqttp.SubOps(mqttp.QoS0))
+
+	matched, groups := subs.match("a/b")
+	if len(matched) != 0 {
+		t.Errorf("shared members matched as plain subscribers: %v", matched)
+	}
+	members := make(map[string]int)
+	for _, g := range groups {
+		members[g.key()] = len(g.members)
+	}
+	want := map[string]int{"$share/g/a/+": 2, "$share/h/a/#": 1}
+	for key, n := range want {
+		if members[key] != n {
+			t.Errorf("group %s has %d members, want %d", key, members[key], n)
+		}
+	}
+	if len(members) != len(want) {
+		t.Errorf("groups %v, want %v", members, want)
+	}
+}
+
+func TestSubscriptionsPrune(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []string
+		remove  []string
+		empty   bool
+	}{
+		{"single", []string{"a/b/c"}, []string{"a/b/c"}, true},
+		{"shared", []string{"$share/g/a/b"}, []string{"$share/g/a/b"}, true},
+		{"sibling kept", []string{"a/b/c", "a/b/d"}, []string{"a/b/c"}, false},
+		{"parent kept", []string{"a/b", "a/b/c"}, []string{"a/b/c"}, false},
+		{"both removed", []string{"a/b", "a/b/c"}, []string{"a/b/c", "a/b"}, true},
+		{"wildcards", []string{"+/#", "#"}, []string{"#", "+/#"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subs := newSubscriptions()
+			for _, f := range tt.filters {
+				subs.subscribe("c1", f, mqttp.SubOps(mqttp.QoS0))
+			}
+			for _, f := range tt.remove {
+				if !subs.unsubscribe("c1", f) {
+					t.Fatalf("unsubscribe %q found nothing", f)
+				}
+			}
+			if got := subs.root.empty(); got != tt.empty {
+				t.Errorf("trie empty %t, want %t", got, tt.empty)
+			}
+			if subs.unsubscribe("c1", tt.remove[0]) {
+				t.Errorf("second unsubscribe %q reported a subscription", tt.remove[0])
+			}
+		})
+	}
+}
+
+func TestSubscriptionsRemoveClient(t *testing.T) {
+	subs := newSubscriptions()
+	subs.subscribe("c1", "a/+", mqttp.SubOps(mqttp.QoS0))
+	subs.subscribe("c1", "$share/g/b", mqttp.SubOps(mqttp.QoS0))
+	subs.subscribe("c2", "a/b", mqttp.SubOps(mqttp.QoS0))
+
+	subs.removeClient("c1")
+	if f := subs.filters("c1"); len(f) != 0 {
+		t.Errorf("c1 still has filters %v", f)
+	}
+	matched, groups := subs.match("a/b")
+	if _, ok := matched["c1"]; ok || len(matched) != 1 {
+		t.Errorf("matched %v after removing c1", matched)
+	}
+	if _, groups = subs.match("b"); len(groups) != 0 {
+		t.Errorf("shared group left after removing its only member")
+	}
+	if subs.find("a/+") != nil {
+		t.Errorf("node a/+ not pruned")
+	}
+}
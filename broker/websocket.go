@@ -0,0 +1,437 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+	"github.com/wonderivan/logger"
+)
+
+// DefaultWSAddr is the listen address of ListenAndServeWS when addr is empty
+const DefaultWSAddr = ":8080"
+
+// DefaultWSPath is the HTTP path MQTT over WebSocket is served on
+const DefaultWSPath = "/mqtt"
+
+// WSOptions describes a WebSocket listener
+type WSOptions struct {
+	// Path of the upgrade request, "/mqtt" if empty
+	Path string
+
+	// Origins are the allowed values of the Origin header, "*" allows any.
+	// If empty only requests without Origin or from the same host pass.
+	Origins []string
+}
+
+// ListenAndServeWS listens on addr, ":8080" if empty, and serves MQTT over
+// WebSocket. The listener speaks TLS if config is not nil.
+func (this *Server) ListenAndServeWS(addr string, opts *WSOptions, config *tls.Config) error {
+	if addr == "" {
+		addr = DefaultWSAddr
+	}
+	if opts == nil {
+		opts = &WSOptions{}
+	}
+	return this.ListenAndServeListener(&Listener{Addr: addr, TLS: config, WebSocket: opts})
+}
+
+// ServeWS serves MQTT over WebSocket on l, it always closes l
+func (this *Server) ServeWS(l net.Listener, opts *WSOptions) error {
+	if opts == nil {
+		opts = &WSOptions{}
+	}
+	return this.ServeListener(l, &Listener{Addr: l.Addr().String(), WebSocket: opts})
+}
+
+func (this *Server) serveWS(l net.Listener, ln *Listener) error {
+	if !this.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer this.trackListener(l, false)
+
+	logger.Info(fmt.Sprintf("Listening for WebSocket on %s", l.Addr()))
+	hs := &http.Server{
+		Handler:           this.wsHandler(ln),
+		ReadHeaderTimeout: wsHandshakeTimeout,
+	}
+	err := hs.Serve(l)
+	if this.shuttingDown() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// time allowed for the HTTP upgrade request
+const wsHandshakeTimeout = 10 * time.Second
+
+// WSHandler returns an http.Handler upgrading requests to MQTT over
+// WebSocket, to be mounted in an existing HTTP server
+func (this *Server) WSHandler(opts *WSOptions) http.Handler {
+	if opts == nil {
+		opts = &WSOptions{}
+	}
+	return this.wsHandler(&Listener{WebSocket: opts})
+}
+
+func (this *Server) wsHandler(ln *Listener) http.Handler {
+	opts := ln.WebSocket
+	path := opts.Path
+	if path == "" {
+		path = DefaultWSPath
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		if !checkOrigin(r, opts.Origins) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		this.conf.RLock()
+		ok := ln.acquire()
+		this.conf.RUnlock()
+		if !ok {
+			logger.Warn(fmt.Sprintf("Listener %s is full, refusing %s", ln, r.RemoteAddr))
+			http.Error(w, "too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		this.conf.RLock()
+		max := ln.MaxPacketSize
+		if max == 0 {
+			max = this.MaxPacketSize
+		}
+		this.conf.RUnlock()
+		conn, err := wsUpgrade(w, r, max)
+		if err != nil {
+			ln.release()
+			logger.Warn(fmt.Sprintf("WebSocket upgrade from %s failed: %s", r.RemoteAddr, err))
+			return
+		}
+		c := newClient(this, conn, ln)
+		if !this.trackConn(c, true) {
+			ln.release()
+			conn.Close()
+			return
+		}
+		c.serve()
+	})
+}
+
+// checkOrigin reports whether the Origin header of r is allowed
+func checkOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if len(origins) == 0 {
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsGUID is appended to Sec-WebSocket-Key for Sec-WebSocket-Accept (RFC 6455)
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsUpgrade answers the WebSocket handshake and takes the connection over
+// from the HTTP server. The "mqtt" subprotocol is selected when offered
+// [MQTT-6.0.0-3]. Frames over max bytes are refused, 0 means the largest
+// MQTT packet.
+func wsUpgrade(w http.ResponseWriter, r *http.Request, max uint32) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "not a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	protocol := ""
+	if r.Header.Get("Sec-WebSocket-Protocol") != "" {
+		for _, p := range []string{"mqtt", "mqttv3.1"} {
+			if headerHasToken(r.Header, "Sec-WebSocket-Protocol", p) {
+				protocol = p
+				break
+			}
+		}
+		if protocol == "" {
+			http.Error(w, "mqtt subprotocol required", http.StatusBadRequest)
+			return nil, errors.New("mqtt subprotocol not offered")
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("response does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// drop the deadlines of the HTTP server
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	resp += "\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newWSConn(conn, brw.Reader, max), nil
+}
+
+// headerHasToken reports whether a comma separated header contains token
+func headerHasToken(h http.Header, name string, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocket opcodes and close status codes (RFC 6455)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+// time allowed for writing the close frame
+const wsCloseTimeout = time.Second
+
+var errWSProtocol = errors.New("websocket: protocol error")
+
+// wsConn is a net.Conn carrying a byte stream in binary WebSocket frames.
+// Read returns the payload of the frames as they arrive, every Write is
+// sent as one binary frame, so the MQTT codec works on it unchanged.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	maxFrame uint64 // largest frame payload accepted
+
+	// read state, used by the reading goroutine only
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	inMessage bool // a frame without FIN was read, continuations follow
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// newWSConn returns a wsConn reading the frames through br, a frame of
+// more than max bytes ends the connection, 0 means the largest MQTT packet
+func newWSConn(conn net.Conn, br *bufio.Reader, max uint32) *wsConn {
+	if max == 0 {
+		max = mqttp.MaxPacketSize
+	}
+	return &wsConn{Conn: conn, br: br, maxFrame: uint64(max)}
+}
+
+// Read implements io.Reader over the payload of binary frames
+func (this *wsConn) Read(p []byte) (int, error) {
+	for this.remaining == 0 {
+		if err := this.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > this.remaining {
+		p = p[:this.remaining]
+	}
+	n, err := this.br.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= this.mask[this.maskPos&3]
+		this.maskPos++
+	}
+	this.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers up to the next data frame, control frames
+// are handled on the way
+func (this *wsConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(this.br, head[:]); err != nil {
+		return err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	// frames of clients are masked, extensions are not negotiated
+	if !masked || head[0]&0x70 != 0 {
+		this.writeClose(wsCloseProtocol)
+		return errWSProtocol
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(this.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(this.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		// the most significant bit must be 0 (RFC 6455 5.2)
+		if length>>63 != 0 {
+			this.writeClose(wsCloseProtocol)
+			return errWSProtocol
+		}
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(this.br, mask[:]); err != nil {
+		return err
+	}
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		// a message is a data frame followed by continuations up to FIN,
+		// messages do not interleave (RFC 6455 5.4)
+		if (opcode == wsContinuation) != this.inMessage {
+			this.writeClose(wsCloseProtocol)
+			return errWSProtocol
+		}
+		if length > this.maxFrame {
+			logger.Warn(fmt.Sprintf("WebSocket frame of %d bytes from %s exceeds %d", length, this.RemoteAddr(), this.maxFrame))
+			this.writeClose(wsCloseTooBig)
+			return errWSProtocol
+		}
+		this.remaining, this.mask, this.maskPos = length, mask, 0
+		this.inMessage = !fin
+		return nil
+	case wsText:
+		// MQTT is carried in binary frames only [MQTT-6.0.0-1]
+		this.writeClose(wsCloseUnsupported)
+		return errWSProtocol
+	case wsClose, wsPing, wsPong:
+		if !fin || length > 125 {
+			this.writeClose(wsCloseProtocol)
+			return errWSProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(this.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+		switch opcode {
+		case wsClose:
+			this.writeClose(wsCloseNormal)
+			return io.EOF
+		case wsPing:
+			this.writeFrame(wsPong, payload)
+		}
+		return nil
+	default:
+		this.writeClose(wsCloseProtocol)
+		return errWSProtocol
+	}
+}
+
+// Write sends p as one binary frame
+func (this *wsConn) Write(p []byte) (int, error) {
+	if err := this.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (this *wsConn) writeFrame(opcode byte, payload []byte) error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if this.closeSent {
+		return net.ErrClosed
+	}
+	return this.writeFrameLocked(opcode, payload)
+}
+
+func (this *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(frame, 127)
+		frame = append(frame, ext[:]...)
+	}
+	frame = append(frame, payload...)
+	_, err := this.Conn.Write(frame)
+	return err
+}
+
+// writeClose sends a close frame once
+func (this *wsConn) writeClose(status uint16) {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if this.closeSent {
+		return
+	}
+	this.closeSent = true
+	this.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+	this.writeFrameLocked(wsClose, []byte{byte(status >> 8), byte(status)})
+}
+
+// Close sends a close frame and closes the network connection
+func (this *wsConn) Close() error {
+	this.writeClose(wsCloseNormal)
+	return this.Conn.Close()
+}
@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// wsFrame builds a masked client frame announcing length bytes of payload,
+// the payload itself may be shorter
+func wsFrame(fin bool, opcode byte, length uint64, payload []byte) []byte {
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head}
+	switch {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 0x80|126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], length)
+		frame = append(frame, 0x80|127)
+		frame = append(frame, ext[:]...)
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	return frame
+}
+
+func TestWSConnRead(t *testing.T) {
+	data := func(fin bool, opcode byte, payload string) []byte {
+		return wsFrame(fin, opcode, uint64(len(payload)), []byte(payload))
+	}
+	tests := []struct {
+		name   string
+		max    uint32
+		frames [][]byte
+		want   string // payload read before the error
+		status uint16 // of the close frame sent, 0 for none
+	}{
+		{"binary", 0, [][]byte{data(true, wsBinary, "abc")}, "abc", 0},
+		{"fragmented", 0, [][]byte{
+			data(false, wsBinary, "ab"),
+			data(true, wsPing, "p"),
+			data(false, wsContinuation, "cd"),
+			data(true, wsContinuation, "e"),
+			data(true, wsBinary, "f"),
+		}, "abcdef", 0},
+		{"continuation without message", 0, [][]byte{data(true, wsContinuation, "ab")}, "", wsCloseProtocol},
+		{"continuation after FIN", 0, [][]byte{
+			data(true, wsBinary, "ab"),
+			data(true, wsContinuation, "cd"),
+		}, "ab", wsCloseProtocol},
+		{"new message before FIN", 0, [][]byte{
+			data(false, wsBinary, "ab"),
+			data(true, wsBinary, "cd"),
+		}, "ab", wsCloseProtocol},
+		{"length MSB set", 0, [][]byte{wsFrame(true, wsBinary, 1<<63|3, []byte("abc"))}, "", wsCloseProtocol},
+		{"over max", 4, [][]byte{data(true, wsBinary, "abcde")}, "", wsCloseTooBig},
+		{"64 bit length over max", 0, [][]byte{wsFrame(true, wsBinary, 1<<40, []byte("abc"))}, "", wsCloseTooBig},
+		{"at max", 4, [][]byte{data(true, wsBinary, "abcd")}, "abcd", 0},
+		{"text", 0, [][]byte{data(true, wsText, "ab")}, "", wsCloseUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(time.Second))
+			c := newWSConn(server, bufio.NewReader(server), tt.max)
+			defer c.Close()
+
+			go func() {
+				for _, f := range tt.frames {
+					if _, err := client.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+			sent := make(chan []byte, 1)
+			go func() {
+				b, _ := ioutil.ReadAll(client)
+				sent <- b
+			}()
+
+			var got bytes.Buffer
+			buff := make([]byte, 16)
+			var err error
+			for got.Len() < len(tt.want) && err == nil {
+				var n int
+				n, err = c.Read(buff)
+				got.Write(buff[:n])
+			}
+			if got.String() != tt.want {
+				t.Fatalf("read %q, want %q", got.String(), tt.want)
+			}
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("read error %s", err)
+				}
+				return
+			}
+			if err == nil {
+				_, err = c.Read(buff)
+			}
+			if err == nil || err == io.EOF {
+				t.Fatalf("read error %v, want a protocol error", err)
+			}
+			server.Close()
+			b := <-sent
+			// the pong of a ping may come before the close frame
+			if len(b) < 4 || b[len(b)-4] != 0x80|wsClose || binary.BigEndian.Uint16(b[len(b)-2:]) != tt.status {
+				t.Fatalf("sent % X, want a close frame with status %d", b, tt.status)
+			}
+		})
+	}
+}
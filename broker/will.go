@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+	"github.com/wonderivan/logger"
+)
+
+// newWill builds the will message of CONNECT with the will properties and
+// returns the Will Delay Interval of MQTT 5.0 clients
+func newWill(pkt *mqttp.Connect) (*mqttp.Publish, uint32) {
+	topic, payload := pkt.Will()
+	msg := mqttp.NewPublish()
+	msg.SetTopic(topic)
+	msg.SetPayload(payload)
+	msg.SetQos(pkt.WillQos())
+	msg.SetRetain(pkt.WillRetain())
+	if pkt.GetVersion() != mqttp.MQTT50 {
+		return msg, 0
+	}
+	props := pkt.WillProps()
+	copyProps(msg.Props(), props)
+	if v, ok := props.MessageExpiryInterval(); ok {
+		msg.Props().SetMessageExpiryInterval(v)
+	}
+	delay, _ := props.WillDelayInterval()
+	return msg, delay
+}
+
+// scheduleWill publishes the will message of a connection which ended
+// without a normal DISCONNECT once the Will Delay Interval elapses, or
+// when the session ends if that comes first [MQTT-3.1.3-9]. s.mu must be
+// held. It returns the will if it is due at once.
+func (this *Server) scheduleWill(s *session, will *mqttp.Publish, delay uint32) *mqttp.Publish {
+	if delay > s.expiry {
+		delay = s.expiry
+	}
+	if delay == 0 {
+		return will
+	}
+	s.will = will
+	s.willTimer = time.AfterFunc(time.Duration(delay)*time.Second, func() {
+		if will := s.takeWill(); will != nil {
+			this.publishWill(s.id, will)
+		}
+	})
+	return nil
+}
+
+// publishWill sends a will message to the subscribers of its topic, the
+// Message Expiry Interval starts now
+func (this *Server) publishWill(id string, msg *mqttp.Publish) {
+	if v, ok := msg.Props().MessageExpiryInterval(); ok {
+		msg.SetExpireAt(time.Now().Add(time.Duration(v) * time.Second))
+	}
+	logger.Info(fmt.Sprintf("Publishing will message of client %s on %s", id, msg.Topic()))
+	this.publish(nil, msg)
+}
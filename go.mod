@@ -1,3 +1,8 @@
 module github.com/chenglinning/gomqtt
 
 go 1.17
+
+require (
+	github.com/wonderivan/logger v1.0.0
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chenglinning/gomqtt/broker"
+	"github.com/chenglinning/gomqtt/mqttp"
+	"github.com/wonderivan/logger"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the broker configuration file, for example
+//
+//	log:
+//	  level: info
+//	  file: /var/log/gomqtt.log
+//	listeners:
+//	  - name: devices
+//	    addr: 0.0.0.0:8883
+//	    tls: {cert: server.pem, key: server.key, ca: ca.pem, require_client_cert: true}
+//	    versions: ["5.0"]
+//	    max_connections: 10000
+//	    mountpoint: devices/
+//	  - name: internal
+//	    network: unix
+//	    addr: /run/gomqtt.sock
+//	auth:
+//	  passwd_file: /etc/gomqtt/passwd
+//	  acl_file: /etc/gomqtt/acl
+//	sessions:
+//	  max_session_expiry: 86400
+//	  max_queued: 1000
+//	retained:
+//	  file: /var/lib/gomqtt/retained
+//	capabilities:
+//	  maximum_qos: 1
+//
+// Unknown keys are errors.
+type Config struct {
+	Log           LogConfig        `yaml:"log"`
+	Listeners     []ListenerConfig `yaml:"listeners"`
+	Auth          AuthConfig       `yaml:"auth"`
+	Sessions      SessionConfig    `yaml:"sessions"`
+	ShareStrategy string           `yaml:"share_strategy"`
+	ClientIDs     ClientIDConfig   `yaml:"assigned_client_ids"`
+	IDPolicy      IDPolicyConfig   `yaml:"client_id_policy"`
+	Retained      RetainedConfig   `yaml:"retained"`
+	Capabilities  CapabilityConfig `yaml:"capabilities"`
+}
+
+// LogConfig sets the log level and an optional log file
+type LogConfig struct {
+	// Level is error, warn, info, debug or trace, info if empty
+	Level string `yaml:"level"`
+	File  string `yaml:"file"`
+}
+
+// ListenerConfig describes one broker.Listener
+type ListenerConfig struct {
+	Name string `yaml:"name"`
+
+	// Network is tcp or unix, tcp if empty
+	Network   string           `yaml:"network"`
+	Addr      string           `yaml:"addr"`
+	TLS       *TLSConfig       `yaml:"tls"`
+	WebSocket *WebSocketConfig `yaml:"websocket"`
+
+	// Versions are "3.1", "3.1.1" and "5.0", all of them if empty
+	Versions []string `yaml:"versions"`
+
+	// Auth replaces the global auth section for this listener
+	Auth *ListenerAuthConfig `yaml:"auth"`
+
+	MaxConnections int    `yaml:"max_connections"`
+	MaxPacketSize  uint32 `yaml:"max_packet_size"`
+	Mountpoint     string `yaml:"mountpoint"`
+}
+
+// TLSConfig describes broker.TLSOptions
+type TLSConfig struct {
+	Cert              string   `yaml:"cert"`
+	Key               string   `yaml:"key"`
+	CA                string   `yaml:"ca"`
+	RequireClientCert bool     `yaml:"require_client_cert"`
+	MinVersion        string   `yaml:"min_version"`
+	Ciphers           []string `yaml:"ciphers"`
+}
+
+// WebSocketConfig describes broker.WSOptions
+type WebSocketConfig struct {
+	Path    string   `yaml:"path"`
+	Origins []string `yaml:"origins"`
+}
+
+// ListenerAuthConfig authenticates the clients of one listener
+type ListenerAuthConfig struct {
+	PasswdFile     string `yaml:"passwd_file"`
+	AllowAnonymous bool   `yaml:"allow_anonymous"`
+}
+
+// AuthConfig names the password and ACL files. Without a password file
+// every client is accepted, with one clients need a user name unless
+// allow_anonymous is set or a certificate gives them an identity.
+type AuthConfig struct {
+	PasswdFile     string `yaml:"passwd_file"`
+	AllowAnonymous bool   `yaml:"allow_anonymous"`
+	ACLFile        string `yaml:"acl_file"`
+
+	// CertIdentity is cn or san, see broker.CertIdentity
+	CertIdentity string `yaml:"cert_identity"`
+}
+
+// SessionConfig holds the session and in-flight limits, zero values keep
+// the broker defaults
+type SessionConfig struct {
+	MaxSessionExpiry uint32 `yaml:"max_session_expiry"`
+	ReceiveMaximum   uint16 `yaml:"receive_maximum"`
+	MaxInflight      uint16 `yaml:"max_inflight"`
+	MaxQueued        int    `yaml:"max_queued"`
+
+	// MinKeepAlive and MaxKeepAlive bound the Keep Alive of MQTT 5.0
+	// clients in seconds
+	MinKeepAlive uint16 `yaml:"min_keep_alive"`
+	MaxKeepAlive uint16 `yaml:"max_keep_alive"`
+
+	// ConnectTimeout is the time in seconds a new connection has to send
+	// CONNECT
+	ConnectTimeout uint16 `yaml:"connect_timeout"`
+
+	// MaxPacketSize limits the size of packets sent by clients on
+	// listeners without max_packet_size of their own
+	MaxPacketSize uint32 `yaml:"max_packet_size"`
+}
+
+// ClientIDConfig makes the client IDs assigned to clients connecting
+// without one
+type ClientIDConfig struct {
+	Prefix string `yaml:"prefix"`
+
+	// Format is random, uuid or sequence, random if empty
+	Format string `yaml:"format"`
+}
+
+// IDPolicyConfig describes the mqttp.ClientIDRules client IDs are checked
+// against
+type IDPolicyConfig struct {
+	// Pattern is mqttp.DefaultClientIDPattern if empty, allowing digits,
+	// letters and '-'. "(?s)^.*$" accepts any UTF-8 string.
+	Pattern          string   `yaml:"pattern"`
+	MaxLength        int      `yaml:"max_length"`
+	ReservedPrefixes []string `yaml:"reserved_prefixes"`
+}
+
+// RetainedConfig enables the retained message store and the file it is
+// loaded from at start and saved to on shutdown
+type RetainedConfig struct {
+	Enabled *bool  `yaml:"enabled"`
+	File    string `yaml:"file"`
+}
+
+// CapabilityConfig sets the features advertised in CONNACK, absent values
+// keep them available
+type CapabilityConfig struct {
+	MaximumQoS            *int  `yaml:"maximum_qos"`
+	WildcardSubscriptions *bool `yaml:"wildcard_subscriptions"`
+	SharedSubscriptions   *bool `yaml:"shared_subscriptions"`
+}
+
+// defaultListener is the listener used when neither the configuration
+// file nor -addr names one
+var defaultListener = ListenerConfig{Name: "default", Addr: "0.0.0.0:9090"}
+
+// loadConfig reads a configuration file, an empty path gives the defaults
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// logLevels maps level names to the levels of the logger
+var logLevels = map[string]string{
+	"error": "EROR",
+	"warn":  "WARN",
+	"info":  "INFO",
+	"debug": "DEBG",
+	"trace": "TRAC",
+}
+
+var protocolVersions = map[string]byte{
+	"3.1":   mqttp.MQTT31,
+	"3.1.1": mqttp.MQTT311,
+	"5.0":   mqttp.MQTT50,
+}
+
+var tlsVersionNames = map[string]bool{"": true, "1.0": true, "1.1": true, "1.2": true, "1.3": true}
+
+// ConfigError lists every problem found in a configuration
+type ConfigError []string
+
+func (this ConfigError) Error() string {
+	return strings.Join(this, "\n")
+}
+
+func (this *ConfigError) add(field string, format string, v ...interface{}) {
+	*this = append(*this, field+": "+fmt.Sprintf(format, v...))
+}
+
+// validate checks the values of the configuration without touching any
+// file, all problems are returned at once
+func (this *Config) validate() error {
+	var errs ConfigError
+
+	if _, ok := logLevels[strings.ToLower(this.Log.Level)]; !ok && this.Log.Level != "" {
+		errs.add("log.level", "unknown level %q, want error, warn, info, debug or trace", this.Log.Level)
+	}
+
+	if len(this.Listeners) == 0 {
+		errs.add("listeners", "at least one listener is required")
+	}
+	names := make(map[string]int)
+	for i, l := range this.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		if l.Name != "" {
+			if j, ok := names[l.Name]; ok {
+				errs.add(field+".name", "%q is already used by listeners[%d]", l.Name, j)
+			}
+			names[l.Name] = i
+		}
+		switch l.Network {
+		case "", "tcp", "unix":
+		default:
+			errs.add(field+".network", "unknown network %q, want tcp or unix", l.Network)
+		}
+		if l.Addr == "" {
+			errs.add(field+".addr", "required")
+		}
+		if t := l.TLS; t != nil {
+			if t.Cert == "" {
+				errs.add(field+".tls.cert", "required")
+			}
+			if t.Key == "" {
+				errs.add(field+".tls.key", "required")
+			}
+			if t.RequireClientCert && t.CA == "" {
+				errs.add(field+".tls.require_client_cert", "needs tls.ca")
+			}
+			if !tlsVersionNames[t.MinVersion] {
+				errs.add(field+".tls.min_version", "unknown version %q, want 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+			}
+		}
+		if ws := l.WebSocket; ws != nil && ws.Path != "" && !strings.HasPrefix(ws.Path, "/") {
+			errs.add(field+".websocket.path", "%q must start with /", ws.Path)
+		}
+		for j, v := range l.Versions {
+			if _, ok := protocolVersions[v]; !ok {
+				errs.add(fmt.Sprintf("%s.versions[%d]", field, j), "unknown version %q, want 3.1, 3.1.1 or 5.0", v)
+			}
+		}
+		if l.MaxPacketSize > mqttp.MaxPacketSize {
+			errs.add(field+".max_packet_size", "%d is above the MQTT limit %d", l.MaxPacketSize, mqttp.MaxPacketSize)
+		}
+		if l.MaxConnections < 0 {
+			errs.add(field+".max_connections", "must not be negative")
+		}
+		if strings.ContainsAny(l.Mountpoint, "+#") {
+			errs.add(field+".mountpoint", "%q must not contain wildcards", l.Mountpoint)
+		}
+	}
+
+	if _, err := broker.ParseCertIdentity(this.Auth.CertIdentity); err != nil {
+		errs.add("auth.cert_identity", "unknown value %q, want cn or san", this.Auth.CertIdentity)
+	}
+	if this.Sessions.MaxQueued < 0 {
+		errs.add("sessions.max_queued", "must not be negative")
+	}
+	if this.Sessions.MaxPacketSize > mqttp.MaxPacketSize {
+		errs.add("sessions.max_packet_size", "%d is above the MQTT limit %d", this.Sessions.MaxPacketSize, mqttp.MaxPacketSize)
+	}
+	if max := this.Sessions.MaxKeepAlive; max > 0 && this.Sessions.MinKeepAlive > max {
+		errs.add("sessions.min_keep_alive", "%d is above max_keep_alive %d", this.Sessions.MinKeepAlive, max)
+	}
+	if format, err := broker.ParseClientIDFormat(this.ClientIDs.Format); err != nil {
+		errs.add("assigned_client_ids.format", "unknown format %q, want random, uuid or sequence", this.ClientIDs.Format)
+	} else if format == broker.ClientIDSequence && this.ClientIDs.Prefix == "" {
+		// the prefix is reserved, without one any client could take a sequence ID
+		errs.add("assigned_client_ids.prefix", "is required with format sequence")
+	}
+	if strings.Trim(this.ClientIDs.Prefix, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-") != "" {
+		errs.add("assigned_client_ids.prefix", "%q may only contain letters, digits and '-'", this.ClientIDs.Prefix)
+	}
+	if _, err := regexp.Compile(this.IDPolicy.Pattern); err != nil {
+		errs.add("client_id_policy.pattern", "%s", err)
+	}
+	if this.IDPolicy.MaxLength < 0 {
+		errs.add("client_id_policy.max_length", "must not be negative")
+	}
+	if _, err := broker.NewShareStrategy(this.ShareStrategy); err != nil {
+		errs.add("share_strategy", "unknown strategy %q, want round_robin, random, sticky or hash", this.ShareStrategy)
+	}
+	if this.Retained.File != "" && !this.retainEnabled() {
+		errs.add("retained.file", "set while retained.enabled is false")
+	}
+	if q := this.Capabilities.MaximumQoS; q != nil && (*q < 0 || *q > 2) {
+		errs.add("capabilities.maximum_qos", "%d is not a QoS, want 0, 1 or 2", *q)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (this *Config) retainEnabled() bool {
+	return this.Retained.Enabled == nil || *this.Retained.Enabled
+}
+
+// setupLog applies the log section to the logger
+func (this *Config) setupLog() error {
+	level := logLevels[strings.ToLower(this.Log.Level)]
+	if level == "" {
+		level = "INFO"
+	}
+	conf := map[string]interface{}{
+		"Console": map[string]interface{}{"level": level, "color": true},
+	}
+	if this.Log.File != "" {
+		conf["File"] = map[string]interface{}{
+			"filename": this.Log.File,
+			"level":    level,
+			"append":   true,
+			"permit":   "0640",
+		}
+	}
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return logger.SetLogger(string(data))
+}
+
+// brokerSetup is the server built from a configuration with its listeners
+type brokerSetup struct {
+	srv       *broker.Server
+	listeners []*broker.Listener
+	watched   []*broker.PasswordFile
+
+	// auth and authz are loaded from the password and ACL files
+	auth  broker.Authenticator
+	authz broker.Authorizer
+
+	// tls serves the certificates of each listener, nil for plain ones,
+	// certs are the configurations loaded from the files
+	tls   []*broker.ReloadableTLS
+	certs []*tls.Config
+}
+
+// build creates the server and its listeners, loading the certificates,
+// password and ACL files. Errors name the field of the failing file.
+func (this *Config) build() (*brokerSetup, error) {
+	setup, err := this.load()
+	if err != nil {
+		return nil, err
+	}
+	setup.srv = broker.NewServer("")
+	setup.srv.ShareStrategy, _ = broker.NewShareStrategy(this.ShareStrategy)
+	this.configure(setup.srv, setup)
+	return setup, nil
+}
+
+// configure sets the settings of srv which may change while it runs.
+// Settings missing from the configuration get the broker defaults, so that
+// removing one on reload restores its default.
+func (this *Config) configure(srv *broker.Server, setup *brokerSetup) {
+	srv.Authenticator = setup.auth
+	srv.Authorizer = setup.authz
+	srv.CertIdentity, _ = broker.ParseCertIdentity(this.Auth.CertIdentity)
+	srv.AssignedIDPrefix = this.ClientIDs.Prefix
+	srv.AssignedIDFormat, _ = broker.ParseClientIDFormat(this.ClientIDs.Format)
+	srv.ClientIDPolicy = nil
+	if p := this.IDPolicy; p.Pattern != "" || p.MaxLength > 0 || len(p.ReservedPrefixes) > 0 {
+		rules := &mqttp.ClientIDRules{
+			Pattern:          mqttp.DefaultClientIDPattern,
+			MaxLength:        p.MaxLength,
+			ReservedPrefixes: p.ReservedPrefixes,
+		}
+		if p.Pattern != "" {
+			rules.Pattern = regexp.MustCompile(p.Pattern)
+		}
+		srv.ClientIDPolicy = rules
+	}
+
+	srv.MaxSessionExpiry = this.Sessions.MaxSessionExpiry
+	srv.ReceiveMaximum = broker.DefaultReceiveMaximum
+	if this.Sessions.ReceiveMaximum > 0 {
+		srv.ReceiveMaximum = this.Sessions.ReceiveMaximum
+	}
+	srv.MaxInflight = broker.DefaultMaxInflight
+	if this.Sessions.MaxInflight > 0 {
+		srv.MaxInflight = this.Sessions.MaxInflight
+	}
+	srv.MaxQueued = broker.DefaultMaxQueued
+	if this.Sessions.MaxQueued > 0 {
+		srv.MaxQueued = this.Sessions.MaxQueued
+	}
+	srv.MinKeepAlive = this.Sessions.MinKeepAlive
+	srv.MaxKeepAlive = this.Sessions.MaxKeepAlive
+	srv.ConnectTimeout = broker.DefaultConnectTimeout
+	if this.Sessions.ConnectTimeout > 0 {
+		srv.ConnectTimeout = time.Duration(this.Sessions.ConnectTimeout) * time.Second
+	}
+	srv.MaxPacketSize = this.Sessions.MaxPacketSize
+
+	srv.RetainAvailable = this.retainEnabled()
+	srv.MaximumQoS = mqttp.QoS2
+	if q := this.Capabilities.MaximumQoS; q != nil {
+		srv.MaximumQoS = byte(*q)
+	}
+	srv.WildcardSubscriptions = true
+	if v := this.Capabilities.WildcardSubscriptions; v != nil {
+		srv.WildcardSubscriptions = *v
+	}
+	srv.SharedSubscriptions = true
+	if v := this.Capabilities.SharedSubscriptions; v != nil {
+		srv.SharedSubscriptions = *v
+	}
+}
+
+// load reads the certificates, password and ACL files and creates the
+// listeners without a server. Errors name the field of the failing file.
+func (this *Config) load() (*brokerSetup, error) {
+	var errs ConfigError
+	setup := &brokerSetup{}
+	identity, _ := broker.ParseCertIdentity(this.Auth.CertIdentity)
+
+	auth, err := setup.authenticator(this.Auth.PasswdFile, this.Auth.AllowAnonymous, identity)
+	if err != nil {
+		errs.add("auth.passwd_file", "%s", err)
+	}
+	setup.auth = auth
+	if this.Auth.ACLFile != "" {
+		acl, err := broker.LoadACL(this.Auth.ACLFile)
+		if err != nil {
+			errs.add("auth.acl_file", "%s", err)
+		} else {
+			setup.authz = acl
+		}
+	}
+
+	for i, l := range this.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		ln := &broker.Listener{
+			Name:           l.Name,
+			Network:        l.Network,
+			Addr:           l.Addr,
+			MaxConnections: l.MaxConnections,
+			MaxPacketSize:  l.MaxPacketSize,
+			Mountpoint:     l.Mountpoint,
+		}
+		var holder *broker.ReloadableTLS
+		var certs *tls.Config
+		for _, v := range l.Versions {
+			ln.Versions = append(ln.Versions, protocolVersions[v])
+		}
+		if t := l.TLS; t != nil {
+			opts := &broker.TLSOptions{
+				CertFile:          t.Cert,
+				KeyFile:           t.Key,
+				CAFile:            t.CA,
+				RequireClientCert: t.RequireClientCert,
+				MinVersion:        t.MinVersion,
+				CipherSuites:      t.Ciphers,
+			}
+			if certs, err = opts.Config(); err != nil {
+				errs.add(field+".tls", "%s", err)
+			}
+			holder = broker.NewReloadableTLS(certs)
+			ln.TLS = holder.Config()
+		}
+		if ws := l.WebSocket; ws != nil {
+			ln.WebSocket = &broker.WSOptions{Path: ws.Path, Origins: ws.Origins}
+		}
+		if a := l.Auth; a != nil {
+			auth, err := setup.authenticator(a.PasswdFile, a.AllowAnonymous, identity)
+			if err != nil {
+				errs.add(field+".auth.passwd_file", "%s", err)
+			}
+			// an empty listener auth section accepts every client
+			ln.Authenticator = auth
+			if auth == nil {
+				ln.Authenticator = broker.AuthFunc(allowAll)
+			}
+		}
+		setup.listeners = append(setup.listeners, ln)
+		setup.tls = append(setup.tls, holder)
+		setup.certs = append(setup.certs, certs)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return setup, nil
+}
+
+// authenticator loads a password file, nil if path is empty. Clients with
+// a certificate identity need no password, clients without a user name
+// are accepted with allowAnonymous.
+func (this *brokerSetup) authenticator(path string, allowAnonymous bool, identity broker.CertIdentity) (broker.Authenticator, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pf, err := broker.LoadPasswordFile(path)
+	if err != nil {
+		return nil, err
+	}
+	this.watched = append(this.watched, pf)
+	chain := broker.AuthChain{}
+	if identity != broker.CertIdentityNone {
+		chain = append(chain, broker.CertAuthenticator{})
+	}
+	chain = append(chain, pf)
+	if allowAnonymous {
+		chain = append(chain, broker.AuthFunc(allowAnonymousUser))
+	}
+	return chain, nil
+}
+
+func allowAll(pkt *mqttp.Connect, info *broker.ConnInfo) (broker.AuthResult, mqttp.ReasonCode) {
+	return broker.AuthAllow, mqttp.CodeSuccess
+}
+
+func allowAnonymousUser(pkt *mqttp.Connect, info *broker.ConnInfo) (broker.AuthResult, mqttp.ReasonCode) {
+	if user, _ := pkt.Credentials(); user == "" {
+		return broker.AuthAllow, mqttp.CodeSuccess
+	}
+	return broker.AuthIgnore, mqttp.CodeSuccess
+}
+
+// loadRetained restores the retained messages saved by saveRetained, a
+// missing file is not an error
+func loadRetained(srv *broker.Server, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return srv.LoadRetained(f)
+}
+
+// saveRetained writes the retained messages to a temporary file renamed
+// over path, so that a failed save keeps the previous file
+func saveRetained(srv *broker.Server, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := srv.SaveRetained(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func validConfig() *Config {
+	return &Config{Listeners: []ListenerConfig{{Name: "default", Addr: "127.0.0.1:1883"}}}
+}
+
+func TestConfigValidate(t *testing.T) {
+	two := 2
+	three := 3
+	disabled := false
+
+	tests := []struct {
+		name  string
+		setup func(*Config)
+		want  []string // fields with an error, none if empty
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"full", func(c *Config) {
+			c.Log.Level = "DEBUG"
+			c.Listeners = append(c.Listeners, ListenerConfig{
+				Name: "tls", Addr: ":8883", Versions: []string{"3.1", "3.1.1", "5.0"},
+				TLS:           &TLSConfig{Cert: "c.pem", Key: "k.pem", CA: "ca.pem", RequireClientCert: true, MinVersion: "1.2"},
+				WebSocket:     &WebSocketConfig{Path: "/mqtt"},
+				MaxPacketSize: 1024, Mountpoint: "devices/",
+			})
+			c.Auth.CertIdentity = "cn"
+			c.ClientIDs = ClientIDConfig{Prefix: "auto-", Format: "uuid"}
+			c.IDPolicy.Pattern = "^[a-z]+$"
+			c.ShareStrategy = "sticky"
+			c.Capabilities.MaximumQoS = &two
+		}, nil},
+		{"bad log level", func(c *Config) { c.Log.Level = "verbose" }, []string{"log.level"}},
+		{"no listeners", func(c *Config) { c.Listeners = nil }, []string{"listeners"}},
+		{"duplicate name", func(c *Config) {
+			c.Listeners = append(c.Listeners, ListenerConfig{Name: "default", Addr: ":1884"})
+		}, []string{"listeners[1].name"}},
+		{"bad network", func(c *Config) { c.Listeners[0].Network = "udp" }, []string{"listeners[0].network"}},
+		{"no addr", func(c *Config) { c.Listeners[0].Addr = "" }, []string{"listeners[0].addr"}},
+		{"tls without files", func(c *Config) {
+			c.Listeners[0].TLS = &TLSConfig{RequireClientCert: true, MinVersion: "2.0"}
+		}, []string{"listeners[0].tls.cert", "listeners[0].tls.key", "listeners[0].tls.require_client_cert", "listeners[0].tls.min_version"}},
+		{"websocket path", func(c *Config) { c.Listeners[0].WebSocket = &WebSocketConfig{Path: "mqtt"} }, []string{"listeners[0].websocket.path"}},
+		{"bad version", func(c *Config) { c.Listeners[0].Versions = []string{"5.0", "4"} }, []string{"listeners[0].versions[1]"}},
+		{"packet size", func(c *Config) { c.Listeners[0].MaxPacketSize = 1 << 30 }, []string{"listeners[0].max_packet_size"}},
+		{"negative connections", func(c *Config) { c.Listeners[0].MaxConnections = -1 }, []string{"listeners[0].max_connections"}},
+		{"wildcard mountpoint", func(c *Config) { c.Listeners[0].Mountpoint = "a/+/" }, []string{"listeners[0].mountpoint"}},
+		{"cert identity", func(c *Config) { c.Auth.CertIdentity = "email" }, []string{"auth.cert_identity"}},
+		{"negative queue", func(c *Config) { c.Sessions.MaxQueued = -1 }, []string{"sessions.max_queued"}},
+		{"session packet size", func(c *Config) { c.Sessions.MaxPacketSize = 1 << 30 }, []string{"sessions.max_packet_size"}},
+		{"keep alive bounds", func(c *Config) {
+			c.Sessions.MinKeepAlive = 60
+			c.Sessions.MaxKeepAlive = 30
+		}, []string{"sessions.min_keep_alive"}},
+		{"id format", func(c *Config) { c.ClientIDs.Format = "counter" }, []string{"assigned_client_ids.format"}},
+		{"id prefix", func(c *Config) { c.ClientIDs.Prefix = "a/b" }, []string{"assigned_client_ids.prefix"}},
+		{"sequence without prefix", func(c *Config) { c.ClientIDs = ClientIDConfig{Format: "sequence"} }, []string{"assigned_client_ids.prefix"}},
+		{"id pattern", func(c *Config) { c.IDPolicy.Pattern = "[" }, []string{"client_id_policy.pattern"}},
+		{"id length", func(c *Config) { c.IDPolicy.MaxLength = -1 }, []string{"client_id_policy.max_length"}},
+		{"share strategy", func(c *Config) { c.ShareStrategy = "first" }, []string{"share_strategy"}},
+		{"retained file disabled", func(c *Config) {
+			c.Retained.Enabled = &disabled
+			c.Retained.File = "retained.json"
+		}, []string{"retained.file"}},
+		{"maximum qos", func(c *Config) { c.Capabilities.MaximumQoS = &three }, []string{"capabilities.maximum_qos"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.setup(c)
+			err := c.validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			errs, ok := err.(ConfigError)
+			if !ok {
+				t.Fatalf("err %v, want a ConfigError", err)
+			}
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e[:strings.Index(e, ":")])
+			}
+			if strings.Join(fields, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("errors on %v, want %v\n%s", fields, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestConfigIDPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy IDPolicyConfig
+		allow  []string
+		refuse []string
+	}{
+		{"default", IDPolicyConfig{}, []string{"sensor-1"}, []string{"sensor_1"}},
+		{"default pattern", IDPolicyConfig{MaxLength: 8}, []string{"sensor-1"}, []string{"sensor_1", "sensor-12"}},
+		{"pattern", IDPolicyConfig{Pattern: `^[a-z_]+$`, ReservedPrefixes: []string{"sys_"}}, []string{"sensor_a"}, []string{"sensor-1", "sys_a"}},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		c.IDPolicy = tt.policy
+		setup, err := c.build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy := setup.srv.ClientIDPolicy
+		if policy == nil {
+			policy = mqttp.DefaultClientIDPolicy
+		}
+		for _, id := range tt.allow {
+			if !policy.AllowClientID(id) {
+				t.Errorf("%s: %q refused", tt.name, id)
+			}
+		}
+		for _, id := range tt.refuse {
+			if policy.AllowClientID(id) {
+				t.Errorf("%s: %q allowed", tt.name, id)
+			}
+		}
+	}
+}
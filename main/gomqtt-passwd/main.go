@@ -0,0 +1,122 @@
+// Command gomqtt-passwd manages the password file of the broker.
+//
+//	gomqtt-passwd add <file> <user>
+//	gomqtt-passwd remove <file> <user>
+//	gomqtt-passwd verify <file> <user>
+//
+// The password is read from the terminal without echo, or from the first
+// line of standard input when it is not a terminal. It is never taken from
+// the command line, where other users could see it.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/chenglinning/gomqtt/broker"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gomqtt-passwd add|remove|verify <file> <user>")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "gomqtt-passwd:", err)
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) != 4 {
+		usage()
+	}
+	cmd, path, user := os.Args[1], os.Args[2], os.Args[3]
+
+	pf, err := broker.LoadPasswordFile(path)
+	if os.IsNotExist(err) && cmd == "add" {
+		pf, err = createFile(path)
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	switch cmd {
+	case "add":
+		password := readPassword(stdin, "Password: ")
+		if isTerminal(os.Stdin) && readPassword(stdin, "Reenter password: ") != password {
+			fail(errors.New("passwords do not match"))
+		}
+		if err := pf.Set(user, password); err != nil {
+			fail(err)
+		}
+		if err := pf.Save(); err != nil {
+			fail(err)
+		}
+	case "remove":
+		if !pf.Remove(user) {
+			fail(fmt.Errorf("no user %s", user))
+		}
+		if err := pf.Save(); err != nil {
+			fail(err)
+		}
+	case "verify":
+		if !pf.Check(user, readPassword(stdin, "Password: ")) {
+			fmt.Println("password does not match")
+			os.Exit(1)
+		}
+		fmt.Println("password matches")
+	default:
+		usage()
+	}
+}
+
+// createFile makes an empty password file readable by its owner only
+func createFile(path string) (*broker.PasswordFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return broker.LoadPasswordFile(path)
+}
+
+// readPassword reads a line of standard input, on a terminal after a
+// prompt and with echo turned off
+func readPassword(stdin *bufio.Reader, prompt string) string {
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, prompt)
+		if setEcho(false) == nil {
+			defer func() {
+				setEcho(true)
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		fail(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// setEcho turns the echo of the terminal on standard input on or off
+func setEcho(on bool) error {
+	mode := "-echo"
+	if on {
+		mode = "echo"
+	}
+	stty := exec.Command("stty", mode)
+	stty.Stdin = os.Stdin
+	return stty.Run()
+}
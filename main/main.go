@@ -1,49 +1,208 @@
-package server
+package main
+
 import (
-	"net"
+	"context"
 	"errors"
-	"regexp"
-	"sync"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
-	"github.com/gomqtt/mqttp"
+
+	"github.com/chenglinning/gomqtt/broker"
+	"github.com/wonderivan/logger"
 )
 
-type Server interface {
+// time given to connected clients to go away on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// how often the password file is checked for changes
+const passwdPollInterval = 5 * time.Second
 
+var (
+	configFile   = flag.String("config", "", "YAML configuration file, reloaded on SIGHUP")
+	checkConfig  = flag.Bool("check-config", false, "check the configuration and exit")
+	addr         = flag.String("addr", "", "listen address of the default listener, 0.0.0.0:9090 without -config")
+	logLevel     = flag.String("log-level", "", "log level: error, warn, info, debug or trace")
+	logFile      = flag.String("log-file", "", "log file")
+	passwdFile   = flag.String("passwd", "", "password file, see main/gomqtt-passwd")
+	aclFile      = flag.String("acl", "", "topic ACL file")
+	tlsAddr      = flag.String("tls-addr", "", "TLS listen address, e.g. 0.0.0.0:8883")
+	certFile     = flag.String("cert", "", "TLS server certificate")
+	keyFile      = flag.String("key", "", "TLS server key")
+	caFile       = flag.String("cafile", "", "CA bundle verifying client certificates")
+	requireCert  = flag.Bool("require-cert", false, "refuse TLS clients without a certificate")
+	tlsMin       = flag.String("tls-min", "1.2", "minimum TLS version")
+	ciphers      = flag.String("ciphers", "", "comma separated TLS 1.2 cipher suites")
+	certIdentity = flag.String("cert-identity", "", "user name from client certificates: cn or san")
+	wsAddr       = flag.String("ws-addr", "", "WebSocket listen address, e.g. 0.0.0.0:8080")
+	wsPath       = flag.String("ws-path", broker.DefaultWSPath, "WebSocket path")
+	wsOrigins    = flag.String("ws-origins", "", "comma separated allowed origins, * for any")
+	wsTLS        = flag.Bool("ws-tls", false, "serve WebSocket over TLS with -cert and -key")
+)
+
+// readConfig loads the configuration file, applies the flags over it and
+// validates the result
+func readConfig() (*Config, error) {
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if *logLevel != "" {
+		cfg.Log.Level = *logLevel
+	}
+	if *logFile != "" {
+		cfg.Log.File = *logFile
+	}
+	if *passwdFile != "" {
+		cfg.Auth.PasswdFile = *passwdFile
+	}
+	if *aclFile != "" {
+		cfg.Auth.ACLFile = *aclFile
+	}
+	if *certIdentity != "" {
+		cfg.Auth.CertIdentity = *certIdentity
+	}
+	if *addr != "" || len(cfg.Listeners) == 0 {
+		l := defaultListener
+		if *addr != "" {
+			l.Addr = *addr
+		}
+		cfg.Listeners = append([]ListenerConfig{l}, cfg.Listeners...)
+	}
+	var tlsConfig *TLSConfig
+	if *certFile != "" || *keyFile != "" {
+		tlsConfig = &TLSConfig{
+			Cert:              *certFile,
+			Key:               *keyFile,
+			CA:                *caFile,
+			RequireClientCert: *requireCert,
+			MinVersion:        *tlsMin,
+		}
+		if *ciphers != "" {
+			tlsConfig.Ciphers = strings.Split(*ciphers, ",")
+		}
+	}
+	if (*tlsAddr != "" || *wsTLS) && tlsConfig == nil {
+		return nil, errors.New("TLS listeners need -cert and -key")
+	}
+	if *tlsAddr != "" {
+		cfg.Listeners = append(cfg.Listeners, ListenerConfig{Name: "tls", Addr: *tlsAddr, TLS: tlsConfig})
+	}
+	if *wsAddr != "" {
+		ws := &WebSocketConfig{Path: *wsPath}
+		if *wsOrigins != "" {
+			ws.Origins = strings.Split(*wsOrigins, ",")
+		}
+		l := ListenerConfig{Name: "websocket", Addr: *wsAddr, WebSocket: ws}
+		if *wsTLS {
+			l.TLS = tlsConfig
+		}
+		cfg.Listeners = append(cfg.Listeners, l)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
-func process(conn net.Conn){
-	defer conn.Close()
-	for {
-	   var buf [128]byte
-	   n ,err := conn.Read(buf[:])
-	   if err != nil {
-		  fmt.Println("Read from tcp server failed,err:",err)
-		  break
-	   }
-	   data := string(buf[:n])
-	   fmt.Printf("Recived from client,data:%s\n",data)
-	}
- }
- 
- func main() {
-	// close TCP service port
-	listener,err := net.Listen("tcp","0.0.0.0:9090")
+func main() {
+	flag.Parse()
+
+	cfg, err := readConfig()
+	if err != nil {
+		fail(*checkConfig, err)
+	}
+	setup, err := cfg.build()
 	if err != nil {
-	   fmt.Println("Listen tcp server failed,err:",err)
-	   return
-	}
- 
-	for{
-	   // create socket connection
-	   conn,err := listener.Accept()
-	   if err != nil {
-		  fmt.Println("Listen.Accept failed,err:",err)
-		  continue
-	   }
- 
-	   // handle connection
-	   go process(conn)
-	}
- }
-  
\ No newline at end of file
+		fail(*checkConfig, err)
+	}
+	if *checkConfig {
+		fmt.Println("Configuration OK")
+		return
+	}
+	if err := cfg.setupLog(); err != nil {
+		fail(false, fmt.Errorf("log: %s", err))
+	}
+
+	srv := setup.srv
+	stopWatch := setup.watch()
+	defer func() { stopWatch() }()
+	if cfg.Retained.File != "" {
+		if err := loadRetained(srv, cfg.Retained.File); err != nil {
+			fail(false, fmt.Errorf("retained.file: %s", err))
+		}
+	}
+
+	errc := make(chan error, len(setup.listeners))
+	for _, ln := range setup.listeners {
+		go func(ln *broker.Listener) {
+			err := srv.ListenAndServeListener(ln)
+			if err != broker.ErrServerClosed {
+				err = fmt.Errorf("listener %s: %s", ln, err)
+			}
+			errc <- err
+		}(ln)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	status := 0
+loop:
+	for {
+		select {
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				logger.Info("Shutting down")
+				break loop
+			}
+			next, err := readConfig()
+			if err != nil {
+				logger.Error(fmt.Sprintf("Reload failed, keeping the running configuration:\n%s", err))
+				continue
+			}
+			stop, err := setup.reload(cfg, next)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Reload failed, keeping the running configuration:\n%s", err))
+				continue
+			}
+			stopWatch()
+			stopWatch = stop
+			cfg = next
+		case err := <-errc:
+			logger.Error(err.Error())
+			status = 1
+			break loop
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Shutdown: %s", err))
+	}
+	if cfg.Retained.File != "" {
+		if err := saveRetained(srv, cfg.Retained.File); err != nil {
+			logger.Error(fmt.Sprintf("Saving retained messages: %s", err))
+			status = 1
+		}
+	}
+	if status != 0 {
+		os.Exit(status)
+	}
+}
+
+// fail reports a configuration error and exits, on stderr for
+// -check-config and in the log otherwise
+func fail(check bool, err error) {
+	if check {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		logger.Error(err.Error())
+	}
+	os.Exit(1)
+}
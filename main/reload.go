@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/chenglinning/gomqtt/broker"
+	"github.com/wonderivan/logger"
+)
+
+// watch polls the password files for changes until the returned function
+// is called
+func (this *brokerSetup) watch() func() {
+	var stops []func()
+	for _, pf := range this.watched {
+		stops = append(stops, pf.Watch(passwdPollInterval))
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// reload applies next in place of the running configuration old without
+// closing connections: authentication, ACL, limits, capabilities, logging
+// and certificates change at once. Listeners which were added, removed or
+// moved and the retained file only change on restart, they are reported
+// and keep running as before. It returns the function stopping the
+// password file watches of the new configuration.
+func (this *brokerSetup) reload(old *Config, next *Config) (func(), error) {
+	loaded, err := next.load()
+	if err != nil {
+		return nil, err
+	}
+	fixed := restartOnly(old, next)
+	for _, field := range fixed {
+		logger.Warn(fmt.Sprintf("%s changed, it applies after a restart", field))
+	}
+	if err := next.setupLog(); err != nil {
+		logger.Error(fmt.Sprintf("log: %s", err))
+	}
+
+	srv := this.srv
+	this.srv.Reconfigure(func() {
+		next.configure(srv, loaded)
+		// a new strategy would forget the state of the running one
+		if next.ShareStrategy != old.ShareStrategy {
+			srv.ShareStrategy, _ = broker.NewShareStrategy(next.ShareStrategy)
+		}
+		for i, ln := range this.listeners {
+			if fixed.has(listenerField(i)) {
+				continue
+			}
+			l := loaded.listeners[i]
+			ln.Versions = l.Versions
+			ln.Authenticator = l.Authenticator
+			ln.MaxConnections = l.MaxConnections
+			ln.MaxPacketSize = l.MaxPacketSize
+		}
+	})
+	for i, holder := range this.tls {
+		if holder != nil && !fixed.has(listenerField(i)) {
+			holder.Store(loaded.certs[i])
+		}
+	}
+	this.watched = loaded.watched
+	logger.Info("Configuration reloaded")
+	return this.watch(), nil
+}
+
+// fields are names of configuration settings
+type fields []string
+
+func (this fields) has(field string) bool {
+	for _, f := range this {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func listenerField(i int) string {
+	return fmt.Sprintf("listeners[%d]", i)
+}
+
+// restartOnly lists the settings of next which differ from old but cannot
+// change while the broker runs
+func restartOnly(old *Config, next *Config) fields {
+	var result fields
+	for i := range old.Listeners {
+		if i >= len(next.Listeners) || !sameEndpoint(&old.Listeners[i], &next.Listeners[i]) {
+			result = append(result, listenerField(i))
+		}
+	}
+	for i := len(old.Listeners); i < len(next.Listeners); i++ {
+		result = append(result, listenerField(i))
+	}
+	if old.Retained.File != next.Retained.File {
+		result = append(result, "retained.file")
+	}
+	return result
+}
+
+// sameEndpoint reports whether two listeners accept connections the same
+// way, so that the running one can take the settings of the other
+func sameEndpoint(a *ListenerConfig, b *ListenerConfig) bool {
+	return a.Name == b.Name && a.Network == b.Network && a.Addr == b.Addr &&
+		(a.TLS == nil) == (b.TLS == nil) &&
+		reflect.DeepEqual(a.WebSocket, b.WebSocket) &&
+		a.Mountpoint == b.Mountpoint
+}
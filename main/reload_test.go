@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/chenglinning/gomqtt/broker"
+	"github.com/chenglinning/gomqtt/mqttp"
+)
+
+func TestLoadBuildsNoServer(t *testing.T) {
+	setup, err := validConfig().load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup.srv != nil {
+		t.Error("load built a server")
+	}
+	if len(setup.listeners) != 1 {
+		t.Errorf("%d listeners", len(setup.listeners))
+	}
+}
+
+func TestReload(t *testing.T) {
+	acl := filepath.Join(t.TempDir(), "acl")
+	if err := ioutil.WriteFile(acl, []byte("topic read #\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	one := 1
+
+	old := validConfig()
+	old.ShareStrategy = "sticky"
+	old.Sessions.ReceiveMaximum = 10
+	old.Listeners = append(old.Listeners, ListenerConfig{Name: "other", Addr: "127.0.0.1:1884", MaxConnections: 3})
+	setup, err := old.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := setup.srv
+	strategy := srv.ShareStrategy
+
+	next := validConfig()
+	next.ShareStrategy = "sticky"
+	next.Auth.ACLFile = acl
+	next.Capabilities.MaximumQoS = &one
+	next.IDPolicy.MaxLength = 8
+	next.Listeners[0].MaxConnections = 5
+	next.Listeners = append(next.Listeners, ListenerConfig{Name: "other", Addr: "127.0.0.1:1885", MaxConnections: 7})
+	stop, err := setup.reload(old, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if srv.Authorizer == nil {
+		t.Error("ACL not loaded")
+	}
+	if srv.MaximumQoS != mqttp.QoS1 {
+		t.Errorf("Maximum QoS %d, want 1", srv.MaximumQoS)
+	}
+	if srv.ClientIDPolicy == nil {
+		t.Error("client ID policy not set")
+	}
+	// a setting removed from the configuration gets its default again
+	if srv.ReceiveMaximum != broker.DefaultReceiveMaximum {
+		t.Errorf("Receive Maximum %d, want %d", srv.ReceiveMaximum, broker.DefaultReceiveMaximum)
+	}
+	// an unchanged strategy keeps its state
+	if srv.ShareStrategy != strategy {
+		t.Error("share strategy replaced")
+	}
+	if n := setup.listeners[0].MaxConnections; n != 5 {
+		t.Errorf("max connections %d, want 5", n)
+	}
+	// a moved listener changes on restart only
+	if n := setup.listeners[1].MaxConnections; n != 3 {
+		t.Errorf("max connections of the moved listener %d, want 3", n)
+	}
+
+	next.ShareStrategy = "hash"
+	if _, err := setup.reload(old, next); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.ShareStrategy.(broker.HashTopicStrategy); !ok {
+		t.Errorf("share strategy %T, want broker.HashTopicStrategy", srv.ShareStrategy)
+	}
+}
+
+func TestReloadFails(t *testing.T) {
+	old := validConfig()
+	setup, err := old.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := setup.srv
+
+	next := validConfig()
+	next.Auth.ACLFile = filepath.Join(t.TempDir(), "missing")
+	next.Sessions.ReceiveMaximum = 5
+	next.Listeners[0].MaxConnections = 5
+	if _, err := setup.reload(old, next); err == nil {
+		t.Fatal("reload with a missing ACL file succeeded")
+	}
+	if srv.Authorizer != nil || srv.ReceiveMaximum != broker.DefaultReceiveMaximum || setup.listeners[0].MaxConnections != 0 {
+		t.Error("failed reload changed the running configuration")
+	}
+}
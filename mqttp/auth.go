@@ -1,48 +1,61 @@
 package mqttp
 
 import (
-	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
-	"io"
 	"fmt"
-	"time"
+	"io"
+
+	"github.com/wonderivan/logger"
 )
 
 type Auth struct {
-	header
-	rcodes []ReasonCode
+	Header
+	rcode ReasonCode
 }
 
 var _ Packet = (*Auth)(nil)
 
 func NewAuth() *Auth {
-	p := &AUth{}
+	p := &Auth{}
+	p.SetType(AUTH)
 	p.ResetProps()
 	return p
 }
 
+func (this *Auth) ReasonCode() ReasonCode {
+	return this.rcode
+}
+
+func (this *Auth) SetReasonCode(c ReasonCode) {
+	this.rcode = c
+}
+
 func (this *Auth) Unpack(rdata []byte) error {
 	r := bytes.NewBuffer(rdata)
+	// the reason code may be omitted when it is success and there are no
+	// properties [MQTT-3.15.2.1]
+	this.rcode = CodeSuccess
+	if r.Len() == 0 {
+		return nil
+	}
+
 	// reason code
 	rcode, err := ReadByte(r)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error parsing connack reason code: %s", err))
+		logger.Error(fmt.Sprintf("Error parsing auth reason code: %s", err))
 		return ErrMalformedStream
 	}
 	reason_code := ReasonCode(rcode)
 	if reason_code.IsValidForType(AUTH) {
 		this.rcode = reason_code
 	} else {
-		logger.Error(fmt.Sprintf("Invalid connack reason code: 0x%02X", rcode))
+		logger.Error(fmt.Sprintf("Invalid auth reason code: 0x%02X", rcode))
 		return ErrMalformedStream
 	}
 
-	if this.GetVersion == MQTT50 {
+	if r.Len() > 0 {
 		// property
-		err = this.ReadProps(r io.Reader)
+		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
 			return ErrMalformedStream
@@ -51,36 +64,35 @@ func (this *Auth) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *Auth) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
+// remainingLength is the length of the variable header and the payload
+func (this *Auth) remainingLength() int {
+	// reason code and property
+	return 1 + this.propset.Size()
+}
+
+// Size returns the length of the encoded packet
+func (this *Auth) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *Auth) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
+	if err != nil {
+		return err
+	}
 	// reason code
-	for _, rc := range this.rcodes {
-    
-		err = WriteByte(buff, rc.Raw())
-		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
-			return nil, err
-		}
+	err = WriteByte(w, this.rcode.Value())
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
+		return err
 	}
 	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
-		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
-		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
-		}
+	err = this.WriteProps(w)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+		return err
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
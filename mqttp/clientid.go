@@ -0,0 +1,67 @@
+package mqttp
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ClientIDPolicy decides which client IDs of CONNECT packets are accepted.
+// Empty client IDs are left to the server, which may assign one.
+type ClientIDPolicy interface {
+	AllowClientID(id string) bool
+}
+
+// ClientIDRules is a ClientIDPolicy checking every rule which is set
+type ClientIDRules struct {
+	// Pattern the ID must match, anchored with ^ and $ to cover the
+	// whole ID, nil for any
+	Pattern *regexp.Regexp
+
+	// MaxLength in characters, 0 for no limit
+	MaxLength int
+
+	// ReservedPrefixes are refused, e.g. the prefix of assigned IDs
+	ReservedPrefixes []string
+
+	// Check is called last when not nil
+	Check func(id string) bool
+}
+
+// AllowClientID implements ClientIDPolicy
+func (this *ClientIDRules) AllowClientID(id string) bool {
+	if this.Pattern != nil && !this.Pattern.MatchString(id) {
+		return false
+	}
+	if this.MaxLength > 0 && utf8.RuneCountInString(id) > this.MaxLength {
+		return false
+	}
+	for _, prefix := range this.ReservedPrefixes {
+		if prefix != "" && strings.HasPrefix(id, prefix) {
+			return false
+		}
+	}
+	if this.Check != nil && !this.Check(id) {
+		return false
+	}
+	return true
+}
+
+// DefaultClientIDPattern allows digits, letters and '-', the client IDs
+// accepted before the policy could be set
+var DefaultClientIDPattern = regexp.MustCompile(`^[0-9a-zA-Z\-]*$`)
+
+// DefaultClientIDPolicy accepts the client IDs of DefaultClientIDPattern.
+// Any UTF-8 string is a valid client ID [MQTT-3.1.3-4], a ClientIDRules
+// with another Pattern or none accepts more of them.
+var DefaultClientIDPolicy ClientIDPolicy = &ClientIDRules{Pattern: DefaultClientIDPattern}
+
+// MaxClientIDLen31 is the length limit of MQTT 3.1 client IDs in characters
+const MaxClientIDLen31 = 23
+
+// validClientID31 reports whether id is 1 to 23 characters long as MQTT
+// 3.1 requires, it cannot ask for an assigned client ID
+func validClientID31(id string) bool {
+	n := utf8.RuneCountInString(id)
+	return n > 0 && n <= MaxClientIDLen31
+}
@@ -0,0 +1,88 @@
+package mqttp
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestClientIDRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *ClientIDRules
+		id    string
+		allow bool
+	}{
+		{"no rules", &ClientIDRules{}, "a_b:c.d/é", true},
+		{"pattern", &ClientIDRules{Pattern: regexp.MustCompile(`^dev-[0-9]+$`)}, "dev-12", true},
+		{"pattern refuses", &ClientIDRules{Pattern: regexp.MustCompile(`^dev-[0-9]+$`)}, "dev-x", false},
+		{"max length", &ClientIDRules{MaxLength: 3}, "abc", true},
+		{"over max length", &ClientIDRules{MaxLength: 3}, "abcd", false},
+		{"length in runes", &ClientIDRules{MaxLength: 3}, "ééé", true},
+		{"reserved prefix", &ClientIDRules{ReservedPrefixes: []string{"auto-", "sys"}}, "system", false},
+		{"other prefix", &ClientIDRules{ReservedPrefixes: []string{"auto-", ""}}, "car-auto-1", true},
+		{"check", &ClientIDRules{Check: func(id string) bool { return id != "root" }}, "user", true},
+		{"check refuses", &ClientIDRules{Check: func(id string) bool { return id != "root" }}, "root", false},
+		{"all rules", &ClientIDRules{
+			Pattern:          regexp.MustCompile(`^[a-z-]+$`),
+			MaxLength:        8,
+			ReservedPrefixes: []string{"auto-"},
+			Check:            func(id string) bool { return true },
+		}, "auto-a", false},
+	}
+	for _, tt := range tests {
+		if got := tt.rules.AllowClientID(tt.id); got != tt.allow {
+			t.Errorf("%s: AllowClientID(%q) %t, want %t", tt.name, tt.id, got, tt.allow)
+		}
+	}
+}
+
+func TestDefaultClientIDPolicy(t *testing.T) {
+	for _, id := range []string{"", "a", "Sensor-01"} {
+		if !DefaultClientIDPolicy.AllowClientID(id) {
+			t.Errorf("%q refused", id)
+		}
+	}
+	for _, id := range []string{"a_b", "a:b", "a.b", "a/b", "é"} {
+		if DefaultClientIDPolicy.AllowClientID(id) {
+			t.Errorf("%q allowed", id)
+		}
+	}
+}
+
+func TestDecoderClientIDPolicy(t *testing.T) {
+	relaxed := &ClientIDRules{MaxLength: 10}
+	tests := []struct {
+		name    string
+		version byte
+		policy  ClientIDPolicy
+		id      string
+		want    error
+	}{
+		{"default", MQTT311, nil, "sensor-1", nil},
+		{"default refuses", MQTT311, nil, "sensor_1", CodeInvalidClientID},
+		{"policy", MQTT50, relaxed, "sensor_1", nil},
+		{"policy refuses", MQTT50, relaxed, strings.Repeat("a", 11), CodeInvalidClientID},
+		{"empty ID is left to the server", MQTT50, relaxed, "", nil},
+		{"MQTT 3.1 length", MQTT31, relaxed, strings.Repeat("a", 10), nil},
+	}
+	for _, tt := range tests {
+		c := NewConnect()
+		c.SetVersion(tt.version)
+		c.SetClean(true)
+		c.client_id = tt.id
+
+		dec := NewDecoder(bytes.NewReader(encode(t, tt.version, c)))
+		dec.SetClientIDPolicy(tt.policy)
+		pkt, err := dec.Decode()
+		if err != tt.want {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		// a refused CONNECT is returned to answer it in CONNACK
+		if pkt == nil || pkt.(*Connect).ClientID() != tt.id {
+			t.Errorf("%s: CONNECT of %q not returned", tt.name, tt.id)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package mqttp
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+)
+
+// protoLevel is the protocol level negotiated on a connection. It is shared
+// by the Decoder and Encoder of the connection which usually run in
+// different goroutines.
+type protoLevel struct {
+	v uint32
+}
+
+func (this *protoLevel) get() byte {
+	return byte(atomic.LoadUint32(&this.v))
+}
+
+func (this *protoLevel) set(v byte) {
+	atomic.StoreUint32(&this.v, uint32(v))
+}
+
+// Decoder reads the packets of one network connection. It records the
+// protocol level of the CONNECT packet and decodes every later packet
+// with it, so that properties and reason codes are parsed as the
+// negotiated MQTT version defines them.
+type Decoder struct {
+	f      *framer
+	level  *protoLevel
+	max    uint32
+	policy ClientIDPolicy
+}
+
+// maxEncoderBuffer is the largest buffer an Encoder keeps between packets
+const maxEncoderBuffer = 64 * 1024
+
+// Encoder writes the packets of one network connection with the protocol
+// level negotiated by CONNECT. Every packet is encoded into a buffer the
+// Encoder reuses and written with a single call, an Encoder must not be
+// used by more than one goroutine at a time.
+type Encoder struct {
+	w     io.Writer
+	level *protoLevel
+	buff  bytes.Buffer
+}
+
+// NewDecoder returns a Decoder reading from r, r is read ahead through a
+// bufio.Reader unless it is an io.ByteReader
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{f: newFramer(r), level: &protoLevel{}}
+}
+
+// NewEncoder returns an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, level: &protoLevel{}}
+}
+
+// NewCodec returns a Decoder and an Encoder sharing the protocol level,
+// the level learned by either of them applies to both.
+func NewCodec(r io.Reader, w io.Writer) (*Decoder, *Encoder) {
+	level := &protoLevel{}
+	return &Decoder{f: newFramer(r), level: level}, &Encoder{w: w, level: level}
+}
+
+// Version returns the negotiated protocol level, TBD before CONNECT
+func (this *Decoder) Version() byte {
+	return this.level.get()
+}
+
+// SetVersion sets the protocol level of the connection
+func (this *Decoder) SetVersion(v byte) {
+	this.level.set(v)
+}
+
+// SetMaxPacketSize makes Decode refuse packets larger than n bytes with
+// CodePacketTooLarge, 0 means no limit. The first packet of a connection
+// is never allowed more than MaxConnectSize.
+func (this *Decoder) SetMaxPacketSize(n uint32) {
+	this.max = n
+}
+
+// SetClientIDPolicy sets the policy client IDs of CONNECT are checked
+// against, nil for DefaultClientIDPolicy
+func (this *Decoder) SetClientIDPolicy(policy ClientIDPolicy) {
+	this.policy = policy
+}
+
+// Decode reads the next packet. The payload of a Publish refers to the
+// pooled buffer it was read into, see Publish.Release. The protocol level
+// of a CONNECT packet is remembered, a second CONNECT on the same
+// connection is a protocol error [MQTT-3.1.0-2]. A CONNECT whose client ID
+// the policy or MQTT 3.1 refuses is returned together with
+// CodeInvalidClientID, so that the server can answer it with CONNACK. So
+// is a CONNECT of an unsupported protocol, together with
+// CodeUnsupportedProtocol and the level it asked for.
+func (this *Decoder) Decode() (Packet, error) {
+	v := this.level.get()
+	max := this.max
+	if v == TBD && (max == 0 || max > MaxConnectSize) {
+		max = MaxConnectSize
+	}
+	pkt, err := this.f.decode(v, max)
+	if err == CodeUnsupportedProtocol && pkt != nil && v == TBD {
+		return pkt, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := pkt.(*Connect); ok {
+		if v != TBD {
+			return nil, CodeProtocolError
+		}
+		this.level.set(c.GetVersion())
+
+		policy := this.policy
+		if policy == nil {
+			policy = DefaultClientIDPolicy
+		}
+		id := c.ClientID()
+		if c.GetVersion() == MQTT31 && !validClientID31(id) {
+			return c, CodeInvalidClientID
+		}
+		if id != "" && !policy.AllowClientID(id) {
+			return c, CodeInvalidClientID
+		}
+	}
+	return pkt, nil
+}
+
+// Version returns the negotiated protocol level, TBD before CONNECT
+func (this *Encoder) Version() byte {
+	return this.level.get()
+}
+
+// SetVersion sets the protocol level of the connection
+func (this *Encoder) SetVersion(v byte) {
+	this.level.set(v)
+}
+
+// Encode writes pkt with the protocol level of the connection. Encoding a
+// CONNECT packet sets the level to the one requested by it. A packet
+// already at the level is not written to, so that it can be read by other
+// goroutines while it is encoded.
+func (this *Encoder) Encode(pkt Packet) error {
+	if c, ok := pkt.(*Connect); ok {
+		this.level.set(c.GetVersion())
+	} else if v := this.level.get(); v != TBD && pkt.GetVersion() != v {
+		pkt.SetVersion(v)
+	}
+
+	this.buff.Reset()
+	this.buff.Grow(pkt.Size())
+	err := pkt.EncodeTo(&this.buff)
+	if err == nil {
+		_, err = this.w.Write(this.buff.Bytes())
+	}
+	if this.buff.Cap() > maxEncoderBuffer {
+		this.buff = bytes.Buffer{}
+	}
+	return err
+}
@@ -2,16 +2,13 @@ package mqttp
 
 import (
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
 	"io"
 	"fmt"
 )
 
 type ConnAck struct {
-	header
+	Header
 	flags        byte
 	rcode	     ReasonCode
 }
@@ -20,6 +17,7 @@ var _ Packet = (*ConnAck)(nil)
 
 func NewConnAck() *ConnAck {
 	p := &ConnAck{}
+	p.SetType(CONNACK)
 	p.ResetProps()
 	return p
 }
@@ -36,6 +34,14 @@ func (this *ConnAck) SetSessionPresent(v bool) {
 	}
 }
 
+func (this *ConnAck) ReasonCode() ReasonCode {
+	return this.rcode
+}
+
+func (this *ConnAck) SetReasonCode(c ReasonCode) {
+	this.rcode = c
+}
+
 func (this *ConnAck) Unpack(rdata []byte) error {
 	r := bytes.NewBuffer(rdata)
 	// connack flags
@@ -65,9 +71,9 @@ func (this *ConnAck) Unpack(rdata []byte) error {
 		return ErrMalformedStream
 	}
 
-	if this.GetVersion == MQTT50 {
+	if this.GetVersion() == MQTT50 {
 		// property
-		err = this.ReadProps(r io.Reader)
+		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
 			return ErrMalformedStream
@@ -77,39 +83,51 @@ func (this *ConnAck) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *ConnAck) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
-	// connack flags
-	err = WriteByte(buff, this.flags)
+// remainingLength is the length of the variable header and the payload
+func (this *ConnAck) remainingLength() int {
+	// connack flags and reason code
+	n := 2
+	if this.GetVersion() == MQTT50 {
+		n += this.propset.Size()
+	}
+	return n
+}
+
+// Size returns the length of the encoded packet
+func (this *ConnAck) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *ConnAck) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
+	if err != nil {
+		return err
+	}
+	// connack flags, reserved in MQTT 3.1 which has no Session Present
+	flags := this.flags
+	if this.GetVersion() == MQTT31 {
+		flags = 0
+	}
+	err = WriteByte(w, flags)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding connack flags: %s", err))
-		return nil, err
+		return err
 	}
 	// reason code
-	err = WriteByte(buff, this.rcode.Value())
+	err = WriteByte(w, this.rcode.Value())
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
-		return nil, err
+		return err
 	}
 	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	if this.GetVersion() == MQTT50 {
+		err = this.WriteProps(w)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
-		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
@@ -2,23 +2,14 @@ package mqttp
 
 import (
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
 	"unicode/utf8"
 	"bytes"
 	"io"
 	"fmt"
 )
 
-var clientIDRegexp *regexp.Regexp
-
-func init() {
-//	clientIDRegexp = regexp.MustCompile(`^[0-9a-zA-Z \-_,.|/]*$`)
-	clientIDRegexp = regexp.MustCompile(`^[0-9a-zA-Z\-]*$`)
-}
-
 type Connect struct {
-	header
+	Header
 	client_id     string
 	username      string
 	password      string
@@ -32,6 +23,7 @@ var _ Packet = (*Connect)(nil)
 
 func NewConnect() *Connect {
 	p := &Connect{}
+	p.SetType(CONNECT)
 	p.ResetProps()
 	p.ResetWillProps()
 	return p
@@ -78,6 +70,45 @@ func (this *Connect) ResetWill() {
 	this.will_message = nil
 }
 
+// SetWill sets the will message published when the connection ends
+// without DISCONNECT
+func (this *Connect) SetWill(topic string, payload []byte, qos byte, retain bool) error {
+	if !IsValidTopic(topic) || len(topic) == 0 {
+		return ErrInvalidTopic
+	}
+	if qos > QoS2 {
+		return ErrInvalidQoS
+	}
+	this.ResetWill()
+	this.flags |= maskConnFlagWill | qos<<3
+	if retain {
+		this.flags |= maskConnFlagWillRetain
+	}
+	this.will_topic = topic
+	this.will_message = payload
+	return nil
+}
+
+// HasWill returns true if CONNECT carries a will message
+func (this *Connect) HasWill() bool {
+	return this.willFlag()
+}
+
+// Will returns will topic and will message
+func (this *Connect) Will() (string, []byte) {
+	return this.will_topic, this.will_message
+}
+
+// WillQos returns QoS of will message
+func (this *Connect) WillQos() byte {
+	return this.willQos()
+}
+
+// WillRetain returns retain flag of will message
+func (this *Connect) WillRetain() bool {
+	return this.willRetain()
+}
+
 // Credentials returns user and password
 func (this *Connect) Credentials() (string, string) {
 	return this.username, this.password
@@ -89,7 +120,7 @@ func (this *Connect) SetCredentials(username string, password string) error {
 	this.flags &= ^maskConnFlagPassword
 
 	// MQTT 3.1.1 does not allow password without user name
-	if (len(username) == 0 && len(password) != 0) && this.GetVersion() < MQTTV50 {
+	if (len(username) == 0 && len(password) != 0) && this.GetVersion() < MQTT50 {
 		return ErrInvalidArgs
 	}
 
@@ -120,7 +151,7 @@ func (this *Connect) willFlag() bool {
 // willQos returns the two bits that specify the QoS level to be used when publishing
 // the Will Message.
 func (this *Connect) willQos() byte {
-	return (this.flags & maskConnFlagWillQos) >> 3)
+	return (this.flags & maskConnFlagWillQos) >> 3
 }
 
 // willRetain returns the bit specifies if the Will Message is to be Retained when it
@@ -142,34 +173,39 @@ func (this *Connect) passwordFlag() bool {
 }
 
 func (this *Connect) validClientID(cid string) bool {
+	if this.GetVersion() == MQTT31 && !validClientID31(cid) {
+		return false
+	}
 	if len(cid) == 0 {
 		return true
 	}
-	return IsValidString(cid) && clientIDRegexp.MatchString(cid)
+	return IsValidString(cid) && DefaultClientIDPolicy.AllowClientID(cid)
 }
 
 func (this *Connect) Unpack(rdata []byte) error {
 	r := bytes.NewBuffer(rdata)
-	// protocol name "MQTT"	
+	// protocol name "MQTT", "MQIsdp" for MQTT 3.1
 	utf8bytes, err := ReadUTF8String(r)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error parsing protocol name: %s", err))
 		return CodeUnspecifiedError
 	}
-	if string(utf8bytes) != "MQTT" {
+	proname := string(utf8bytes)
+	if proname != PRONAME && proname != PRONAME31 {
 		logger.Error(fmt.Sprintf("Invalid protocol name: 0x%s", utf8bytes))
 		return CodeUnsupportedProtocol
 	}
-	// protocol level (4 || 5)
+	// protocol level (3 || 4 || 5), 3 goes with "MQIsdp" only
 	proto_version, err := ReadByte(r)
 	if err != nil {
 		logger.Error("Error parsing protocol version")
 		return CodeMalformedPacket
 	}
-	if proto_version == MQTT311 || proto_version == MQTT50 {
-		this.SetVersion(proto_version)
-	} else {
-		logger.Error(fmt.Sprintf("Invalid protocol version: 0x%02X", proto_version))
+	// the level is kept even when it is not supported, the server answers
+	// in the format of the level the client asked for
+	this.SetVersion(proto_version)
+	if proname != protocolName(proto_version) {
+		logger.Error(fmt.Sprintf("Invalid protocol version: 0x%02X of %s", proto_version, proname))
 		return CodeUnsupportedProtocol
 	}
 
@@ -191,7 +227,7 @@ func (this *Connect) Unpack(rdata []byte) error {
 			logger.Error(fmt.Sprintf("Invalid will qos: 0x%02X", this.willQos()))
 			return CodeMalformedPacket
 		}
-	} else if this.willQos > QoS0 {
+	} else if this.willQos() > QoS0 {
 		logger.Error(fmt.Sprintf("Invalid will qos: 0x%02X", this.willQos()))
 		return CodeMalformedPacket
 	}
@@ -204,42 +240,40 @@ func (this *Connect) Unpack(rdata []byte) error {
 	}
 	this.SetKeepAlive(keep_alive)
     
-	if proto_version == MQTT311 {
+	if proto_version < MQTT50 {
 		if !this.usernameFlag() && this.passwordFlag() {
 			logger.Error(fmt.Sprintf("Invalid connect flags: 0x%02X", this.flags))
 			return CodeMalformedPacket
 		}
 	} else { // MQTT 5.0
 		// reading properties
-		err = this.ReadProps(r io.Reader)
+		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
 			return CodeMalformedPacket
 		}
 	}
 
-	// MQTT3.1.1 5.0  reading client id
+	// MQTT 3.1, 3.1.1, 5.0 reading client id
 	client_id, err := ReadUTF8String(r)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed reading client id: %s", err))
 		return CodeMalformedPacket
 	}
-	if !clientIDRegexp.MatchString(client_id) || len(client_id) == 0 {
-		logger.Error(fmt.Sprintf("Invalic client id: %s", client_id))
-		return CodeInvalidClientID
-	}
-	this. client_id = client_id
+	// the client id is checked against the ClientIDPolicy of the Decoder,
+	// an empty one asks the server to assign one [MQTT-3.1.3-6]
+	this.client_id = client_id
 
 	// MQTT 5.0 reading will properties
 	if this.willFlag() && proto_version == MQTT50 {
-		err = this.ReadWillProps(r io.Reader)
+		err = this.ReadWillProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading will properties: %s", err))
 			return CodeMalformedPacket
 		}
 	}
 
-	// MQTT 3.1.1, 5.0
+	// MQTT 3.1, 3.1.1, 5.0
 	if this.willFlag() {
 		// reading will topic
 		will_topic, err := ReadUTF8String(r)
@@ -256,7 +290,7 @@ func (this *Connect) Unpack(rdata []byte) error {
 		this.will_topic = will_topic
 
 		// reading will paload
-		payload, err : = ReadBinaryData(r)
+		payload, err := ReadBinaryData(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading will payload: %s", err))
 			return CodeMalformedPacket
@@ -284,122 +318,124 @@ func (this *Connect) Unpack(rdata []byte) error {
 		this.password = password
 	}
 
-	// authenticate usrname / password
-	// DTB
+	// user name and password are checked by the broker Authenticator
+	return nil
 }
 
-func (this *Connect) Pack() ([]byte, error) {
-	// 2 (4==len("MQTT") ) + 4 ("MQTT")  + 1 (proto level) + 1 (connect flags) +2 (keep alive interval) 
-	buff := bytes.NewBuffer([]byte{})
-	
+// remainingLength is the length of the variable header and the payload
+func (this *Connect) remainingLength() int {
+	// protocol name, protocol level, connect flags and keep alive
+	n := 2 + len(protocolName(this.GetVersion())) + 1 + 1 + 2
+	if this.GetVersion() == MQTT50 {
+		n += this.propset.Size()
+	}
+	// client id
+	n += 2 + len(this.client_id)
+	if this.willFlag() {
+		if this.GetVersion() == MQTT50 {
+			n += this.willpropset.Size()
+		}
+		n += 2 + len(this.will_topic) + 2 + len(this.will_message)
+	}
+	if this.usernameFlag() {
+		n += 2 + len(this.username)
+	}
+	if this.passwordFlag() {
+		n += 2 + len(this.password)
+	}
+	return n
+}
+
+// Size returns the length of the encoded packet
+func (this *Connect) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *Connect) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
+	if err != nil {
+		return err
+	}
 	// Variable Header:
-	// protocol name "MQTT"
-	err = WriteString(buff, PRONAME)
+	// protocol name "MQTT", "MQIsdp" for MQTT 3.1
+	err = WriteString(w, protocolName(this.GetVersion()))
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding protocol name: %s", err))
-		return nil, err
+		return err
 	}
-
 	// protocol level
-	err = WriteByte(buff, this.GetVersion())
+	err = WriteByte(w, this.GetVersion())
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error encoding protoco level: %s", err))
-		return nil, err
+		logger.Error(fmt.Sprintf("Error encoding protocol level: %s", err))
+		return err
 	}
 	// connect flags
-	err = WriteByte(buff, this.flags)
+	err = WriteByte(w, this.flags)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding connect flags: %s", err))
-		return nil, err
+		return err
 	}
-
 	// keep alive interval
-	err = WriteUint16(buff, this.keep_alive)
+	err = WriteUint16(w, this.keep_alive)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error encoding connect flags: %s", err))
-		return nil, err
+		logger.Error(fmt.Sprintf("Error encoding keep alive: %s", err))
+		return err
 	}
-
 	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	if this.GetVersion() == MQTT50 {
+		err = this.WriteProps(w)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
-		}
-
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
 
 	// payload:
 	//   clientid
-	err = WriteString(buff, this.client_id)
+	err = WriteString(w, this.client_id)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding clientid: %s", err))
-		return nil, err
+		return err
 	}
 	if this.willFlag() {
-		// will property 
-		if this.GetVersion()==MQTT50 {
-			wpbytes := this.willpropset.PackProps(this.GetType())
-			wplen := len(willppbytes)
-			// encoding will propertiy len
-			err = WriteUvarint(buff, uint32(wplen))
+		// will property
+		if this.GetVersion() == MQTT50 {
+			err = this.WriteWillProps(w)
 			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding will propertiy length: %s", err))
-				return nil, err
-			}
-			if wplen>0 {
-				_, err = buff.Write(wpbytes)
-				if err != nil {
-					logger.Error(fmt.Sprintf("Error encoding will property: %s", err))
-					return nil, err
-				}
+				logger.Error(fmt.Sprintf("Error encoding will property: %s", err))
+				return err
 			}
 		}
-
 		// will topic
-		err = WriteString(buff, this.will_topic)
+		err = WriteString(w, this.will_topic)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding will topic: %s", err))
-			return nil, err
+			return err
 		}
-
 		// will payload
-		err = WriteBinaryData(buff, this.will_message)
+		err = WriteBinaryData(w, this.will_message)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding will message: %s", err))
-			return nil, err
+			return err
 		}
 	}
 	// user name
 	if this.usernameFlag() {
-		err = WriteString(buff, this.username)
+		err = WriteString(w, this.username)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding username: %s", err))
-			return nil, err
+			return err
 		}
 	}
 	// user password
 	if this.passwordFlag() {
-		err = WriteString(buff, this.password)
+		err = WriteString(w, this.password)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding password: %s", err))
-			return nil, err
+			return err
 		}
 	}
 
-	return buff.Bytes(), nil
-
+	return nil
 }
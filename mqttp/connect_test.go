@@ -0,0 +1,133 @@
+package mqttp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConnectMQTT31(t *testing.T) {
+	c := NewConnect()
+	c.SetVersion(MQTT31)
+	c.SetClean(true)
+	c.SetKeepAlive(30)
+	if err := c.SetClientID("legacy-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := encode(t, MQTT31, c)
+	want := []byte{0x10, 22, 0, 6, 'M', 'Q', 'I', 's', 'd', 'p', 3, 0x02, 0, 30,
+		0, 8, 'l', 'e', 'g', 'a', 'c', 'y', '-', '1'}
+	if !bytes.Equal(raw, want) {
+		t.Fatalf("encoded % X, want % X", raw, want)
+	}
+
+	dec := NewDecoder(bytes.NewReader(raw))
+	pkt, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pkt.(*Connect); got.GetVersion() != MQTT31 || got.ClientID() != "legacy-1" {
+		t.Errorf("decoded version %d client ID %q", got.GetVersion(), got.ClientID())
+	}
+	if dec.Version() != MQTT31 {
+		t.Errorf("decoder level %d, want %d", dec.Version(), MQTT31)
+	}
+}
+
+func TestConnectMQTT31ClientID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want error
+	}{
+		{"one character", "a", nil},
+		{"23 characters", strings.Repeat("a", 23), nil},
+		{"23 runes", strings.Repeat("é", 23), nil},
+		{"24 characters", strings.Repeat("a", 24), CodeInvalidClientID},
+		{"empty", "", CodeInvalidClientID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConnect()
+			c.SetVersion(MQTT31)
+			c.SetClean(true)
+			c.client_id = tt.id
+
+			// the length is counted in runes, whatever characters the
+			// policy allows
+			dec := NewDecoder(bytes.NewReader(encode(t, MQTT31, c)))
+			dec.SetClientIDPolicy(&ClientIDRules{})
+			pkt, err := dec.Decode()
+			if err != tt.want {
+				t.Fatalf("err %v, want %v", err, tt.want)
+			}
+			if pkt.(*Connect).ClientID() != tt.id {
+				t.Errorf("client ID %q, want %q", pkt.(*Connect).ClientID(), tt.id)
+			}
+		})
+	}
+}
+
+func TestConnectProtocolName(t *testing.T) {
+	tests := []struct {
+		name    string
+		proname string
+		level   byte
+		want    error
+	}{
+		{"MQIsdp 3", PRONAME31, MQTT31, nil},
+		{"MQTT 4", PRONAME, MQTT311, nil},
+		{"MQTT 5", PRONAME, MQTT50, nil},
+		{"MQTT 3", PRONAME, MQTT31, CodeUnsupportedProtocol},
+		{"MQIsdp 4", PRONAME31, MQTT311, CodeUnsupportedProtocol},
+		{"MQTT 6", PRONAME, 6, CodeUnsupportedProtocol},
+		{"unknown name", "MQXX", MQTT311, CodeUnsupportedProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			WriteString(&body, tt.proname)
+			body.Write([]byte{tt.level, 0x02, 0, 60})
+			if tt.level == MQTT50 {
+				body.WriteByte(0) // property length
+			}
+			WriteString(&body, "c")
+
+			var raw bytes.Buffer
+			writeFixedHeader(&raw, CONNECT.ToByte()<<4, body.Len())
+			raw.Write(body.Bytes())
+
+			pkt, err := NewDecoder(&raw).Decode()
+			if err != tt.want {
+				t.Fatalf("err %v, want %v", err, tt.want)
+			}
+			if pkt == nil {
+				t.Fatal("no CONNECT returned")
+			}
+			if tt.proname == PRONAME && pkt.GetVersion() != tt.level {
+				t.Errorf("level %d, want %d", pkt.GetVersion(), tt.level)
+			}
+		})
+	}
+}
+
+func TestConnAckMQTT31(t *testing.T) {
+	tests := []struct {
+		name string
+		v    byte
+		want []byte
+	}{
+		{"3.1 has no session present", MQTT31, []byte{0x20, 2, 0, 0}},
+		{"3.1.1", MQTT311, []byte{0x20, 2, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := NewConnAck()
+			ack.SetSessionPresent(true)
+			if got := encode(t, tt.v, ack); !bytes.Equal(got, tt.want) {
+				t.Errorf("encoded % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,33 +2,46 @@ package mqttp
 
 import (
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
 	"io"
 	"fmt"
 )
 
 type Disconnect struct {
-	header
+	Header
 	rcode	     ReasonCode
 }
 
-var _ Packet = (*Disconnnect)(nil)
+var _ Packet = (*Disconnect)(nil)
 
 func NewDisconnect() *Disconnect {
 	p := &Disconnect{}
+	p.SetType(DISCONNECT)
 	p.ResetProps()
 	return p
 }
 
+func (this *Disconnect) ReasonCode() ReasonCode {
+	return this.rcode
+}
+
+func (this *Disconnect) SetReasonCode(c ReasonCode) {
+	this.rcode = c
+}
+
 func (this *Disconnect) Unpack(rdata []byte) error {
 	r := bytes.NewBuffer(rdata)
+	// MQTT 3.1.1 DISCONNECT has no variable header, MQTT 5.0 may omit the
+	// reason code when it is normal disconnection and there are no properties
+	this.rcode = CodeSuccess
+	if this.GetVersion() != MQTT50 || r.Len() == 0 {
+		return nil
+	}
+
 	// reason code
 	rcode, err := ReadByte(r)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error parsing connack reason code: %s", err))
+		logger.Error(fmt.Sprintf("Error parsing disconnect reason code: %s", err))
 		return ErrMalformedStream
 	}
 
@@ -36,13 +49,13 @@ func (this *Disconnect) Unpack(rdata []byte) error {
 	if reason_code.IsValidForType(DISCONNECT) {
 		this.rcode = reason_code
 	} else {
-		logger.Error(fmt.Sprintf("Invalid connack reason code: 0x%02X", rcode))
+		logger.Error(fmt.Sprintf("Invalid disconnect reason code: 0x%02X", rcode))
 		return ErrMalformedStream
 	}
 
-	if this.GetVersion == MQTT50 {
+	if r.Len() > 0 {
 		// property
-		err = this.ReadProps(r io.Reader)
+		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
 			return ErrMalformedStream
@@ -52,33 +65,40 @@ func (this *Disconnect) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *Disconnect) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
-	// reason code
-	err = WriteByte(buff, this.rcode.Value())
+// remainingLength is the length of the variable header and the payload
+func (this *Disconnect) remainingLength() int {
+	if this.GetVersion() < MQTT50 {
+		return 0
+	}
+	// reason code and property
+	return 1 + this.propset.Size()
+}
+
+// Size returns the length of the encoded packet
+func (this *Disconnect) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *Disconnect) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
-		return nil, err
+		return err
 	}
-	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	if this.GetVersion() == MQTT50 {
+		// reason code
+		err = WriteByte(w, this.rcode.Value())
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
+			logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
+			return err
 		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+		// property
+		err = this.WriteProps(w)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
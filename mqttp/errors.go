@@ -50,7 +50,7 @@ const (
 	ErrInvalidArgs
 	ErrInvalidUtf8
 	ErrNotSupported
-	ErrINvalidProtocolName
+	ErrInvalidProtocolName
 )
 
 // Error returns the corresponding error string for the ConnAckCode
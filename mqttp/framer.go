@@ -0,0 +1,216 @@
+package mqttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wonderivan/logger"
+)
+
+// framerBufferSize is the read buffer of a Decoder, large enough for the
+// fixed header and the body of most packets
+const framerBufferSize = 4096
+
+// frameClasses are the capacities of the pooled frames, larger frames are
+// allocated for the packet and left to the garbage collector
+var frameClasses = [...]int{256, 1024, 4096, 16384, 65536}
+
+var framePools [len(frameClasses)]sync.Pool
+
+// frame holds the variable header and payload of one packet. A Publish
+// decoded from a frame refers to it for its payload, the frame goes back
+// to its pool when the last reference is released.
+type frame struct {
+	buf  []byte
+	refs int32
+	pool *sync.Pool // nil for frames too large to pool
+}
+
+// getFrame returns a frame of n bytes with one reference
+func getFrame(n int) *frame {
+	for i, size := range frameClasses {
+		if n > size {
+			continue
+		}
+		f, _ := framePools[i].Get().(*frame)
+		if f == nil {
+			f = &frame{buf: make([]byte, size), pool: &framePools[i]}
+		}
+		f.buf = f.buf[:n]
+		f.refs = 1
+		return f
+	}
+	return &frame{buf: make([]byte, n), refs: 1}
+}
+
+// retain takes another reference to the frame
+func (this *frame) retain() {
+	atomic.AddInt32(&this.refs, 1)
+}
+
+// release drops a reference, the last one puts the frame back into its pool
+func (this *frame) release() {
+	if atomic.AddInt32(&this.refs, -1) == 0 && this.pool != nil {
+		this.buf = this.buf[:cap(this.buf)]
+		this.pool.Put(this)
+	}
+}
+
+// byteReader is what the framer needs to read the fixed header byte by
+// byte without a read call per byte
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// unbufferedReader reads single bytes without reading ahead, for readers
+// the framer does not own
+type unbufferedReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (this *unbufferedReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(this.Reader, this.b[:])
+	return this.b[0], err
+}
+
+// framer splits a stream into packets
+type framer struct {
+	r byteReader
+}
+
+// newFramer returns a framer owning r, it reads ahead through a bufio.Reader
+// unless r can read single bytes itself
+func newFramer(r io.Reader) *framer {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReaderSize(r, framerBufferSize)
+	}
+	return &framer{r: br}
+}
+
+// header reads the fixed header of the next packet. A packet larger than
+// max bytes is refused before its body is read, max 0 means no limit.
+func (this *framer) header(max uint32) (fh byte, remLen uint32, err error) {
+	fh, err = this.r.ReadByte()
+	if err != nil {
+		logger.Error(err.Error())
+		return 0, 0, err
+	}
+
+	remLen, err = readUvarint(this.r)
+	if err != nil {
+		logger.Error(err.Error())
+		return 0, 0, CodeMalformedPacket
+	}
+	if remLen > uint32(maxRemainingLength) {
+		logger.Error(fmt.Sprintf("Remaining length %d exceeds %d", remLen, maxRemainingLength))
+		return 0, 0, CodeMalformedPacket
+	}
+	if max > 0 && uint64(1+vlen(remLen))+uint64(remLen) > uint64(max) {
+		logger.Error(fmt.Sprintf("Packet of %d bytes exceeds maximum packet size %d", remLen, max))
+		return 0, 0, CodePacketTooLarge
+	}
+	return fh, remLen, nil
+}
+
+// body reads remLen bytes into a pooled frame. A packet larger than the
+// pooled frames is read into a buffer grown as the data arrives, so that
+// a Remaining Length alone does not make the framer allocate its size.
+func (this *framer) body(remLen uint32) (*frame, error) {
+	n := int(remLen)
+	chunk := frameClasses[len(frameClasses)-1]
+	if n <= chunk {
+		f := getFrame(n)
+		_, err := io.ReadFull(this.r, f.buf)
+		if err != nil {
+			logger.Error(err.Error())
+			f.release()
+			return nil, CodeMalformedPacket
+		}
+		return f, nil
+	}
+
+	buf := make([]byte, 0, 2*chunk)
+	for len(buf) < n {
+		if len(buf) == cap(buf) {
+			size := 2 * cap(buf)
+			if size > n {
+				size = n
+			}
+			grown := make([]byte, len(buf), size)
+			copy(grown, buf)
+			buf = grown
+		}
+		end := cap(buf)
+		if end > n {
+			end = n
+		}
+		_, err := io.ReadFull(this.r, buf[len(buf):end])
+		if err != nil {
+			logger.Error(err.Error())
+			return nil, CodeMalformedPacket
+		}
+		buf = buf[:end]
+	}
+	return &frame{buf: buf, refs: 1}, nil
+}
+
+// decode reads the next packet for protocol level v. A Publish keeps the
+// frame for its payload until it is released, the frame of any other
+// packet goes back to the pool as soon as it is unpacked.
+func (this *framer) decode(v byte, max uint32) (Packet, error) {
+	fh, remLen, err := this.header(max)
+	if err != nil {
+		return nil, err
+	}
+
+	pktype := PKType(fh & maskType >> 4)
+	flags := fh & maskFlags
+	pkt, err := NewPacket(v, pktype, flags)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	f, err := this.body(remLen)
+	if err != nil {
+		return nil, err
+	}
+	err = pkt.Unpack(f.buf)
+	if pub, ok := pkt.(*Publish); ok && err == nil {
+		pub.frame = f
+		return pub, nil
+	}
+	f.release()
+	if err == CodeUnsupportedProtocol {
+		// CONNECT with the protocol level it asked for
+		return pkt, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// readUvarint reads a Variable Byte Integer of at most four bytes
+func readUvarint(r io.ByteReader) (uint32, error) {
+	var x uint32
+	var shift uint32
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		x |= uint32(b&0x7f) << shift
+		if b < 0x80 {
+			return x, nil
+		}
+		shift += 7
+	}
+	return 0, ErrMalformedStream
+}
@@ -0,0 +1,100 @@
+package mqttp
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestDecoderMaxPacketSize(t *testing.T) {
+	pub := NewPublish()
+	pub.SetTopic("a/b")
+	pub.SetPayload(make([]byte, 100))
+	size := uint32(pub.Size())
+
+	tests := []struct {
+		name string
+		max  uint32
+		want error
+	}{
+		{"no limit", 0, nil},
+		{"exact", size, nil},
+		{"one byte short", size - 1, CodePacketTooLarge},
+		{"tiny", 10, CodePacketTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(encode(t, MQTT311, pub)))
+			dec.SetVersion(MQTT311)
+			dec.SetMaxPacketSize(tt.max)
+			_, err := dec.Decode()
+			if err != tt.want {
+				t.Errorf("err %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// headerOnly is a fixed header claiming remLen bytes of PUBLISH which never
+// arrive
+func headerOnly(remLen uint32) io.Reader {
+	var buff bytes.Buffer
+	writeFixedHeader(&buff, PUBLISH.ToByte()<<4, int(remLen))
+	return &buff
+}
+
+func TestDecoderCapsFirstPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    uint32
+		remLen uint32
+		want   error
+	}{
+		{"over the cap", 0, MaxConnectSize, CodePacketTooLarge},
+		{"over a larger limit", 64 * 1024 * 1024, MaxConnectSize, CodePacketTooLarge},
+		{"under the cap", 0, 1000, CodeMalformedPacket}, // the body never arrives
+		{"smaller limit applies", 500, 1000, CodePacketTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(headerOnly(tt.remLen))
+			dec.SetMaxPacketSize(tt.max)
+			_, err := dec.Decode()
+			if err != tt.want {
+				t.Errorf("err %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFramerGrowsLargePackets(t *testing.T) {
+	// a Remaining Length of 200 MB with no data behind it must not
+	// allocate 200 MB
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	dec := NewDecoder(headerOnly(200 * 1024 * 1024))
+	dec.SetVersion(MQTT311)
+	if _, err := dec.Decode(); err != CodeMalformedPacket {
+		t.Fatalf("err %v, want %v", err, CodeMalformedPacket)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1024*1024 {
+		t.Errorf("allocated %d bytes for a packet that never arrived", n)
+	}
+
+	for _, n := range []int{64*1024 - 10, 64 * 1024, 200 * 1024, 1024*1024 + 7} {
+		pub := NewPublish()
+		pub.SetTopic("big")
+		payload := make([]byte, n)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		pub.SetPayload(payload)
+		got := roundTrip(t, MQTT311, pub).(*Publish)
+		if !bytes.Equal(got.Payload(), payload) {
+			t.Errorf("payload of %d bytes differs after decoding", n)
+		}
+		got.Release()
+	}
+}
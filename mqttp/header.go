@@ -1,8 +1,5 @@
 package mqttp
 import (
-	"bytes"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 )
@@ -30,7 +27,10 @@ func (h *Header) GetType() PKType {
 
 // Set the Packet Type 
 func (h *Header) SetType(t PKType) {
-	h.pktype = t
+	h.ptype = t
+	if h.propset != nil {
+		h.propset.ptype = t
+	}
 }
 
 // Type returns the Packet ID
@@ -95,55 +95,34 @@ func (h *Header) ParseFlags(flags byte) {
 	h.retain = flags & maskRetain > 0
 }
 
+// Props returns the packet properties
+func (h *Header) Props() *PropertySet {
+	return h.propset
+}
+
+// WillProps returns the will properties of CONNECT
+func (h *Header) WillProps() *PropertySet {
+	return h.willpropset
+}
+
 // Reset Properties
 func (h *Header) ResetProps() {
-	h.propset = &PropertySet{ props: make(PropertyMap) }
+	h.propset = &PropertySet{ptype: h.ptype, props: make(PropertyMap)}
 }
 
 // Reset Will Properties
 func (h *Header) ResetWillProps() {
-	h.willpropset = &PropertySet{ props: make(PropertyMap) }
+	h.willpropset = &PropertySet{ptype: PUBLISH, props: make(PropertyMap)}
 }
 
-// Pack Props 
-func (h *Header) WriterProps(w io.Writer) error {
-	packBytes := h.propset.PackProps(h.ptype)
-	if packBytes == nil {
-		return errors.New(fmt.Sprintf("There is no property (packet type: 0x%d)", h.ptype))
-	}
-
-	pplen := len(packBytes)
-	// write property lenght
-	err := WriteUvarint(w, uint32(pplen))
-	if err != nil {
-		return err
-	}
-
-	// write property payload
-	_, err := w.Write(packBytes)
-
-	return err
+// WriteProps writes the Property Length and the properties
+func (h *Header) WriteProps(w io.Writer) error {
+	return h.propset.EncodeTo(w)
 }
 
-// Pack Will Props 
+// WriteWillProps writes the Property Length and the will properties
 func (h *Header) WriteWillProps(w io.Writer) error {
-	packBytes := h.willpropset.PackProps(h.ptype)
-	if package == nil {
-		return errors.New(fmt.Sprintf("There is no property (packet type: 0x%d)", h.ptype))
-	}
-
-	pplen := len(packBytes)
-	// write property lenght
-	err := WriteUvarint(w, uint32(pplen))
-	if err != nil {
-		return err
-	}
-
-	// write property payload
-	_, err := w.Write(packBytes)
-
-	return err
-
+	return h.willpropset.EncodeTo(w)
 }
 
 // Unpack Props
@@ -156,12 +135,12 @@ func (h *Header) ReadProps(r io.Reader) error {
 // Unpack Will Props
 func (h *Header) ReadWillProps(r io.Reader) error {
 	h.ResetWillProps()
-	err := h.willpropset.UnpackProps(r, h.ptype) 
+	err := h.willpropset.UnpackProps(r, PUBLISH)
 	return err
 }
 
 func (h *Header) SubOpsValid(ops byte) bool {
-	if h.version == MQTT311 {
+	if h.version < MQTT50 {
 		return ops & maskSubscriptionReservedV3 < 3
 	}
 	if ops & maskSubscriptionReservedV5 > 0 {
@@ -174,4 +153,9 @@ func (h *Header) SubOpsValid(ops byte) bool {
 		return false
 	}
     return true
-}
\ No newline at end of file
+}
+// String returns the packet type and the fixed header fields, for logging
+func (h *Header) String() string {
+	return fmt.Sprintf("%s: version=%d pid=%d dup=%t qos=%d retain=%t",
+		h.ptype.Name(), h.version, h.pid, h.dup, h.qos, h.retain)
+}
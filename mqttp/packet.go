@@ -10,6 +10,15 @@ import (
 const (
 	// maxFixedHeaderLength int    = 5
 	maxRemainingLength int32 = (256 * 1024 * 1024) - 1 // 256 MB
+
+	// MaxPacketSize is the size of the largest packet the remaining
+	// length can describe, fixed header included
+	MaxPacketSize uint32 = 1 + 4 + uint32(maxRemainingLength)
+
+	// MaxConnectSize limits the packet a Decoder reads before CONNECT, it
+	// leaves room for the five strings of the CONNECT payload and the
+	// properties of MQTT 5.0
+	MaxConnectSize uint32 = 1024 * 1024
 )
 const (
 	//  maskHeaderType  byte = 0xF0
@@ -19,34 +28,35 @@ const (
 )
 
 type Packet interface {
-	Pack() (byte[], error)
-	Unpack(rdata byte[]) error
+	Size() int
+	EncodeTo(w io.Writer) error
+	Unpack(rdata []byte) error
 
 	String() string
 
 	GetVersion() byte
 	SetVersion(v byte)
 
-	GetType() byte
-	SetType(t byte)
+	GetType() PKType
+	SetType(t PKType)
 
 	GetPacketID() uint16
 	SetPacketID(id uint16)
 
-	GetQoS() byte
+	GetQos() byte
 	SetQos(q byte)
 
-	IsDup() bool
+	GetDup() bool
 	SetDup(b bool)
 
-	IsRetain() bool
+	GetRetain() bool
 	SetRetain(b bool)
 
-//	GetRemLen() int32
-//	SetRemLen(l int32)
-
 	GetFixedHeaderFirstByte() byte
-	ParseFlags(flags byte) 
+	ParseFlags(flags byte)
+
+	Props() *PropertySet
+	WillProps() *PropertySet
 
 	ResetProps()
 	ResetWillProps()
@@ -56,7 +66,6 @@ type Packet interface {
 
 	WriteWillProps(io.Writer) error
 	ReadWillProps(io.Reader) error
-
 }
 
 func NewPacket(v byte, t PKType, flags byte) (Packet, error) {
@@ -100,7 +109,7 @@ func NewPacket(v byte, t PKType, flags byte) (Packet, error) {
 	}
 
 	if t != PUBLISH {
-		dflags := DefaultFlags(t)
+		dflags := t.DefaultFlags()
 		if flags != dflags {
 			return nil, ErrMalformedStream
 		}
@@ -116,71 +125,58 @@ func NewPacket(v byte, t PKType, flags byte) (Packet, error) {
 // ReadPacket takes an instance of an io.Reader (such as net.Conn) and attempts
 // to read an MQTT packet from the stream. It returns a Packet
 // representing the decoded MQTT packet and an error. One of these returns will
-// always be nil, a nil Packet indicating an error occurred.
+// be nil, except for a CONNECT of an unsupported protocol level which is
+// returned together with CodeUnsupportedProtocol so that it can be answered
+// with CONNACK.
+// The protocol level is not known here, use a Decoder to read the packets
+// of a connection after CONNECT and to limit their size. r is not read
+// beyond the packet.
 func ReadPacket(r io.Reader) (Packet, error) {
-	buffer := make([]byte, 1)
-	_, err := io.ReadFull(r, buffer)
-	
-	if err != nil {
-		logger.Error(err.Error())
-		return nil, CodeMalformedPacket
+	br, ok := r.(byteReader)
+	if !ok {
+		br = &unbufferedReader{Reader: r}
 	}
+	f := framer{r: br}
+	return f.decode(TBD, 0)
+}
 
-	pktype := PKType(buffer[0] & maskType >> 4)
-	flags :=  buffer[0] & maskFlags
-
-	remLen, err := ReadUvarint(r)
-	if err != nil {
-		logger.Error(err.Error())
-		return nil, CodeMalformedPacket
-	}
-
-	pkt, err := NewPacket(TBD, pktype, flags)
-
-	if err != nil {
-		logger.Error(err.Error())
-		return nil, err
-	}
-
-	rdata := make([]byte, remLen)
-	n, err := io.ReadFull(r, rdata)
-	if err != nil {
-		logger.Error(err.Error())
-		return nil, CodeMalformedPacket
-	}
-	if n != remLen {
-		logger.Error("failed to read remained data")
-		return nil, CodeMalformedPacket
-	}
-
-	err = pkt.Unpack(rdata)
-
-	return pkt, err
+// packetSize returns the length of an encoded packet whose variable header
+// and payload are remlen bytes long
+func packetSize(remlen int) int {
+	return 1 + vlen(uint32(remlen)) + remlen
 }
 
-func WritePacket(w io.Writer, pkt Packet) error {
-	data, err := pkt.Pack()
-	if err != nil {
-		return err
+// writeFixedHeader writes the first byte fh and the remaining length of a packet
+func writeFixedHeader(w io.Writer, fh byte, remlen int) error {
+	if remlen > int(maxRemainingLength) {
+		logger.Error(fmt.Sprintf("Remaining length %d exceeds %d", remlen, maxRemainingLength))
+		return CodePacketTooLarge
 	}
 
 	// fixed header 1th byte
-	fh := pkt.GetFixedHeaderFirstByte()
-	err = WriteByte(w, fh)
+	err := WriteByte(w, fh)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding fixed header: %s", err))
 		return err
 	}
 
-	// fixed remaining lenght field
-	remlen := len(data)
+	// fixed remaining length field
 	err = WriteUvarint(w, uint32(remlen))
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error encoding remianing lenght: %s", err))
+		logger.Error(fmt.Sprintf("Error encoding remaining length: %s", err))
+		return err
+	}
+	return nil
+}
+
+// WritePacket encodes pkt into a buffer of its exact size and writes it to
+// w with a single call
+func WritePacket(w io.Writer, pkt Packet) error {
+	buff := bytes.NewBuffer(make([]byte, 0, pkt.Size()))
+	err := pkt.EncodeTo(buff)
+	if err != nil {
 		return err
 	}
-	
-	// data
-	m, err := w.Write(data)
+	_, err = w.Write(buff.Bytes())
 	return err
 }
@@ -0,0 +1,183 @@
+package mqttp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// encode returns the bytes of pkt at protocol level v
+func encode(t *testing.T, v byte, pkt Packet) []byte {
+	t.Helper()
+	var buff bytes.Buffer
+	enc := NewEncoder(&buff)
+	if _, ok := pkt.(*Connect); !ok {
+		enc.SetVersion(v)
+	}
+	if err := enc.Encode(pkt); err != nil {
+		t.Fatalf("encode %s: %s", pkt.GetType().Name(), err)
+	}
+	return buff.Bytes()
+}
+
+func testPackets(v byte) []Packet {
+	connect := NewConnect()
+	connect.SetVersion(v)
+	connect.SetClean(true)
+	connect.SetKeepAlive(60)
+	connect.SetClientID("client-1")
+	connect.SetCredentials("user", "secret")
+
+	connack := NewConnAck()
+	connack.SetSessionPresent(true)
+
+	pub0 := NewPublish()
+	pub0.SetTopic("a/b")
+	pub0.SetPayload([]byte("qos 0"))
+
+	pub2 := NewPublish()
+	pub2.SetQos(QoS2)
+	pub2.SetRetain(true)
+	pub2.SetDup(true)
+	pub2.SetPacketID(10)
+	pub2.SetTopic("a/c")
+	pub2.SetPayload(bytes.Repeat([]byte{0xAB}, 300))
+
+	puback := NewPubAck()
+	puback.SetPacketID(10)
+	pubrec := NewPubRec()
+	pubrec.SetPacketID(11)
+	pubrel := NewPubRel()
+	pubrel.SetPacketID(12)
+	pubcomp := NewPubComp()
+	pubcomp.SetPacketID(13)
+
+	sub := NewSubscribe()
+	sub.SetPacketID(14)
+	sub.AddTopic("a/+", SubOps(QoS1))
+	sub.AddTopic("b/#", SubOps(QoS2))
+
+	suback := NewSubAck()
+	suback.SetPacketID(14)
+	suback.AddReasonCode(ReasonCode(QoS1))
+	suback.AddReasonCode(ReasonCode(QoS2))
+
+	unsub := NewUnSubscribe()
+	unsub.SetPacketID(15)
+	unsub.TopicList = append(unsub.TopicList, "a/+", "b/#")
+
+	unsuback := NewUnSubAck()
+	unsuback.SetPacketID(15)
+
+	pkts := []Packet{connect, connack, pub0, pub2, puback, pubrec, pubrel, pubcomp,
+		sub, suback, unsub, unsuback, NewPingReq(), NewPingResp(), NewDisconnect()}
+
+	if v == MQTT50 {
+		connect.Props().SetSessionExpiryInterval(3600)
+		connect.Props().SetReceiveMaximum(20)
+		connack.Props().SetAssignedClientIdentifier("assigned")
+		connack.Props().SetMaximumPacketSize(1 << 20)
+		pub2.Props().SetMessageExpiryInterval(120)
+		pub2.Props().AddUserProperty("k", "v")
+		pub2.Props().SetPayloadFormatIndicator(0)
+		sub.Props().AddSubscriptionIdentifier(7)
+		unsuback.AddReasonCode(CodeSuccess)
+		unsuback.AddReasonCode(CodeNoSubscriptionExisted)
+		auth := NewAuth()
+		auth.SetReasonCode(CodeContinueAuthentication)
+		auth.Props().SetAuthenticationMethod("SCRAM-SHA-1")
+		pkts = append(pkts, auth)
+	}
+	return pkts
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, v := range []byte{MQTT311, MQTT50} {
+		for _, pkt := range testPackets(v) {
+			t.Run(pkt.GetType().Name()+"/"+string('0'+v), func(t *testing.T) {
+				want := encode(t, v, pkt)
+				got := roundTrip(t, v, pkt)
+				if got.GetType() != pkt.GetType() {
+					t.Fatalf("decoded %s", got.GetType().Name())
+				}
+				// encoding is deterministic, the decoded packet gives
+				// the same bytes
+				if again := encode(t, v, got); !bytes.Equal(again, want) {
+					t.Errorf("re-encoded\n% X\nwant\n% X", again, want)
+				}
+			})
+		}
+	}
+}
+
+func TestWritePacketSize(t *testing.T) {
+	for _, pkt := range testPackets(MQTT50) {
+		pkt.SetVersion(MQTT50)
+		var buff bytes.Buffer
+		if err := WritePacket(&buff, pkt); err != nil {
+			t.Fatalf("%s: %s", pkt.GetType().Name(), err)
+		}
+		if buff.Len() != pkt.Size() {
+			t.Errorf("%s wrote %d bytes, Size() is %d", pkt.GetType().Name(), buff.Len(), pkt.Size())
+		}
+	}
+}
+
+func TestPacketEncoding(t *testing.T) {
+	pub := NewPublish()
+	pub.SetQos(QoS1)
+	pub.SetPacketID(1)
+	pub.SetTopic("t")
+	pub.SetPayload([]byte("x"))
+
+	rel := NewPubRel()
+	rel.SetPacketID(2)
+
+	tests := []struct {
+		name string
+		v    byte
+		pkt  Packet
+		want []byte
+	}{
+		{"publish v3", MQTT311, pub, []byte{0x32, 6, 0, 1, 't', 0, 1, 'x'}},
+		{"publish v5", MQTT50, pub, []byte{0x32, 7, 0, 1, 't', 0, 1, 0, 'x'}},
+		{"pubrel v3", MQTT311, rel, []byte{0x62, 2, 0, 2}},
+		{"pingreq", MQTT311, NewPingReq(), []byte{0xC0, 0}},
+		{"disconnect v3", MQTT311, NewDisconnect(), []byte{0xE0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encode(t, tt.v, tt.pkt); !bytes.Equal(got, tt.want) {
+				t.Errorf("encoded % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPropertiesEncodedInIDOrder(t *testing.T) {
+	props := &PropertySet{ptype: PUBLISH, props: make(PropertyMap)}
+	props.AddUserProperty("k", "v")
+	props.SetContentType("c")
+	props.SetPayloadFormatIndicator(1)
+	props.AddSubscriptionIdentifier(5)
+
+	want := []PropertyID{Payload_Format_Indicator, Content_Type, Subscription_Identifier, User_Property}
+	if !reflect.DeepEqual(props.ids, want) {
+		t.Fatalf("ids %v, want %v", props.ids, want)
+	}
+
+	var buff bytes.Buffer
+	if err := props.EncodeTo(&buff); err != nil {
+		t.Fatal(err)
+	}
+	if buff.Len() != props.Size() {
+		t.Errorf("encoded %d bytes, Size() is %d", buff.Len(), props.Size())
+	}
+	decoded := &PropertySet{ptype: PUBLISH, props: make(PropertyMap)}
+	if err := decoded.UnpackProps(&buff, PUBLISH); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.ids, want) {
+		t.Errorf("decoded ids %v, want %v", decoded.ids, want)
+	}
+}
@@ -1,24 +1,18 @@
 package mqttp
 
 import (
-	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
-	"bytes"
 	"io"
-	"fmt"
-	"time"
 )
 
 type PingReq struct {
-	header
+	Header
 }
 
 var _ Packet = (*PingReq)(nil)
 
 func NewPingReq() *PingReq {
 	p := &PingReq{}
+	p.SetType(PINGREQ)
 	return p
 }
 
@@ -26,6 +20,13 @@ func (this *PingReq) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *PingReq) Pack() ([]byte, error) {
-	return []byte{}, nil
+// Size returns the length of the encoded packet
+func (this *PingReq) Size() int {
+	return packetSize(0)
+}
+
+// EncodeTo writes the fixed header to w, the packet has no variable header
+// and no payload
+func (this *PingReq) EncodeTo(w io.Writer) error {
+	return writeFixedHeader(w, this.GetFixedHeaderFirstByte(), 0)
 }
@@ -1,31 +1,32 @@
 package mqttp
 
 import (
-	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
-	"bytes"
 	"io"
-	"fmt"
-	"time"
 )
 
 type PingResp struct {
-	header
+	Header
 }
 
 var _ Packet = (*PingResp)(nil)
 
-func NewPingReq() *PingResp {
+func NewPingResp() *PingResp {
 	p := &PingResp{}
+	p.SetType(PINGRESP)
 	return p
 }
 
-func (this *PingReq) Unpack(rdata []byte) error {
+func (this *PingResp) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *PingReq) Pack() ([]byte, error) {
-	return []byte{}, nil
+// Size returns the length of the encoded packet
+func (this *PingResp) Size() int {
+	return packetSize(0)
+}
+
+// EncodeTo writes the fixed header to w, the packet has no variable header
+// and no payload
+func (this *PingResp) EncodeTo(w io.Writer) error {
+	return writeFixedHeader(w, this.GetFixedHeaderFirstByte(), 0)
 }
@@ -1,13 +1,36 @@
 package mqttp
 
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
 type PKType byte
 
 const PRONAME string = "MQTT"
+
+// PRONAME31 is the protocol name of MQTT 3.1
+const PRONAME31 string = "MQIsdp"
+
 const (
 	TBD		byte = 0
+	MQTT31  byte = 3 // treated as MQTT 3.1.1 except in CONNECT and CONNACK
 	MQTT311 byte = 4
 	MQTT50  byte = 5
 )
+
+// protocolName returns the protocol name of CONNECT for protocol level v,
+// "" for an unknown level
+func protocolName(v byte) string {
+	switch v {
+	case MQTT31:
+		return PRONAME31
+	case MQTT311, MQTT50:
+		return PRONAME
+	}
+	return ""
+}
+
 const (
 	QoS0 byte = 0
 	QoS1 byte = 1
@@ -124,13 +147,18 @@ func IsValidTopic(s string) bool {
 	return utf8.ValidString(s) && BasicUTFRegexp.MatchString(s) && TopicPublishRegexp.MatchString(s)
 }
 
-type SubOptions byte
+type SubOps byte
 
 // QoS quality of service
 func (s SubOps) QoS() byte {
 	return byte(s) & maskSubscriptionQoS
 }
 
+// WithQoS returns the options with the QoS replaced
+func (s SubOps) WithQoS(qos byte) SubOps {
+	return SubOps(byte(s)&^maskSubscriptionQoS | qos&maskSubscriptionQoS)
+}
+
 // Raw just return byte
 func (s SubOps) Raw() byte {
 	return byte(s)
@@ -0,0 +1,477 @@
+package mqttp
+
+// Typed accessors of the MQTT 5.0 properties [MQTT-2.2.2]. Getters report
+// whether the property is present, setters replace its value and return
+// ErrPropertyPacketTypeMismatch when the packet type does not allow it.
+
+// get returns the value of a property which occurs once
+func (this *PropertySet) get(id PropertyID) (PropertyValue, bool) {
+	v, ok := this.props[id]
+	return v, ok
+}
+
+// set replaces the value of a property which occurs once
+func (this *PropertySet) set(id PropertyID, v PropertyValue) error {
+	if !IsValidPacketType4Prop(id, this.ptype) {
+		return ErrPropertyPacketTypeMismatch
+	}
+	this.put(id, v)
+	return nil
+}
+
+// add appends a value of a property which may occur more than once
+func (this *PropertySet) add(id PropertyID, v PropertyValue) error {
+	if !IsValidPacketType4Prop(id, this.ptype) {
+		return ErrPropertyPacketTypeMismatch
+	}
+	if !MultiAllowedProperty(id, this.ptype) {
+		this.put(id, v)
+		return nil
+	}
+	list, _ := this.props[id].([]PropertyValue)
+	this.put(id, append(list, v))
+	return nil
+}
+
+// list returns the values of a property which may occur more than once
+func (this *PropertySet) list(id PropertyID) []PropertyValue {
+	switch v := this.props[id].(type) {
+	case nil:
+		return nil
+	case []PropertyValue:
+		return v
+	default:
+		return []PropertyValue{v}
+	}
+}
+
+// Type returns the packet type the properties belong to
+func (this *PropertySet) Type() PKType {
+	return this.ptype
+}
+
+// PayloadFormatIndicator is 0 for unspecified bytes, 1 for UTF-8 encoded character data
+func (this *PropertySet) PayloadFormatIndicator() (byte, bool) {
+	v, ok := this.get(Payload_Format_Indicator)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetPayloadFormatIndicator sets the Payload Format Indicator
+func (this *PropertySet) SetPayloadFormatIndicator(v byte) error {
+	return this.set(Payload_Format_Indicator, v)
+}
+
+// MessageExpiryInterval is the lifetime of a PUBLISH in seconds
+func (this *PropertySet) MessageExpiryInterval() (uint32, bool) {
+	v, ok := this.get(Message_Expiry_Interval)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint32)
+	return t, ok
+}
+
+// SetMessageExpiryInterval sets the Message Expiry Interval
+func (this *PropertySet) SetMessageExpiryInterval(v uint32) error {
+	return this.set(Message_Expiry_Interval, v)
+}
+
+// ContentType describes the content of a PUBLISH
+func (this *PropertySet) ContentType() (string, bool) {
+	v, ok := this.get(Content_Type)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// SetContentType sets the Content Type
+func (this *PropertySet) SetContentType(v string) error {
+	return this.set(Content_Type, v)
+}
+
+// ResponseTopic is the topic name for a response message
+func (this *PropertySet) ResponseTopic() (string, bool) {
+	v, ok := this.get(Response_Topic)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// SetResponseTopic sets the Response Topic
+func (this *PropertySet) SetResponseTopic(v string) error {
+	return this.set(Response_Topic, v)
+}
+
+// CorrelationData identifies the request a response is for
+func (this *PropertySet) CorrelationData() ([]byte, bool) {
+	v, ok := this.get(Correlation_Data)
+	if !ok {
+		return nil, false
+	}
+	t, ok := v.([]byte)
+	return t, ok
+}
+
+// SetCorrelationData sets the Correlation Data
+func (this *PropertySet) SetCorrelationData(v []byte) error {
+	return this.set(Correlation_Data, v)
+}
+
+// SessionExpiryInterval is how long the session is kept after the network
+// connection closes, in seconds
+func (this *PropertySet) SessionExpiryInterval() (uint32, bool) {
+	v, ok := this.get(Session_Expiry_Interval)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint32)
+	return t, ok
+}
+
+// SetSessionExpiryInterval sets the Session Expiry Interval
+func (this *PropertySet) SetSessionExpiryInterval(v uint32) error {
+	return this.set(Session_Expiry_Interval, v)
+}
+
+// AssignedClientIdentifier is the client ID assigned by the server
+func (this *PropertySet) AssignedClientIdentifier() (string, bool) {
+	v, ok := this.get(Assigned_Client_Identifier)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// SetAssignedClientIdentifier sets the Assigned Client Identifier
+func (this *PropertySet) SetAssignedClientIdentifier(v string) error {
+	return this.set(Assigned_Client_Identifier, v)
+}
+
+// ServerKeepAlive replaces the Keep Alive of CONNECT, in seconds
+func (this *PropertySet) ServerKeepAlive() (uint16, bool) {
+	v, ok := this.get(Server_Keep_Alive)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint16)
+	return t, ok
+}
+
+// SetServerKeepAlive sets the Server Keep Alive
+func (this *PropertySet) SetServerKeepAlive(v uint16) error {
+	return this.set(Server_Keep_Alive, v)
+}
+
+// AuthenticationMethod names the extended authentication method
+func (this *PropertySet) AuthenticationMethod() (string, bool) {
+	v, ok := this.get(Authentication_Method)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// SetAuthenticationMethod sets the Authentication Method
+func (this *PropertySet) SetAuthenticationMethod(v string) error {
+	return this.set(Authentication_Method, v)
+}
+
+// AuthenticationData is the data of the extended authentication
+func (this *PropertySet) AuthenticationData() ([]byte, bool) {
+	v, ok := this.get(Authentication_Data)
+	if !ok {
+		return nil, false
+	}
+	t, ok := v.([]byte)
+	return t, ok
+}
+
+// SetAuthenticationData sets the Authentication Data
+func (this *PropertySet) SetAuthenticationData(v []byte) error {
+	return this.set(Authentication_Data, v)
+}
+
+// RequestProblemInformation asks for Reason String and User Properties on failures
+func (this *PropertySet) RequestProblemInformation() (byte, bool) {
+	v, ok := this.get(Request_Problem_Information)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetRequestProblemInformation sets the Request Problem Information
+func (this *PropertySet) SetRequestProblemInformation(v byte) error {
+	return this.set(Request_Problem_Information, v)
+}
+
+// WillDelayInterval delays the will message, in seconds
+func (this *PropertySet) WillDelayInterval() (uint32, bool) {
+	v, ok := this.get(Will_Delay_Interval)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint32)
+	return t, ok
+}
+
+// SetWillDelayInterval sets the Will Delay Interval
+func (this *PropertySet) SetWillDelayInterval(v uint32) error {
+	return this.set(Will_Delay_Interval, v)
+}
+
+// RequestResponseInformation asks for Response Information in CONNACK
+func (this *PropertySet) RequestResponseInformation() (byte, bool) {
+	v, ok := this.get(Request_Response_Information)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetRequestResponseInformation sets the Request Response Information
+func (this *PropertySet) SetRequestResponseInformation(v byte) error {
+	return this.set(Request_Response_Information, v)
+}
+
+// ResponseInformation is the basis of response topics
+func (this *PropertySet) ResponseInformation() (string, bool) {
+	v, ok := this.get(Response_Information)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// SetResponseInformation sets the Response Information
+func (this *PropertySet) SetResponseInformation(v string) error {
+	return this.set(Response_Information, v)
+}
+
+// ServerReference names another server to use
+func (this *PropertySet) ServerReference() (string, bool) {
+	v, ok := this.get(Server_Reference)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// SetServerReference sets the Server Reference
+func (this *PropertySet) SetServerReference(v string) error {
+	return this.set(Server_Reference, v)
+}
+
+// ReasonString is a human readable reason for diagnostics
+func (this *PropertySet) ReasonString() (string, bool) {
+	v, ok := this.get(Reason_String)
+	if !ok {
+		return "", false
+	}
+	t, ok := v.(string)
+	return t, ok
+}
+
+// SetReasonString sets the Reason String
+func (this *PropertySet) SetReasonString(v string) error {
+	return this.set(Reason_String, v)
+}
+
+// ReceiveMaximum is the number of QoS 1 and 2 messages processed at once
+func (this *PropertySet) ReceiveMaximum() (uint16, bool) {
+	v, ok := this.get(Receive_Maximum)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint16)
+	return t, ok
+}
+
+// SetReceiveMaximum sets the Receive Maximum
+func (this *PropertySet) SetReceiveMaximum(v uint16) error {
+	return this.set(Receive_Maximum, v)
+}
+
+// TopicAliasMaximum is the highest Topic Alias accepted
+func (this *PropertySet) TopicAliasMaximum() (uint16, bool) {
+	v, ok := this.get(Topic_Alias_Maximum)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint16)
+	return t, ok
+}
+
+// SetTopicAliasMaximum sets the Topic Alias Maximum
+func (this *PropertySet) SetTopicAliasMaximum(v uint16) error {
+	return this.set(Topic_Alias_Maximum, v)
+}
+
+// TopicAlias stands for the topic name of a PUBLISH
+func (this *PropertySet) TopicAlias() (uint16, bool) {
+	v, ok := this.get(Topic_Alias)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint16)
+	return t, ok
+}
+
+// SetTopicAlias sets the Topic Alias
+func (this *PropertySet) SetTopicAlias(v uint16) error {
+	return this.set(Topic_Alias, v)
+}
+
+// MaximumQoS is the highest QoS the server supports
+func (this *PropertySet) MaximumQoS() (byte, bool) {
+	v, ok := this.get(Maximum_QoS)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetMaximumQoS sets the Maximum QoS
+func (this *PropertySet) SetMaximumQoS(v byte) error {
+	return this.set(Maximum_QoS, v)
+}
+
+// RetainAvailable is 0 when the server does not support retained messages
+func (this *PropertySet) RetainAvailable() (byte, bool) {
+	v, ok := this.get(Retain_Available)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetRetainAvailable sets the Retain Available
+func (this *PropertySet) SetRetainAvailable(v byte) error {
+	return this.set(Retain_Available, v)
+}
+
+// MaximumPacketSize is the largest packet accepted, in bytes
+func (this *PropertySet) MaximumPacketSize() (uint32, bool) {
+	v, ok := this.get(Maximum_Packet_Size)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(uint32)
+	return t, ok
+}
+
+// SetMaximumPacketSize sets the Maximum Packet Size
+func (this *PropertySet) SetMaximumPacketSize(v uint32) error {
+	return this.set(Maximum_Packet_Size, v)
+}
+
+// WildcardSubscriptionAvailable is 0 when the server does not support wildcard filters
+func (this *PropertySet) WildcardSubscriptionAvailable() (byte, bool) {
+	v, ok := this.get(Wildcard_Subscription_Available)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetWildcardSubscriptionAvailable sets the Wildcard Subscription Available
+func (this *PropertySet) SetWildcardSubscriptionAvailable(v byte) error {
+	return this.set(Wildcard_Subscription_Available, v)
+}
+
+// SubscriptionIdentifierAvailable is 0 when the server does not support Subscription Identifiers
+func (this *PropertySet) SubscriptionIdentifierAvailable() (byte, bool) {
+	v, ok := this.get(Subscription_Identifier_Available)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetSubscriptionIdentifierAvailable sets the Subscription Identifier Available
+func (this *PropertySet) SetSubscriptionIdentifierAvailable(v byte) error {
+	return this.set(Subscription_Identifier_Available, v)
+}
+
+// SharedSubscriptionAvailable is 0 when the server does not support shared subscriptions
+func (this *PropertySet) SharedSubscriptionAvailable() (byte, bool) {
+	v, ok := this.get(Shared_Subscription_Available)
+	if !ok {
+		return 0, false
+	}
+	t, ok := v.(byte)
+	return t, ok
+}
+
+// SetSharedSubscriptionAvailable sets the Shared Subscription Available
+func (this *PropertySet) SetSharedSubscriptionAvailable(v byte) error {
+	return this.set(Shared_Subscription_Available, v)
+}
+
+// SubscriptionIdentifiers returns the Subscription Identifiers of a
+// PUBLISH or SUBSCRIBE
+func (this *PropertySet) SubscriptionIdentifiers() []uint32 {
+	var ids []uint32
+	for _, v := range this.list(Subscription_Identifier) {
+		if id, ok := v.(uint32); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// AddSubscriptionIdentifier adds a Subscription Identifier, PUBLISH may
+// carry several of them
+func (this *PropertySet) AddSubscriptionIdentifier(id uint32) error {
+	return this.add(Subscription_Identifier, id)
+}
+
+// UserProperties returns the User Properties in the order they were added
+func (this *PropertySet) UserProperties() []StringPair {
+	var pairs []StringPair
+	for _, v := range this.list(User_Property) {
+		if pair, ok := v.(StringPair); ok {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// AddUserProperty adds a User Property, the same name may occur more
+// than once
+func (this *PropertySet) AddUserProperty(k string, v string) error {
+	return this.add(User_Property, StringPair{k: k, v: v})
+}
+
+// NewStringPair returns a User Property name and value
+func NewStringPair(k string, v string) StringPair {
+	return StringPair{k: k, v: v}
+}
+
+// Key returns the name of a User Property
+func (this StringPair) Key() string {
+	return this.k
+}
+
+// Value returns the value of a User Property
+func (this StringPair) Value() string {
+	return this.v
+}
@@ -1,12 +1,12 @@
 package mqttp
 
 import (
-	"github.com/wonderivan/logger"
+	"errors"
 	"fmt"
 	"io"
-	"bytes"
-	"encoding/binary"
-	"unicode/utf8"
+	"sort"
+
+	"github.com/wonderivan/logger"
 )
 
 // PropertyID id as per [MQTT-2.2.2]
@@ -15,8 +15,10 @@ type PropertyValue interface{}
 type PropertyMap map[PropertyID] PropertyValue
 
 type PropertySet struct {
-	props propertyTypeMap
-} 
+	ptype PKType       // packet type, PUBLISH for will properties
+	props PropertyMap
+	ids   []PropertyID // IDs of props in ascending order
+}
 
 // PropertyError encodes property error
 type PropertyError int
@@ -61,34 +63,34 @@ const (
 	Shared_Subscription_Available           = PropertyID (0x2A)
 )
 
-var propertyTypeMap = map[PropertyID] byte {
-	Payload_Format_Indicator:			One_Byte
-	Message_Expiry_Interval:            Four_Byte_Integer
-	Content_Type:                    	UTF8_String
-	Response_Topic:                  	UTF8_String
-	Correlation_Data:                	Binary_Data
-	Subscription_Identifier:         	Variable_Byte_Integer
-	Session_Expiry_Interval:		    Four_Byte_Integer
-	Assigned_Client_Identifier:         UTF8_String
-	Server_Keep_Alive:                  Two_Byte_Integer
-	Authentication_Method:              UTF8_String
-	Authentication_Data:                Binary_Data
-	Request_Problem_Information:        One_Byte
-	Will_Delay_Interval:                Four_Byte_Integer
-	Request_Response_Information:       One_Byte
-	Response_Information:               UTF8_String
-	Server_Reference:                   UTF8_String
-	Reason_String:                      UTF8_String
-	Receive_Maximum:                    Two_Byte_Integer
-	Topic_Alias_Maximum:                Two_Byte_Integer
-	Topic_Alias:                        Two_Byte_Integer
-	Maximum_QoS:                        One_Byte
-	Retain_Available:                   One_Byte
-	User_Property:                      UTF8_String_Pair
-	Maximum_Packet_Size:                Four_Byte_Integer
-	Wildcard_Subscription_Available:    One_Byte
-	Subscription_Identifier_Available:  One_Byte
-	Shared_Subscription_Available:      One_Byte
+var propertyTypeMap = map[PropertyID]byte{
+	Payload_Format_Indicator:           One_Byte,
+	Message_Expiry_Interval:            Four_Byte_Integer,
+	Content_Type:                       UTF8_String,
+	Response_Topic:                     UTF8_String,
+	Correlation_Data:                   Binary_Data,
+	Subscription_Identifier:            Variable_Byte_Integer,
+	Session_Expiry_Interval:            Four_Byte_Integer,
+	Assigned_Client_Identifier:         UTF8_String,
+	Server_Keep_Alive:                  Two_Byte_Integer,
+	Authentication_Method:              UTF8_String,
+	Authentication_Data:                Binary_Data,
+	Request_Problem_Information:        One_Byte,
+	Will_Delay_Interval:                Four_Byte_Integer,
+	Request_Response_Information:       One_Byte,
+	Response_Information:               UTF8_String,
+	Server_Reference:                   UTF8_String,
+	Reason_String:                      UTF8_String,
+	Receive_Maximum:                    Two_Byte_Integer,
+	Topic_Alias_Maximum:                Two_Byte_Integer,
+	Topic_Alias:                        Two_Byte_Integer,
+	Maximum_QoS:                        One_Byte,
+	Retain_Available:                   One_Byte,
+	User_Property:                      UTF8_String_Pair,
+	Maximum_Packet_Size:                Four_Byte_Integer,
+	Wildcard_Subscription_Available:    One_Byte,
+	Subscription_Identifier_Available:  One_Byte,
+	Shared_Subscription_Available:      One_Byte,
 }
 
 
@@ -134,7 +136,7 @@ type StringPair struct {
 
 // propertyAllowedMessageTypes properties and their supported packets type.
 // bool flag indicates either duplicate allowed or not
-var propertyAllowedMessageTypes = map[PropertyID]map[byte]bool{
+var propertyAllowedMessageTypes = map[PropertyID]map[PKType]bool{
 	Payload_Format_Indicator:            {PUBLISH: false},
 	Message_Expiry_Interval:             {PUBLISH: false},
 	Content_Type:                        {PUBLISH: false},
@@ -170,7 +172,7 @@ var propertyAllowedMessageTypes = map[PropertyID]map[byte]bool{
 }
 
 // DupAllowed check if property id allows keys duplication
-func MultiAllowedProperty(ppid PropertyID, t byte) bool {
+func MultiAllowedProperty(ppid PropertyID, t PKType) bool {
 	d, ok := propertyAllowedMessageTypes[ppid]
 	if ok {
 		return d[t]
@@ -191,7 +193,7 @@ func GetPropertyType(ppid PropertyID) (byte, error) {
 	if t, ok := propertyTypeMap[ppid]; ok {
 		return t, nil
 	}
-	return 0, errors.New(fmt.Sprintf("Invalid Property ID: 0x%04X", ppid))
+	return 0, fmt.Errorf("Invalid Property ID: 0x%04X", ppid)
 }
 
 // Get Property data lenght
@@ -205,19 +207,19 @@ func GetPropertyLength(pptype byte, val PropertyValue) int {
 	case Four_Byte_Integer:
 		pplen = 4
 	case Variable_Byte_Integer:
-		pplen -= vlen(val.(uint32))
+		pplen = vlen(val.(uint32))
 	case UTF8_String:
 		pplen = (2 + len(val.(string)))
 	case UTF8_String_Pair:
 		pplen = (4 + len(val.(StringPair).k) + len(val.(StringPair).v))
 	case Binary_Data:
-		pplen -= (2 + len(val.([]byte)))
+		pplen = (2 + len(val.([]byte)))
     }
 	return pplen
 }
 
 // IsValidPacketType check either property id can be used for given packet type
-func IsValidPacketType4Prop(ppid PropertyID, t byte) bool {
+func IsValidPacketType4Prop(ppid PropertyID, t PKType) bool {
 	mT, ok := propertyAllowedMessageTypes[ppid]
 	if !ok {
 		return false
@@ -233,10 +235,40 @@ func IsValidPacketType4Prop(ppid PropertyID, t byte) bool {
 // reset PropertySet
 func (this *PropertySet) Reset() {
 	this.props = make(PropertyMap)
+	this.ids = this.ids[:0]
+}
+
+// put stores the value of a property and keeps ids sorted, properties are
+// always encoded in ascending order of their IDs so that the same set gives
+// the same bytes
+func (this *PropertySet) put(id PropertyID, val PropertyValue) {
+	if _, ok := this.props[id]; !ok {
+		i := sort.Search(len(this.ids), func(i int) bool { return this.ids[i] >= id })
+		this.ids = append(this.ids, 0)
+		copy(this.ids[i+1:], this.ids[i:])
+		this.ids[i] = id
+	}
+	this.props[id] = val
+}
+
+// clone returns a copy of the set, lists of multi-valued properties are
+// copied too
+func (this *PropertySet) clone() *PropertySet {
+	if this == nil {
+		return nil
+	}
+	c := &PropertySet{ptype: this.ptype, props: make(PropertyMap, len(this.props)), ids: append([]PropertyID(nil), this.ids...)}
+	for id, val := range this.props {
+		if list, ok := val.([]PropertyValue); ok {
+			val = append([]PropertyValue(nil), list...)
+		}
+		c.props[id] = val
+	}
+	return c
 }
 
 // Set property value
-func (this *PropertySet) SetProperty(t PKType, id PropertyID , val PropertyValue) error {
+func (this *PropertySet) SetProperty(t PKType, id PropertyID, val PropertyValue) error {
 	if mT, ok := propertyAllowedMessageTypes[id]; !ok {
 		return ErrPropertyInvalidID
 	} else if _, ok = mT[t]; !ok {
@@ -244,16 +276,13 @@ func (this *PropertySet) SetProperty(t PKType, id PropertyID , val PropertyValue
 	}
 	dup := MultiAllowedProperty(id, t)
 	if dup {
-		if _, ok = this.props[id]; ok {
-			this.props[id] = append(this.props[id], val)
-		} else {
-			this.props[id] = make([]PropertyValue,0)
-		}
+		list, _ := this.props[id].([]PropertyValue)
+		this.put(id, append(list, val))
 	} else {
-		if _, ok = this.props[id]; ok {
+		if _, ok := this.props[id]; ok {
 			return CodeProtocolError
 		}
-		this.props[ppid] = val
+		this.put(id, val)
 	}
 
 	return nil
@@ -261,10 +290,7 @@ func (this *PropertySet) SetProperty(t PKType, id PropertyID , val PropertyValue
 
 // Get property value
 func (this *PropertySet) GetProperty(id PropertyID) PropertyValue {
-	if v, ok := this.props[id]; !ok {
-		return nil
-	} 
-	return v
+	return this.props[id]
 }
 
 func (this *PropertySet) UnpackProps(r io.Reader, t PKType) error {
@@ -272,89 +298,114 @@ func (this *PropertySet) UnpackProps(r io.Reader, t PKType) error {
 
 	ulen, err := ReadUvarint(r)
 	if err != nil {
-		logger.Error("Error parsing properties lenght")
-		return nil, ErrMalformedStream
+		logger.Error("Error parsing properties length")
+		return ErrMalformedStream
 	}
 
-	proplen := int(ulen)
+	propLen := int(ulen)
 	for propLen > 0 {
-		ppid, err := ReadUvarint(r)
+		uid, err := ReadUvarint(r)
 		if err != nil {
 			logger.Error("Error parsing property ID")
-			return nil, err
+			return ErrMalformedStream
 		}
+		ppid := PropertyID(uid)
 		if !IsValidPacketType4Prop(ppid, t) {
 			logger.Error(fmt.Sprintf("Invalid PropertyID: 0x%04X Packet type: 0x%02X", ppid, t))
-			return nil, ErrMalformedStream
+			return ErrMalformedStream
 		}
 
-		propLen -= vlen(ppid)
+		propLen -= vlen(uid)
 
 		pptype, err := GetPropertyType(ppid)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Invalid Property pptype of PropertyID : 0x%04X Packet type: 0x%02X", ppid, t))
-			return nil, err
+			return err
 		}
 
 		val, err := ReadPropVal(r, pptype)
-
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error read property value (pptye: 0x%02x)", pptype))
-			return nil, err
+			return ErrMalformedStream
 		}
 
 		err = this.SetProperty(t, ppid, val)
-		if err {
+		if err != nil {
 			logger.Error(err.Error())
 			return err
 		}
-		proplen -= GetPropertyLength(pptype, val)
+		propLen -= GetPropertyLength(pptype, val)
+	}
+	if propLen < 0 {
+		logger.Error("Properties exceed the property length")
+		return ErrMalformedStream
 	}
 
 	return nil
 }
 
-func ReadPropVal(r io.Reader, pptype byte) (interface{}, error) {
+func ReadPropVal(r io.Reader, pptype byte) (PropertyValue, error) {
 	switch pptype {
 	case One_Byte:
-		v, err := ReadByte(r)
+		return ReadByte(r)
 	case Two_Byte_Integer:
-		v, err := ReadUint16(r)
+		return ReadUint16(r)
 	case Four_Byte_Integer:
-		v, err := ReadUint32(r)
+		return ReadUint32(r)
 	case Variable_Byte_Integer:
-		v, err := ReadUvarint(r)
+		return ReadUvarint(r)
 	case UTF8_String:
-		v, err := ReadSting(r)
+		return ReadString(r)
 	case UTF8_String_Pair:
-		v, err := ReadStingPair(r)
+		return ReadStringPair(r)
 	case Binary_Data:
-		v, err := ReadBinaryData(r)
-	default:
-		v, err := nil, errors.New("Invalid property data type")
+		return ReadBinaryData(r)
 	}
-	return v, err
+	return nil, errors.New("Invalid property data type")
 }
 
-func (this *PropertySet) PackProps(t PKType) []byte {
-	wbuff := bytes.NewBuffer([]byte{})
-
-	for id, val := range this.props {
-		dup := MultiAllowedProperty(id, t)
-		if dup {
-			err := WriteMultiProp(wbuff, id, val)
-			if err != nil {
-				return nil
+// Len returns the length of the encoded properties, not counting the
+// Property Length in front of them
+func (this *PropertySet) Len() int {
+	n := 0
+	for _, id := range this.ids {
+		pptype, _ := GetPropertyType(id)
+		if list, ok := this.props[id].([]PropertyValue); ok {
+			for _, v := range list {
+				n += vlen(uint32(id)) + GetPropertyLength(pptype, v)
 			}
 		} else {
-			err := WriteProp(wbuff, id, val)
-			if err != nil {
-				return nil
-			}
- 	    }
+			n += vlen(uint32(id)) + GetPropertyLength(pptype, this.props[id])
+		}
 	}
+	return n
+}
 
-	return wbuff.Bytes()
+// Size returns the length of the encoded properties including the
+// Property Length
+func (this *PropertySet) Size() int {
+	n := this.Len()
+	return vlen(uint32(n)) + n
+}
+
+// EncodeTo writes the Property Length and the properties in ascending
+// order of their IDs to w
+func (this *PropertySet) EncodeTo(w io.Writer) error {
+	err := WriteUvarint(w, uint32(this.Len()))
+	if err != nil {
+		return err
+	}
+	for _, id := range this.ids {
+		if list, ok := this.props[id].([]PropertyValue); ok {
+			err = WriteMultiProp(w, id, list)
+		} else {
+			err = WriteProp(w, id, this.props[id])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func WriteProp(w io.Writer, id PropertyID, v PropertyValue) error {
@@ -363,8 +414,8 @@ func WriteProp(w io.Writer, id PropertyID, v PropertyValue) error {
 		return err
 	}
 
-	// write property ID 
-	err = WriteUvarint(w, id)
+	// write property ID
+	err = WriteUvarint(w, uint32(id))
 	if err != nil {
 		return err
 	}
@@ -390,39 +441,19 @@ func WriteProp(w io.Writer, id PropertyID, v PropertyValue) error {
 	return err
 }
 
-func WriteMultiProp(w io.Writer, id PropertyID, v PropertyValue) error {
-	var err error
-	if id == Subscription_Identifier { // Variable_Byte_Integer
-		for i, val := range v.([]uint32) {
-			// write property ID
-			err = WriteUvarint(w, id)
-			if err != nil {
-				return err
-			}
-			// write property value
-			err = WriteUvarint(w, val)
-			if err != nil {
-				return err
-			}
-		} 
-	} else if id == User_Property { // UTF8_String_pair
-		for i, val := range v.([]StringPair) {
-			// write property id
-			err = WriteUvarint(w, id)
-			if err != nil {
-				return err
-			}
-			// write property value
-			err = WriteStringPair(w, val)
-			if err != nil {
-				return err
-			}
-		} 
-	} else {
-		err = errors.New(fmt.Sprintf("Not allow duplicate. Property ID: 0x%04X", id))
+// WriteMultiProp writes every value of a property which may occur more
+// than once, each with its property ID
+func WriteMultiProp(w io.Writer, id PropertyID, list []PropertyValue) error {
+	if id != Subscription_Identifier && id != User_Property {
+		err := fmt.Errorf("Not allow duplicate. Property ID: 0x%04X", id)
 		logger.Error(err.Error())
 		return err
 	}
-
+	for _, val := range list {
+		err := WriteProp(w, id, val)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,331 @@
+package mqttp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// roundTrip encodes pkt at protocol level v and decodes it again
+func roundTrip(t *testing.T, v byte, pkt Packet) Packet {
+	t.Helper()
+	var buff bytes.Buffer
+	enc := NewEncoder(&buff)
+	dec := NewDecoder(&buff)
+	if _, ok := pkt.(*Connect); !ok {
+		enc.SetVersion(v)
+		dec.SetVersion(v)
+	}
+	err := enc.Encode(pkt)
+	if err != nil {
+		t.Fatalf("encode %s: %s", pkt.GetType().Name(), err)
+	}
+	if buff.Len() != pkt.Size() {
+		t.Fatalf("%s encoded %d bytes, Size() is %d", pkt.GetType().Name(), buff.Len(), pkt.Size())
+	}
+	got, err := dec.Decode()
+	if err != nil {
+		t.Fatalf("decode %s: %s", pkt.GetType().Name(), err)
+	}
+	if buff.Len() != 0 {
+		t.Fatalf("%d bytes left after decoding %s", buff.Len(), pkt.GetType().Name())
+	}
+	return got
+}
+
+func TestUserPropertiesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []StringPair
+	}{
+		{"none", nil},
+		{"one", []StringPair{NewStringPair("region", "eu")}},
+		{"repeated name", []StringPair{
+			NewStringPair("tag", "a"),
+			NewStringPair("tag", "b"),
+			NewStringPair("tag", "a"),
+		}},
+		{"empty strings", []StringPair{NewStringPair("", "")}},
+		{"utf8", []StringPair{NewStringPair("名前", "値"), NewStringPair("k", "é")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := NewPublish()
+			pub.SetVersion(MQTT50)
+			pub.SetQos(QoS1)
+			pub.SetPacketID(7)
+			pub.SetTopic("a/b")
+			pub.SetPayload([]byte("payload"))
+			pub.Props().SetContentType("text/plain")
+			for _, p := range tt.pairs {
+				if err := pub.Props().AddUserProperty(p.Key(), p.Value()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := roundTrip(t, MQTT50, pub).(*Publish)
+			if pairs := got.Props().UserProperties(); !reflect.DeepEqual(pairs, tt.pairs) {
+				t.Errorf("user properties %v, want %v", pairs, tt.pairs)
+			}
+			if ct, _ := got.Props().ContentType(); ct != "text/plain" {
+				t.Errorf("content type %q, want text/plain", ct)
+			}
+		})
+	}
+}
+
+func TestWillUserPropertiesRoundTrip(t *testing.T) {
+	c := NewConnect()
+	c.SetVersion(MQTT50)
+	c.SetClean(true)
+	c.SetClientID("c1")
+	c.SetWill("will/c1", []byte("gone"), QoS1, false)
+	c.WillProps().SetWillDelayInterval(30)
+	c.WillProps().AddUserProperty("reason", "power")
+	c.WillProps().AddUserProperty("reason", "network")
+
+	got := roundTrip(t, MQTT50, c).(*Connect)
+	want := []StringPair{NewStringPair("reason", "power"), NewStringPair("reason", "network")}
+	if pairs := got.WillProps().UserProperties(); !reflect.DeepEqual(pairs, want) {
+		t.Errorf("will user properties %v, want %v", pairs, want)
+	}
+	if d, _ := got.WillProps().WillDelayInterval(); d != 30 {
+		t.Errorf("will delay %d, want 30", d)
+	}
+	if topic, msg := got.Will(); topic != "will/c1" || string(msg) != "gone" {
+		t.Errorf("will %q %q", topic, msg)
+	}
+}
+
+func TestWriteMultiProp(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      PropertyID
+		list    []PropertyValue
+		want    []byte
+		wantErr bool
+	}{
+		{"user property", User_Property,
+			[]PropertyValue{NewStringPair("k", "v"), NewStringPair("k", "w")},
+			[]byte{0x26, 0, 1, 'k', 0, 1, 'v', 0x26, 0, 1, 'k', 0, 1, 'w'}, false},
+		{"subscription identifier", Subscription_Identifier,
+			[]PropertyValue{uint32(1), uint32(200)},
+			[]byte{0x0B, 1, 0x0B, 0xC8, 0x01}, false},
+		{"single valued", Content_Type, []PropertyValue{"a", "b"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			err := WriteMultiProp(&buff, tt.id, tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(buff.Bytes(), tt.want) {
+				t.Errorf("wrote % X, want % X", buff.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+// propertyPackets builds a packet of each type the accessors are tested on
+var propertyPackets = map[PKType]func() Packet{
+	CONNECT: func() Packet {
+		c := NewConnect()
+		c.SetVersion(MQTT50)
+		c.SetClean(true)
+		c.SetClientID("c1")
+		c.SetWill("will/c1", []byte("gone"), QoS0, false)
+		return c
+	},
+	CONNACK: func() Packet {
+		return NewConnAck()
+	},
+	PUBLISH: func() Packet {
+		pub := NewPublish()
+		pub.SetQos(QoS1)
+		pub.SetPacketID(1)
+		pub.SetTopic("a/b")
+		return pub
+	},
+	SUBSCRIBE: func() Packet {
+		sub := NewSubscribe()
+		sub.SetPacketID(1)
+		sub.AddTopic("a/+", SubOps(QoS1))
+		return sub
+	},
+}
+
+func TestPropertyAccessors(t *testing.T) {
+	tests := []struct {
+		name  string
+		ptype PKType
+		set   func(ps *PropertySet) error
+		get   func(ps *PropertySet) (interface{}, bool)
+		want  interface{}
+	}{
+		{"Payload Format Indicator", PUBLISH,
+			func(ps *PropertySet) error { return ps.SetPayloadFormatIndicator(1) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.PayloadFormatIndicator() }, byte(1)},
+		{"Message Expiry Interval", PUBLISH,
+			func(ps *PropertySet) error { return ps.SetMessageExpiryInterval(3600) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.MessageExpiryInterval() }, uint32(3600)},
+		{"Content Type", PUBLISH,
+			func(ps *PropertySet) error { return ps.SetContentType("application/json") },
+			func(ps *PropertySet) (interface{}, bool) { return ps.ContentType() }, "application/json"},
+		{"Response Topic", PUBLISH,
+			func(ps *PropertySet) error { return ps.SetResponseTopic("reply/c1") },
+			func(ps *PropertySet) (interface{}, bool) { return ps.ResponseTopic() }, "reply/c1"},
+		{"Correlation Data", PUBLISH,
+			func(ps *PropertySet) error { return ps.SetCorrelationData([]byte{1, 2, 3}) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.CorrelationData() }, []byte{1, 2, 3}},
+		{"Topic Alias", PUBLISH,
+			func(ps *PropertySet) error { return ps.SetTopicAlias(4) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.TopicAlias() }, uint16(4)},
+		{"Session Expiry Interval", CONNECT,
+			func(ps *PropertySet) error { return ps.SetSessionExpiryInterval(300) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.SessionExpiryInterval() }, uint32(300)},
+		{"Receive Maximum", CONNECT,
+			func(ps *PropertySet) error { return ps.SetReceiveMaximum(10) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.ReceiveMaximum() }, uint16(10)},
+		{"Maximum Packet Size", CONNECT,
+			func(ps *PropertySet) error { return ps.SetMaximumPacketSize(1 << 20) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.MaximumPacketSize() }, uint32(1 << 20)},
+		{"Topic Alias Maximum", CONNECT,
+			func(ps *PropertySet) error { return ps.SetTopicAliasMaximum(8) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.TopicAliasMaximum() }, uint16(8)},
+		{"Request Response Information", CONNECT,
+			func(ps *PropertySet) error { return ps.SetRequestResponseInformation(1) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.RequestResponseInformation() }, byte(1)},
+		{"Request Problem Information", CONNECT,
+			func(ps *PropertySet) error { return ps.SetRequestProblemInformation(0) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.RequestProblemInformation() }, byte(0)},
+		{"Authentication Method", CONNECT,
+			func(ps *PropertySet) error { return ps.SetAuthenticationMethod("SCRAM-SHA-1") },
+			func(ps *PropertySet) (interface{}, bool) { return ps.AuthenticationMethod() }, "SCRAM-SHA-1"},
+		{"Authentication Data", CONNECT,
+			func(ps *PropertySet) error { return ps.SetAuthenticationData([]byte("data")) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.AuthenticationData() }, []byte("data")},
+		{"Assigned Client Identifier", CONNACK,
+			func(ps *PropertySet) error { return ps.SetAssignedClientIdentifier("auto-1") },
+			func(ps *PropertySet) (interface{}, bool) { return ps.AssignedClientIdentifier() }, "auto-1"},
+		{"Server Keep Alive", CONNACK,
+			func(ps *PropertySet) error { return ps.SetServerKeepAlive(60) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.ServerKeepAlive() }, uint16(60)},
+		{"Response Information", CONNACK,
+			func(ps *PropertySet) error { return ps.SetResponseInformation("reply/") },
+			func(ps *PropertySet) (interface{}, bool) { return ps.ResponseInformation() }, "reply/"},
+		{"Server Reference", CONNACK,
+			func(ps *PropertySet) error { return ps.SetServerReference("other:1883") },
+			func(ps *PropertySet) (interface{}, bool) { return ps.ServerReference() }, "other:1883"},
+		{"Reason String", CONNACK,
+			func(ps *PropertySet) error { return ps.SetReasonString("welcome") },
+			func(ps *PropertySet) (interface{}, bool) { return ps.ReasonString() }, "welcome"},
+		{"Maximum QoS", CONNACK,
+			func(ps *PropertySet) error { return ps.SetMaximumQoS(QoS1) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.MaximumQoS() }, QoS1},
+		{"Retain Available", CONNACK,
+			func(ps *PropertySet) error { return ps.SetRetainAvailable(0) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.RetainAvailable() }, byte(0)},
+		{"Wildcard Subscription Available", CONNACK,
+			func(ps *PropertySet) error { return ps.SetWildcardSubscriptionAvailable(0) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.WildcardSubscriptionAvailable() }, byte(0)},
+		{"Subscription Identifier Available", CONNACK,
+			func(ps *PropertySet) error { return ps.SetSubscriptionIdentifierAvailable(0) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.SubscriptionIdentifierAvailable() }, byte(0)},
+		{"Shared Subscription Available", CONNACK,
+			func(ps *PropertySet) error { return ps.SetSharedSubscriptionAvailable(0) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.SharedSubscriptionAvailable() }, byte(0)},
+		{"Subscription Identifier of SUBSCRIBE", SUBSCRIBE,
+			func(ps *PropertySet) error { return ps.AddSubscriptionIdentifier(42) },
+			func(ps *PropertySet) (interface{}, bool) { return ps.SubscriptionIdentifiers(), true }, []uint32{42}},
+		{"Subscription Identifiers of PUBLISH", PUBLISH,
+			func(ps *PropertySet) error {
+				ps.AddSubscriptionIdentifier(1)
+				return ps.AddSubscriptionIdentifier(268435455)
+			},
+			func(ps *PropertySet) (interface{}, bool) { return ps.SubscriptionIdentifiers(), true }, []uint32{1, 268435455}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := propertyPackets[tt.ptype]()
+			if err := tt.set(pkt.Props()); err != nil {
+				t.Fatalf("set: %s", err)
+			}
+			got := roundTrip(t, MQTT50, pkt)
+			v, ok := tt.get(got.Props())
+			if !ok || !reflect.DeepEqual(v, tt.want) {
+				t.Errorf("decoded %v %t, want %v", v, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestWillPropertyAccessors(t *testing.T) {
+	c := propertyPackets[CONNECT]().(*Connect)
+	ps := c.WillProps()
+	ps.SetWillDelayInterval(30)
+	ps.SetPayloadFormatIndicator(1)
+	ps.SetMessageExpiryInterval(60)
+	ps.SetContentType("text/plain")
+	ps.SetResponseTopic("reply/c1")
+	ps.SetCorrelationData([]byte{7})
+
+	got := roundTrip(t, MQTT50, c).WillProps()
+	if v, ok := got.WillDelayInterval(); !ok || v != 30 {
+		t.Errorf("Will Delay Interval %d %t", v, ok)
+	}
+	if v, ok := got.PayloadFormatIndicator(); !ok || v != 1 {
+		t.Errorf("Payload Format Indicator %d %t", v, ok)
+	}
+	if v, ok := got.MessageExpiryInterval(); !ok || v != 60 {
+		t.Errorf("Message Expiry Interval %d %t", v, ok)
+	}
+	if v, ok := got.ContentType(); !ok || v != "text/plain" {
+		t.Errorf("Content Type %q %t", v, ok)
+	}
+	if v, ok := got.ResponseTopic(); !ok || v != "reply/c1" {
+		t.Errorf("Response Topic %q %t", v, ok)
+	}
+	if v, ok := got.CorrelationData(); !ok || !bytes.Equal(v, []byte{7}) {
+		t.Errorf("Correlation Data %v %t", v, ok)
+	}
+}
+
+func TestPropertyPacketTypeMismatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		ptype PKType
+		set   func(ps *PropertySet) error
+	}{
+		{"Will Delay Interval in CONNECT", CONNECT, func(ps *PropertySet) error { return ps.SetWillDelayInterval(1) }},
+		{"Session Expiry Interval in PUBLISH", PUBLISH, func(ps *PropertySet) error { return ps.SetSessionExpiryInterval(1) }},
+		{"Topic Alias in CONNACK", CONNACK, func(ps *PropertySet) error { return ps.SetTopicAlias(1) }},
+		{"Server Keep Alive in CONNECT", CONNECT, func(ps *PropertySet) error { return ps.SetServerKeepAlive(1) }},
+		{"Content Type in SUBSCRIBE", SUBSCRIBE, func(ps *PropertySet) error { return ps.SetContentType("a") }},
+		{"Subscription Identifier in CONNACK", CONNACK, func(ps *PropertySet) error { return ps.AddSubscriptionIdentifier(1) }},
+	}
+	for _, tt := range tests {
+		ps := propertyPackets[tt.ptype]().Props()
+		if err := tt.set(ps); err != ErrPropertyPacketTypeMismatch {
+			t.Errorf("%s: err %v, want %v", tt.name, err, ErrPropertyPacketTypeMismatch)
+		}
+		if ps.Len() != 0 {
+			t.Errorf("%s: property stored", tt.name)
+		}
+	}
+}
+
+func TestPropertyWrongType(t *testing.T) {
+	// a value of another Go type reads as absent instead of panicking
+	ps := NewConnect().Props()
+	ps.put(Session_Expiry_Interval, "300")
+	ps.put(Receive_Maximum, uint32(10))
+	if v, ok := ps.SessionExpiryInterval(); ok {
+		t.Errorf("Session Expiry Interval %d", v)
+	}
+	if v, ok := ps.ReceiveMaximum(); ok {
+		t.Errorf("Receive Maximum %d", v)
+	}
+}
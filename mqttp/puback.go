@@ -2,17 +2,13 @@ package mqttp
 
 import (
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
 	"io"
 	"fmt"
-	"time"
 )
 
 type PubAck struct {
-	header
+	Header
 	rcode  ReasonCode
 }
 
@@ -20,10 +16,19 @@ var _ Packet = (*PubAck)(nil)
 
 func NewPubAck() *PubAck {
 	p := &PubAck{}
+	p.SetType(PUBACK)
 	p.ResetProps()
 	return p
 }
 
+func (this *PubAck) ReasonCode() ReasonCode {
+	return this.rcode
+}
+
+func (this *PubAck) SetReasonCode(c ReasonCode) {
+	this.rcode = c
+}
+
 func (this *PubAck) Unpack(rdata []byte) error {
 	r := bytes.NewBuffer(rdata)
 	// packet id
@@ -38,66 +43,79 @@ func (this *PubAck) Unpack(rdata []byte) error {
 	}
 	this.SetPacketID(pid)
 
-	// reason code
-	rcode, err := ReadByte(r)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Error parsing puback reason code: %s", err))
-		return ErrMalformedStream
-	}
-	reason_code := ReasonCode(rcode)
-	if reason_code.IsValidForType(PUBACK) {
-		this.rcode = reason_code
-	} else {
-		logger.Error(fmt.Sprintf("Invalid puback reason code: 0x%02X", rcode))
-		return ErrMalformedStream
-	}
-
-	if this.GetVersion == MQTT50 {
-		// property
-		err = this.ReadProps(r io.Reader)
+	// reason code and properties are MQTT 5.0 only, they may be omitted
+	// when the reason code is success and there are no properties
+	this.rcode = CodeSuccess
+	if this.GetVersion() == MQTT50 && r.Len() > 0 {
+		rcode, err := ReadByte(r)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
+			logger.Error(fmt.Sprintf("Error parsing puback reason code: %s", err))
+			return ErrMalformedStream
+		}
+		reason_code := ReasonCode(rcode)
+		if reason_code.IsValidForType(PUBACK) {
+			this.rcode = reason_code
+		} else {
+			logger.Error(fmt.Sprintf("Invalid puback reason code: 0x%02X", rcode))
 			return ErrMalformedStream
 		}
+
+		if r.Len() > 0 {
+			// property
+			err = this.ReadProps(r)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
+				return ErrMalformedStream
+			}
+		}
 	}
 
 	return nil
 }
 
-func (this *PubAck) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
+// remainingLength is the length of the variable header and the payload
+func (this *PubAck) remainingLength() int {
 	// packet id
-	err = WriteUint16(buff, this.GetPacketID())
-	if err != nil {
-		logger.Error(fmt.Sprintf("Error encoding packet id: %s", err))
-		return nil, err
+	n := 2
+	if this.GetVersion() == MQTT50 {
+		// reason code and property
+		n += 1 + this.propset.Size()
 	}
+	return n
+}
+
+// Size returns the length of the encoded packet
+func (this *PubAck) Size() int {
+	return packetSize(this.remainingLength())
+}
 
-	// reason code
-	err = WriteByte(buff, this.rcode.Value())
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *PubAck) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
-		return nil, err
+		return err
 	}
-	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	// packet id
+	err = WriteUint16(w, this.GetPacketID())
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error encoding packet id: %s", err))
+		return err
+	}
+
+	if this.GetVersion() == MQTT50 {
+		// reason code
+		err = WriteByte(w, this.rcode.Value())
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
+			logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
+			return err
 		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+		// property
+		err = this.WriteProps(w)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
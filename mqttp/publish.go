@@ -2,9 +2,6 @@ package mqttp
 
 import (
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
 	"io"
 	"fmt"
@@ -12,23 +9,25 @@ import (
 )
 
 type Publish struct {
-	header
+	Header
 	topic     string
 	expire_at time.Time
 	payload   []byte
+	frame     *frame // the payload is part of it if not nil
 }
 
 var _ Packet = (*Publish)(nil)
 
 func NewPublish() *Publish {
 	p := &Publish{}
+	p.SetType(PUBLISH)
 	p.ResetProps()
 	return p
 }
 
 func (this *Publish) Expired() bool {
 	// check if expired 
-	if this.expire_at == nil {
+	if this.expire_at.IsZero() {
 		return false
 	}
 //	now := time.Now()
@@ -36,15 +35,98 @@ func (this *Publish) Expired() bool {
 }
 
 func (this *Publish) ExpiredInterval() uint32 {
-	pv := propset.GetProperty(Message_Expiry_Interval)
+	pv := this.propset.GetProperty(Message_Expiry_Interval)
 	if pv==nil {
         return 315360000   // 10 years
 	}
 	return pv.(uint32)
 }
 
+// ExpireAt returns when the message expires, the zero time if never
+func (this *Publish) ExpireAt() time.Time {
+	return this.expire_at
+}
+
+// SetExpireAt sets when the message expires, the zero time means never
+func (this *Publish) SetExpireAt(t time.Time) {
+	this.expire_at = t
+}
+
+func (this *Publish) Topic() string {
+	return this.topic
+}
+
+func (this *Publish) SetTopic(v string) error {
+	if !IsValidTopic(v) {
+		return ErrInvalidTopic
+	}
+	this.topic = v
+	return nil
+}
+
+// SetValidTopic sets a topic name known to be valid without checking it
+// again, such as the topic of a decoded packet or a part of it after a
+// topic level separator
+func (this *Publish) SetValidTopic(v string) {
+	this.topic = v
+}
+
+func (this *Publish) Payload() []byte {
+	return this.payload
+}
+
+func (this *Publish) SetPayload(v []byte) {
+	this.payload = v
+}
+
+// SharePayload makes the payload of src the payload of this packet without
+// copying it. If src was decoded this packet takes its own reference to
+// the buffer and must be released as well.
+func (this *Publish) SharePayload(src *Publish) {
+	this.Release()
+	this.payload = src.payload
+	if src.frame != nil {
+		src.frame.retain()
+		this.frame = src.frame
+	}
+}
+
+// Copy returns a packet with the header, topic and properties of this one
+// which shares its payload, see SharePayload. Changing the copy leaves this
+// packet as it is.
+func (this *Publish) Copy() *Publish {
+	p := &Publish{Header: this.Header, topic: this.topic, expire_at: this.expire_at}
+	p.propset = this.propset.clone()
+	p.SharePayload(this)
+	return p
+}
+
+// Release gives the buffer the packet was decoded from back to the Decoder
+// once no other packet shares it. The payload must not be used afterwards.
+// Packets built by the application or detached are not affected, a decoded
+// packet which is never released is left to the garbage collector.
+func (this *Publish) Release() {
+	if this.frame == nil {
+		return
+	}
+	this.frame.release()
+	this.frame = nil
+	this.payload = nil
+}
+
+// Detach copies the payload out of the buffer the packet was decoded from
+// and releases it, the packet may then be kept for as long as needed
+func (this *Publish) Detach() {
+	if this.frame == nil {
+		return
+	}
+	this.payload = append([]byte(nil), this.payload...)
+	this.frame.release()
+	this.frame = nil
+}
+
 func (this *Publish) Unpack(rdata []byte) error {
-	r := bytes.NewBuffer(rdata)
+	r := bytes.NewReader(rdata)
 	// topic name
 	topic, err := ReadUTF8String(r)
 	if err != nil {
@@ -58,7 +140,7 @@ func (this *Publish) Unpack(rdata []byte) error {
 	this.topic = topic
 
 	// packet id
-	if this.GetQoS() > 0 {
+	if this.GetQos() > 0 {
 		pid, err := ReadUint16(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error parsing packet ID: %s", err))
@@ -72,7 +154,7 @@ func (this *Publish) Unpack(rdata []byte) error {
 	}
 
 	// property
-	if this.GetVersion == MQTT50 {
+	if this.GetVersion() == MQTT50 {
 		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
@@ -80,66 +162,74 @@ func (this *Publish) Unpack(rdata []byte) error {
 		}
 	}
 
-    // payload
-	payload, err := ReadRestData(r)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Error parsing payload: %s", err))
-		return CodeUnspecifiedError
-	}
-	this.payload = payload
+	// payload, the rest of rdata without copying it
+	this.payload = rdata[len(rdata)-r.Len() : len(rdata) : len(rdata)]
 	
-	// expire at 
-	if this.GetVersion == MQTT50 {
+	// expire at, messages without Message Expiry Interval never expire
+	if this.GetVersion() == MQTT50 && this.propset.GetProperty(Message_Expiry_Interval) != nil {
 		interval := this.ExpiredInterval()
 		duration := time.Duration(interval)*time.Second
 		this.expire_at = time.Now().Add(duration)
 	} else {
-		this.expire_at = nil
+		this.expire_at = time.Time{}
 	}
 
 	return nil
 }
 
-func (this *Publish) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
+// remainingLength is the length of the variable header and the payload
+func (this *Publish) remainingLength() int {
+	// topic
+	n := 2 + len(this.topic)
+	// packet id
+	if this.GetQos() > 0 {
+		n += 2
+	}
+	if this.GetVersion() == MQTT50 {
+		n += this.propset.Size()
+	}
+	return n + len(this.payload)
+}
+
+// Size returns the length of the encoded packet
+func (this *Publish) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *Publish) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
+	if err != nil {
+		return err
+	}
 	// topic
-	err = WriteString(buff, this.topic)
+	err = WriteString(w, this.topic)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding topic: %s", err))
-		return nil, err
+		return err
 	}
 	// packet id
-	if this.GetQoS() > 0 {
-		err = WriteUint16(buff, this.GetPacketID())
+	if this.GetQos() > 0 {
+		err = WriteUint16(w, this.GetPacketID())
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding packet id: %s", err))
-			return nil, err
+			return err
 		}
 	}
 	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	if this.GetVersion() == MQTT50 {
+		err = this.WriteProps(w)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
-		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
-	_, err = buff.Write(this.payload)
+	// payload
+	_, err = w.Write(this.payload)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding payload: %s", err))
-		return nil, err
+		return err
 	}
-	
-	return buff.Bytes(), nil
+
+	return nil
 }
@@ -52,8 +52,10 @@ const ( // /////////////////////////////////////////////////////   |    \    |
 	CodeWildcardSubscriptionsNotSupported  ReasonCode = 0xA2 //         \ <--|
 )
 
-var packetTypeCodeMap = map[PKType]map[ReasonCode] bool {
-{
+// CodeDisconnectWithWill asks the server to publish the will message on DISCONNECT (V5.0)
+const CodeDisconnectWithWill ReasonCode = 0x04
+
+var packetTypeCodeMap = map[PKType]map[ReasonCode]bool{
 	CONNACK: {
 		CodeSuccess:                            true,
 		CodeRefusedUnacceptableProtocolVersion: true,
@@ -116,9 +118,9 @@ var packetTypeCodeMap = map[PKType]map[ReasonCode] bool {
 	},
 
 	SUBACK: {
-		QoS0:                                  true,  // QoS 0
-		QoS1:                                  true,  // QoS 1
-		QoS2:                                  true,  // QoS 2
+		ReasonCode(QoS0):                      true, // QoS 0
+		ReasonCode(QoS1):                      true, // QoS 1
+		ReasonCode(QoS2):                      true, // QoS 2
 		CodeUnspecifiedError:                  true,
 		CodeImplementationSpecificError:       true,
 		CodeNotAuthorized:                     true,
@@ -142,7 +144,7 @@ var packetTypeCodeMap = map[PKType]map[ReasonCode] bool {
 
 	DISCONNECT: {
 		CodeSuccess:                           true,
-		CodeRefusedBadUsernameOrPassword:      true,
+		CodeDisconnectWithWill:                true,
 		CodeUnspecifiedError:                  true,
 		CodeMalformedPacket:                   true,
 		CodeProtocolError:                     true,
@@ -2,17 +2,13 @@ package mqttp
 
 import (
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
 	"io"
 	"fmt"
-	"time"
 )
 
 type SubAck struct {
-	header
+	Header
 	rcodes []ReasonCode
 }
 
@@ -20,11 +16,20 @@ var _ Packet = (*SubAck)(nil)
 
 func NewSubAck() *SubAck {
 	p := &SubAck{}
+	p.SetType(SUBACK)
 	p.ResetProps()
 	p.rcodes = make([]ReasonCode, 0)
 	return p
 }
 
+func (this *SubAck) ReasonCodes() []ReasonCode {
+	return this.rcodes
+}
+
+func (this *SubAck) AddReasonCode(c ReasonCode) {
+	this.rcodes = append(this.rcodes, c)
+}
+
 func (this *SubAck) Unpack(rdata []byte) error {
 	r := bytes.NewBuffer(rdata)
 
@@ -40,21 +45,20 @@ func (this *SubAck) Unpack(rdata []byte) error {
 	}
 	this.SetPacketID(pid)
 
-	if this.GetVersion == MQTT50 {
+	if this.GetVersion() == MQTT50 {
 		// property
-		err = this.ReadProps(r io.Reader)
+		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
 			return ErrMalformedStream
 		}
 	}
 
-	restLen := r.Len()
-	if restLen == 0 {
+	if r.Len() == 0 {
 		return CodeProtocolError
-	} 
+	}
 	// reason code for each topic filter
-	for restLen > 0 {
+	for r.Len() > 0 {
 		rcode, err := ReadByte(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error parsing reason code: %s", err))
@@ -63,7 +67,7 @@ func (this *SubAck) Unpack(rdata []byte) error {
 		// verfify reason code 		
 		reason_code := ReasonCode(rcode)
 		if reason_code.IsValidForType(SUBACK) {
-			this.rcodes = append(reason_code)
+			this.rcodes = append(this.rcodes, reason_code)
 		} else {
 			logger.Error(fmt.Sprintf("Invalid suback reason code: 0x%02X", rcode))
 			return ErrMalformedStream
@@ -72,43 +76,50 @@ func (this *SubAck) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *SubAck) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
+// remainingLength is the length of the variable header and the payload
+func (this *SubAck) remainingLength() int {
 	// packet id
-	err = WriteUint16(buff, this.GetPacketID())
+	n := 2
+	if this.GetVersion() == MQTT50 {
+		n += this.propset.Size()
+	}
+	// reason code
+	return n + len(this.rcodes)
+}
+
+// Size returns the length of the encoded packet
+func (this *SubAck) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *SubAck) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
+	if err != nil {
+		return err
+	}
+	// packet id
+	err = WriteUint16(w, this.GetPacketID())
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding packet id: %s", err))
-		return nil, err
+		return err
 	}
 	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	if this.GetVersion() == MQTT50 {
+		err = this.WriteProps(w)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
-		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
-
 	// reason code
 	for _, rc := range this.rcodes {
-    
-		err = WriteByte(buff, rc.Raw())
+		err = WriteByte(w, rc.Value())
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding reason code: %s", err))
-			return nil, err
+			return err
 		}
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
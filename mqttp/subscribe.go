@@ -1,10 +1,8 @@
 package mqttp
 
 import (
+	"fmt"
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
 	"io"
 )
@@ -16,7 +14,7 @@ type TopicOpsPair struct {
 }
 
 type Subscribe struct {
-	header
+	Header
 	topicOpsList [] *TopicOpsPair
 }
 
@@ -26,11 +24,33 @@ var _ Packet = (*Subscribe)(nil)
 
 func NewSubscribe() *Subscribe {
 	p := &Subscribe{}
+	p.SetType(SUBSCRIBE)
+	p.ParseFlags(SUBSCRIBE.DefaultFlags()) // reserved flags 0010 [MQTT-2.1.3-1]
 	p.ResetProps()
 	p.topicOpsList = make([]*TopicOpsPair, 0)
 	return p
 }
 
+// TopicFilter returns the subscription topic filter
+func (this *TopicOpsPair) TopicFilter() string {
+	return this.topicFilter
+}
+
+// Options returns the subscription options
+func (this *TopicOpsPair) Options() SubOps {
+	return this.options
+}
+
+// TopicOpsList returns the topic filter and options pairs in packet order
+func (this *Subscribe) TopicOpsList() []*TopicOpsPair {
+	return this.topicOpsList
+}
+
+// AddTopic appends a topic filter with its subscription options
+func (this *Subscribe) AddTopic(filter string, ops SubOps) {
+	this.topicOpsList = append(this.topicOpsList, &TopicOpsPair{topicFilter: filter, options: ops})
+}
+
 func (this *Subscribe) Unpack(rdata []byte) error {
 	r := bytes.NewBuffer(rdata)
 	// packet id
@@ -46,20 +66,19 @@ func (this *Subscribe) Unpack(rdata []byte) error {
 	this.SetPacketID(pid)
 
 	// property
-	if this.GetVersion == MQTT50 {
-		err = this.ReadProps(r io.Reader)
+	if this.GetVersion() == MQTT50 {
+		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
 			return CodeProtocolError
 		}
 	}
 
-	restLen := r.Len()
-	if restLen == 0 {
+	if r.Len() == 0 {
 		return CodeProtocolError
-	} 
+	}
 
-	for restLen > 0 {
+	for r.Len() > 0 {
 		// topic filter
 		topic, err := ReadUTF8String(r)
 		if err != nil {
@@ -75,7 +94,6 @@ func (this *Subscribe) Unpack(rdata []byte) error {
 		if this.SubOpsValid(ops) {
 			tops := &TopicOpsPair{topicFilter:topic, options: SubOps(ops)}
 			this.topicOpsList = append(this.topicOpsList, tops)
-			restLen -= (len(topic) + 2 + 1)
 		} else {
 			logger.Error(fmt.Sprintf("Invalid sub options: 0x%02X", ops))
 			return CodeUnspecifiedError
@@ -85,50 +103,60 @@ func (this *Subscribe) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *Subscribe) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
+// remainingLength is the length of the variable header and the payload
+func (this *Subscribe) remainingLength() int {
 	// packet id
-	err = WriteUint16(buff, this.GetPacketID())
+	n := 2
+	if this.GetVersion() == MQTT50 {
+		n += this.propset.Size()
+	}
+	// topic filter and options
+	for _, tpo := range this.topicOpsList {
+		n += 2 + len(tpo.topicFilter) + 1
+	}
+	return n
+}
+
+// Size returns the length of the encoded packet
+func (this *Subscribe) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *Subscribe) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
+	if err != nil {
+		return err
+	}
+	// packet id
+	err = WriteUint16(w, this.GetPacketID())
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding packet id: %s", err))
-		return nil, err
+		return err
 	}
-
 	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	if this.GetVersion() == MQTT50 {
+		err = this.WriteProps(w)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
-		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
-
 	// topic filter options pairs
 	for _, tpo := range this.topicOpsList {
 		// topic filter
-		err = WriteString(buff, tpo.topicFilter)
+		err = WriteString(w, tpo.topicFilter)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding topic filter: %s", err))
-			return nil, err
+			return err
 		}
-        // options
-		err = WriteByte(buff, tpo.options.Raw())
+		// options
+		err = WriteByte(w, tpo.options.Raw())
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding options: %s", err))
-			return nil, err
+			return err
 		}
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
@@ -1,16 +1,14 @@
 package mqttp
 
 import (
+	"fmt"
 	"github.com/wonderivan/logger"
-	"encoding/binary"
-	"regexp"
-	"unicode/utf8"
 	"bytes"
 	"io"
 )
 
 type UnSubscribe struct {
-	header
+	Header
 	TopicList []string
 }
 
@@ -18,6 +16,8 @@ var _ Packet = (*UnSubscribe)(nil)
 
 func NewUnSubscribe() *UnSubscribe {
 	p := &UnSubscribe{}
+	p.SetType(UNSUBSCRIBE)
+	p.ParseFlags(UNSUBSCRIBE.DefaultFlags()) // reserved flags 0010 [MQTT-2.1.3-1]
 	p.ResetProps()
 	p.TopicList = make([]string , 0)
 	return p
@@ -38,20 +38,19 @@ func (this *UnSubscribe) Unpack(rdata []byte) error {
 	this.SetPacketID(pid)
 
 	// property
-	if this.GetVersion == MQTT50 {
-		err = this.ReadProps(r io.Reader)
+	if this.GetVersion() == MQTT50 {
+		err = this.ReadProps(r)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed reading properties: %s", err))
 			return CodeProtocolError
 		}
 	}
 
-	restLen := r.Len()
-	if restLen == 0 {
+	if r.Len() == 0 {
 		return CodeProtocolError
-	} 
+	}
 
-	for restLen > 0 {
+	for r.Len() > 0 {
 		// topic filter
 		topic, err := ReadUTF8String(r)
 		if err != nil {
@@ -64,44 +63,53 @@ func (this *UnSubscribe) Unpack(rdata []byte) error {
 	return nil
 }
 
-func (this *UnSubscribe) Pack() ([]byte, error) {
-	buff := bytes.NewBuffer([]byte{})
+// remainingLength is the length of the variable header and the payload
+func (this *UnSubscribe) remainingLength() int {
+	// packet id
+	n := 2
+	if this.GetVersion() == MQTT50 {
+		n += this.propset.Size()
+	}
+	// topic filter
+	for _, topic := range this.TopicList {
+		n += 2 + len(topic)
+	}
+	return n
+}
+
+// Size returns the length of the encoded packet
+func (this *UnSubscribe) Size() int {
+	return packetSize(this.remainingLength())
+}
+
+// EncodeTo writes the fixed header, the variable header and the payload to w
+func (this *UnSubscribe) EncodeTo(w io.Writer) error {
+	err := writeFixedHeader(w, this.GetFixedHeaderFirstByte(), this.remainingLength())
+	if err != nil {
+		return err
+	}
 	// packet id
-	err = WriteUint16(buff, this.GetPacketID())
+	err = WriteUint16(w, this.GetPacketID())
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error encoding packet id: %s", err))
-		return nil, err
+		return err
 	}
-
 	// property
-	if this.GetVersion()==MQTT50 {
-		ppbytes := this.propset.PackProps(this.GetType())
-		// propertiy len
-		plen := len(ppbytes)
-		err = WriteUvarint(buff, uint32(plen))
+	if this.GetVersion() == MQTT50 {
+		err = this.WriteProps(w)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error encoding property length: %s", err))
-			return nil, err
-		}
-		// property content
-		if plen>0 {
-			_, err = buff.Write(ppbytes)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Error encoding property: %s", err))
-				return nil, err
-			}
+			logger.Error(fmt.Sprintf("Error encoding property: %s", err))
+			return err
 		}
 	}
-
 	// topic filter list
 	for _, topic := range this.TopicList {
-		// topic filter
-		err = WriteString(buff, topic)
+		err = WriteString(w, topic)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Error encoding topic filter: %s", err))
-			return nil, err
+			return err
 		}
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
@@ -1,191 +1,160 @@
 package mqttp
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"regexp"
-	"unicode/utf8"
-
 )
+
 const (
-	MAX_UINT uint64 = 268435455
+	MAX_UINT uint32 = 268435455
 )
-/*
-func ReadUvarint(r io.Reader) (uint32, error) {
-	var b byte
-	var x uint32
-	var shift uint32
 
-	buff := make([]byte, 1)
-
-	for i:=0; i<4; i++ {
-		_, err := io.ReadFull(r, buff)
-		if err != nil {
-			return 0, err
-		}
-		b = buff[0]
-		if b < 0x80 {
-			return x | uint32(b) << shift, nil
-		}
-		x |= uint32(b & 0x7f) << shift
-		shift += 7
-	}
-	
-	return 0, errors.New("uvarint32 overflow")
-}
-*/
+var errInvalidUTF8 = errors.New("Invalid UTF8 encode")
 
 func ReadByte(r io.Reader) (byte, error) {
-	buff := make([]byte, 1)
-	_, err := io.ReadFull(r, buff)
+	var buff [1]byte
+	_, err := io.ReadFull(r, buff[:])
 	if err != nil {
 		return 0, err
 	}
 	return buff[0], nil
- }
+}
 
- func WriteByte(w io.Writer, v byte) error {
-	buff := []byte{v}
-	_, err := w.Write(buff)
+func WriteByte(w io.Writer, v byte) error {
+	if bw, ok := w.(io.ByteWriter); ok {
+		return bw.WriteByte(v)
+	}
+	_, err := w.Write([]byte{v})
 	return err
 }
 
- func ReadUint16(r io.Reader) (uint16, error) {
-	buff := make([]byte, 2)
-	_, err := io.ReadFull(r, buff)
+func ReadUint16(r io.Reader) (uint16, error) {
+	var buff [2]byte
+	_, err := io.ReadFull(r, buff[:])
 	if err != nil {
 		return 0, err
 	}
-	v := binary.BigEndian.Uint16(buff)
-	return v, nil
- }
+	return binary.BigEndian.Uint16(buff[:]), nil
+}
 
- func WriteUint16(w io.Writer, v uint16) error {
-	buff := make([]byte, 2)
-	binary.BigEndian.PutUint16(buff, v)
-	_, err := w.Write(buff)
+func WriteUint16(w io.Writer, v uint16) error {
+	var buff [2]byte
+	binary.BigEndian.PutUint16(buff[:], v)
+	_, err := w.Write(buff[:])
 	return err
 }
- 
- func ReadUint32(r io.Reader) (uint32, error) {
-	buff := make([]byte, 4)
-	_, err := io.ReadFull(r, buff)
+
+func ReadUint32(r io.Reader) (uint32, error) {
+	var buff [4]byte
+	_, err := io.ReadFull(r, buff[:])
 	if err != nil {
 		return 0, err
 	}
-	v := binary.BigEndian.Uint32(buff)
-	return v, nil
- }
+	return binary.BigEndian.Uint32(buff[:]), nil
+}
 
- func WriteUint32(w io.Writer, v uint32) error {
-	buff := make([]byte, 4)
-	binary.BigEndian.PutUint32(buff, v)
-	_, err := w.Write(buff)
+func WriteUint32(w io.Writer, v uint32) error {
+	var buff [4]byte
+	binary.BigEndian.PutUint32(buff[:], v)
+	_, err := w.Write(buff[:])
 	return err
 }
 
- func ReadSting(r io.Reader) (string, error) {
-	n, err := ReadUint16(r)
+// ReadString reads a UTF-8 Encoded String [MQTT-1.5.4]
+func ReadString(r io.Reader) (string, error) {
+	buff, err := ReadBinaryData(r)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	buff := make([]byte, n)
-	_, err := io.ReadFull(r, buff)
-	if err != nil {
-		return nil, err
+	if !IsValidUTF(buff) {
+		return "", errInvalidUTF8
 	}
-	return string(v), nil
- }
+	return string(buff), nil
+}
 
- func WriteString(w io.Writer, v string) error {
-	buff := []byte(v)
-	n := (len(buff))
-	err := WriteUint16(w, uint16(n))
+func WriteString(w io.Writer, v string) error {
+	err := WriteUint16(w, uint16(len(v)))
 	if err != nil {
 		return err
 	}
-	_, err := w.Write(buff)
+	_, err = io.WriteString(w, v)
 	return err
 }
 
-func ReadStingPair(r io.Reader) (StringPair, error) {
-	key, err := ReadSting(r)
+// ReadStringPair reads a UTF-8 String Pair [MQTT-1.5.7]
+func ReadStringPair(r io.Reader) (StringPair, error) {
+	key, err := ReadString(r)
 	if err != nil {
-		return nil, err
+		return StringPair{}, err
 	}
-	val, err := ReadSting(r)
+	val, err := ReadString(r)
 	if err != nil {
-		return nil, err
+		return StringPair{}, err
 	}
-	return StringPair{k:key, v:val}, nil
- }
+	return StringPair{k: key, v: val}, nil
+}
 
- func WriteStringPair(w io.Writer, sp StringPair) error {
+func WriteStringPair(w io.Writer, sp StringPair) error {
 	err := WriteString(w, sp.k)
 	if err != nil {
 		return err
 	}
-	err = WriteString(w, sp.v)
-	if err != nil {
-		return err
-	}
-	return nil
+	return WriteString(w, sp.v)
 }
-  
+
+// ReadUvarint reads a Variable Byte Integer of at most four bytes [MQTT-1.5.5]
 func ReadUvarint(r io.Reader) (uint32, error) {
-   u64, err := binary.ReadUvarint(r)
-   if err != nil {
-		return 0, err
-   }
-   if u64 > MAX_UINT {
-    	return 0, errors.New("uvarint32 overflow")
-   }
-   return uint32(u64), nil
+	var x uint32
+	var shift uint32
+	for i := 0; i < 4; i++ {
+		b, err := ReadByte(r)
+		if err != nil {
+			return 0, err
+		}
+		x |= uint32(b&0x7f) << shift
+		if b < 0x80 {
+			return x, nil
+		}
+		shift += 7
+	}
+	return 0, errors.New("uvarint32 overflow")
 }
 
 func WriteUvarint(w io.Writer, n uint32) error {
-	buff := make([]byte, 8)
 	if n > MAX_UINT {
-    	return errors.New("uvarint32 overflow > 268435455")
+		return errors.New("uvarint32 overflow > 268435455")
+	}
+	var buff [4]byte
+	m := 0
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		buff[m] = b
+		m++
+		if n == 0 {
+			break
+		}
 	}
-	m := binary.PutUvarint(buff, uint64(n))
-	m, err := w.Write(buff[:m])
+	_, err := w.Write(buff[:m])
 	return err
 }
 
-func ReadUTF8String(r io.Reader) ([]byte, error) {
-	n, err := ReadUint16(r)
-	if err != nil {
-		return nil, err
-	}
-	buff := make([]byte, n)
-	_, err := io.ReadFull(r, buff)
-	if err != nil {
-		return nil, err
-	}
-
-	if !utf8.Valid(buff) || !BasicUTFRegexp.Match(buff) {
-		return nil, errors.New("Invalid UTF8 encode")
-	}
-
-	return buff, nil
- }
+// ReadUTF8String reads a UTF-8 Encoded String, the characters MQTT does
+// not allow are refused [MQTT-1.5.3]
+func ReadUTF8String(r io.Reader) (string, error) {
+	return ReadString(r)
+}
 
- func WriteUTF8String(w io.Writer, buff []byte) error {
-	if !utf8.Valid(buff) || !BasicUTFRegexp.Match(buff) {
-		return errors.New("Invalid UTF8 encode")
+func WriteUTF8String(w io.Writer, v string) error {
+	if !IsValidString(v) {
+		return errInvalidUTF8
 	}
-	n := (len(buff))
-	err := WriteUint16(w, uint16(n))
-	if err != nil {
-		return err
-	}
-	_, err := w.Write(buff)
-	return err
+	return WriteString(w, v)
 }
 
 func ReadBinaryData(r io.Reader) ([]byte, error) {
@@ -194,42 +163,39 @@ func ReadBinaryData(r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	buff := make([]byte, n)
-	_, err := io.ReadFull(r, buff)
+	_, err = io.ReadFull(r, buff)
 	if err != nil {
 		return nil, err
 	}
 	return buff, nil
- }
+}
 
- func WriteBinaryData(w io.Writer, buff []byte) error {
-	n := (len(buff))
-	err := WriteUint16(w, uint16(n))
+func WriteBinaryData(w io.Writer, buff []byte) error {
+	err := WriteUint16(w, uint16(len(buff)))
 	if err != nil {
 		return err
 	}
-	_, err := w.Write(buff)
+	_, err = w.Write(buff)
 	return err
 }
 
 func boolToByte(b bool) byte {
-	switch b {
-	case true:
+	if b {
 		return 0x01
-	default:
-		return 0x00
 	}
+	return 0x00
 }
 
 func vlen(u uint32) int {
 	if u < 128 {
 		return 1
-	} 
+	}
 	if u < 16384 {
 		return 2
-	} 
+	}
 	if u < 2097152 {
 		return 3
-	} 
+	}
 	if u < 268435456 {
 		return 4
 	}
@@ -237,9 +203,5 @@ func vlen(u uint32) int {
 }
 
 func ReadRestData(r io.Reader) ([]byte, error) {
-	rest_data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
-	return rest_data, nil
- }
+	return ioutil.ReadAll(r)
+}